@@ -0,0 +1,59 @@
+package command
+
+import (
+	"fmt"
+	"github.com/songxinjianqwe/capsule/cli/util"
+	"github.com/songxinjianqwe/capsule/libcapsule"
+	"github.com/songxinjianqwe/capsule/libcapsule/facade"
+	"github.com/songxinjianqwe/capsule/libcapsule/util/stdio"
+	"github.com/urfave/cli"
+	"io"
+	"os"
+)
+
+/*
+连接到后台运行(run -d)的容器的stdio，可以有多个客户端同时attach
+*/
+var AttachCommand = cli.Command{
+	Name:  "attach",
+	Usage: "attach to the stdin, stdout and stderr of a detached container",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "detach-keys",
+			Value: stdio.DefaultDetachKeys,
+			Usage: "key sequence for detaching from the container, example: ctrl-p,ctrl-q",
+		},
+		cli.BoolFlag{
+			Name:  "no-stdin",
+			Usage: "do not attach stdin",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		if err := util.CheckArgs(ctx, 1, util.ExactArgs); err != nil {
+			return err
+		}
+		detachKeys, err := stdio.ParseDetachKeys(ctx.String("detach-keys"))
+		if err != nil {
+			return err
+		}
+		container, err := facade.GetContainer(ctx.GlobalString("root"), ctx.Args().First())
+		if err != nil {
+			return err
+		}
+		status, err := container.Status()
+		if err != nil {
+			return err
+		}
+		if status != libcapsule.Running {
+			return fmt.Errorf("cannot attach to a container in the %s state", status)
+		}
+		var stdin io.Reader = os.Stdin
+		if ctx.Bool("no-stdin") {
+			stdin = nil
+		}
+		if err := container.Attach(stdin, detachKeys); err != nil && err != stdio.ErrDetached {
+			return err
+		}
+		return nil
+	},
+}
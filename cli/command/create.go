@@ -2,6 +2,7 @@ package command
 
 import (
 	"github.com/songxinjianqwe/capsule/cli/util"
+	"github.com/songxinjianqwe/capsule/libcapsule/configs"
 	"github.com/songxinjianqwe/capsule/libcapsule/facade"
 	"github.com/urfave/cli"
 )
@@ -9,7 +10,15 @@ import (
 var CreateCommand = cli.Command{
 	Name:  "create",
 	Usage: "create a container",
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
+		cli.StringFlag{
+			Name:  "console-socket",
+			Usage: "path to an AF_UNIX socket which will receive a file descriptor referencing the master end of the console's pseudoterminal",
+		},
+		cli.BoolFlag{
+			Name:  "no-pivot",
+			Usage: "do not use pivot root to jail process inside rootfs, moves the rootfs onto / and chroots instead, use it when the rootfs is on top of a ramdisk",
+		},
 		cli.StringFlag{
 			Name:  "bundle, b",
 			Value: "",
@@ -23,7 +32,7 @@ var CreateCommand = cli.Command{
 			Name:  "port, p",
 			Usage: `port mappings, example: host port:container port`,
 		},
-	},
+	}, util.BandwidthFlags...),
 	Action: func(ctx *cli.Context) error {
 		if err := util.CheckArgs(ctx, 1, util.ExactArgs); err != nil {
 			return err
@@ -35,7 +44,15 @@ var CreateCommand = cli.Command{
 		if err != nil {
 			return err
 		}
-		if err := facade.CreateOrRunContainer(ctx.GlobalString("root"), ctx.Args().First(), ctx.String("bundle"), spec, facade.ContainerActCreate, false, ctx.String("network"), ctx.StringSlice("port")); err != nil {
+		bandwidth, err := util.ParseBandwidth(ctx)
+		if err != nil {
+			return err
+		}
+		if _, err := facade.CreateOrRunContainer(ctx.GlobalString("root"), ctx.Args().First(), ctx.String("bundle"), spec, facade.ContainerActCreate, false, ctx.String("console-socket"), false, ctx.Bool("no-pivot"), configs.EndpointConfig{
+			NetworkName:  ctx.String("network"),
+			PortMappings: ctx.StringSlice("port"),
+			Bandwidth:    bandwidth,
+		}); err != nil {
 			return err
 		}
 		return nil
@@ -16,6 +16,14 @@ var ExecCommand = cli.Command{
 			Name:  "detach, d",
 			Usage: "detach from the container's process",
 		},
+		cli.BoolFlag{
+			Name:  "tty, t",
+			Usage: "allocate a pseudo-TTY",
+		},
+		cli.BoolTFlag{
+			Name:  "sig-proxy",
+			Usage: "forward signals received by capsule to the exec process, only for foreground, --sig-proxy=false to disable",
+		},
 		cli.StringSliceFlag{
 			Name:  "env, e",
 			Usage: "set environment variables",
@@ -24,6 +32,18 @@ var ExecCommand = cli.Command{
 			Name:  "cwd",
 			Usage: "current work directory of exec process",
 		},
+		cli.StringFlag{
+			Name:  "user, u",
+			Usage: "user[:group] to run the exec process as, names or ids",
+		},
+		cli.StringSliceFlag{
+			Name:  "cap-add",
+			Usage: "add linux capabilities, e.g. --cap-add NET_ADMIN, ALL for all capabilities",
+		},
+		cli.StringSliceFlag{
+			Name:  "cap-drop",
+			Usage: "drop linux capabilities, e.g. --cap-drop CHOWN, ALL for all capabilities",
+		},
 	},
 	Action: func(ctx *cli.Context) error {
 		if err := util.CheckArgs(ctx, 2, util.MinArgs); err != nil {
@@ -33,19 +53,24 @@ var ExecCommand = cli.Command{
 		if len(args) == 1 && strings.Contains(args[0], " ") {
 			args = strings.Split(args[0], " ")
 		}
-		execId, err := facade.ExecContainer(
+		execId, exitStatus, err := facade.ExecContainer(
 			ctx.GlobalString("root"),
 			ctx.Args().First(),
 			ctx.Bool("detach"),
+			ctx.Bool("tty"),
+			ctx.BoolT("sig-proxy"),
 			args,
 			ctx.String("cwd"),
-			ctx.StringSlice("env"))
+			ctx.StringSlice("env"),
+			ctx.String("user"),
+			ctx.StringSlice("cap-add"),
+			ctx.StringSlice("cap-drop"))
 		if err != nil {
 			return err
 		}
 		if ctx.Bool("detach") {
 			fmt.Printf("exec id is %s\n", execId)
 		}
-		return nil
+		return util.ExitWithStatus(exitStatus)
 	},
 }
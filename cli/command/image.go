@@ -127,6 +127,9 @@ var imageGetCommand = cli.Command{
 // -memory
 // ~~~~~~~~~~~~~~~~~~~~~~~~~~~~~下面是spec里没有的,由capsule负责做的配置信息
 // -link
+// -dns -dns-search -dns-option
+// -add-host hostname:ip
+// -ingress-rate -ingress-burst -egress-rate -egress-burst
 // -volume a/a:b
 // -network $network_name
 // -port xx:xxx
@@ -134,11 +137,19 @@ var imageGetCommand = cli.Command{
 var imageRunContainerCommand = cli.Command{
 	Name:  "runc",
 	Usage: "run container in image way",
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		cli.BoolFlag{
 			Name:  "detach, d",
 			Usage: "detach from the container's process",
 		},
+		cli.BoolFlag{
+			Name:  "tty, t",
+			Usage: "allocate a pseudo-TTY",
+		},
+		cli.BoolTFlag{
+			Name:  "sig-proxy",
+			Usage: "forward signals received by capsule to the container init process, only for foreground, --sig-proxy=false to disable",
+		},
 		cli.StringFlag{
 			Name:  "id",
 			Usage: "container unique id",
@@ -152,6 +163,26 @@ var imageRunContainerCommand = cli.Command{
 			Name:  "env, e",
 			Usage: "environment variables",
 		},
+		cli.StringFlag{
+			Name:  "user, u",
+			Usage: "user[:group] to run the container process as, names or ids",
+		},
+		cli.StringSliceFlag{
+			Name:  "cap-add",
+			Usage: "add linux capabilities, e.g. --cap-add NET_ADMIN, ALL for all capabilities",
+		},
+		cli.StringSliceFlag{
+			Name:  "cap-drop",
+			Usage: "drop linux capabilities, e.g. --cap-drop CHOWN, ALL for all capabilities",
+		},
+		cli.StringSliceFlag{
+			Name:  "security-opt",
+			Usage: "security options, seccomp=<profile file> or seccomp=unconfined, the default seccomp profile is used if not set",
+		},
+		cli.StringSliceFlag{
+			Name:  "ulimit",
+			Usage: "resource limits of the container process, <type>=<soft>[:<hard>], e.g. --ulimit nofile=1024:2048",
+		},
 		cli.StringFlag{
 			Name:  "hostname, h",
 			Usage: "hostname",
@@ -187,7 +218,23 @@ var imageRunContainerCommand = cli.Command{
 			Name:  "link",
 			Usage: "-link container_id:alias",
 		},
-	},
+		cli.StringSliceFlag{
+			Name:  "dns",
+			Usage: "custom dns servers",
+		},
+		cli.StringSliceFlag{
+			Name:  "dns-search",
+			Usage: "custom dns search domains",
+		},
+		cli.StringSliceFlag{
+			Name:  "dns-option",
+			Usage: "custom dns options",
+		},
+		cli.StringSliceFlag{
+			Name:  "add-host",
+			Usage: "-add-host hostname:ip, add a custom host-to-IP mapping",
+		},
+	}, util.BandwidthFlags...),
 	Action: func(ctx *cli.Context) error {
 		if err := util.CheckArgs(ctx, 2, util.MinArgs); err != nil {
 			return err
@@ -209,16 +256,25 @@ var imageRunContainerCommand = cli.Command{
 			splits := strings.SplitN(label, "=", 2)
 			annotations[splits[0]] = splits[1]
 		}
+		bandwidth, err := util.ParseBandwidth(ctx)
+		if err != nil {
+			return err
+		}
 		args := ctx.Args()[1:]
 		if len(args) == 1 && strings.Contains(args[0], " ") {
 			args = strings.Split(args[0], " ")
 		}
-		if err := imageService.Run(&image.ImageRunArgs{
+		exitStatus, err := imageService.Run(&image.ImageRunArgs{
 			ImageId:      ctx.Args().First(),
 			ContainerId:  containerId,
 			Args:         args,
 			Env:          ctx.StringSlice("env"),
 			Cwd:          ctx.String("cwd"),
+			User:         ctx.String("user"),
+			CapAdd:       ctx.StringSlice("cap-add"),
+			CapDrop:      ctx.StringSlice("cap-drop"),
+			SecurityOpt:  ctx.StringSlice("security-opt"),
+			Ulimits:      ctx.StringSlice("ulimit"),
 			Hostname:     hostname,
 			Cpushare:     ctx.Uint64("cpushare"),
 			Memory:       ctx.Int64("memory"),
@@ -226,12 +282,20 @@ var imageRunContainerCommand = cli.Command{
 			Network:      ctx.String("network"),
 			PortMappings: ctx.StringSlice("port"),
 			Detach:       ctx.Bool("detach"),
+			Tty:          ctx.Bool("tty"),
+			SigProxy:     ctx.BoolT("sig-proxy"),
 			Volumes:      ctx.StringSlice("volume"),
 			Links:        ctx.StringSlice("link"),
-		}); err != nil {
+			Dns:          ctx.StringSlice("dns"),
+			DnsSearch:    ctx.StringSlice("dns-search"),
+			DnsOptions:   ctx.StringSlice("dns-option"),
+			ExtraHosts:   ctx.StringSlice("add-host"),
+			Bandwidth:    bandwidth,
+		})
+		if err != nil {
 			return err
 		}
-		return nil
+		return util.ExitWithStatus(exitStatus)
 	},
 }
 
@@ -3,14 +3,19 @@ package command
 import (
 	"github.com/sirupsen/logrus"
 	"github.com/songxinjianqwe/capsule/libcapsule"
+	"github.com/songxinjianqwe/capsule/libcapsule/constant"
 	_ "github.com/songxinjianqwe/capsule/libcapsule/nsenter"
 	"github.com/urfave/cli"
 	"os"
 	"runtime"
 )
 
+/*
+init命令的参数是--root $root init，不能根据os.Args[1]判断，只有init命令的环境变量中有initializer type
+capability等是线程级别的，设置完之后必须在同一个线程中执行命令
+*/
 func init() {
-	if len(os.Args) > 1 && os.Args[1] == "init" {
+	if os.Getenv(constant.EnvInitializerType) != "" {
 		logrus.Infof("setting go max procs = 1")
 		runtime.GOMAXPROCS(1)
 		runtime.LockOSThread()
@@ -30,6 +35,8 @@ var InitCommand = cli.Command{
 		}
 		if err := factory.StartInitialization(); err != nil {
 			logrus.WithField("init", true).Errorf("init failed, err: %s", err.Error())
+			// 对于前台exec来说，这就是exec的退出码
+			return cli.NewExitError("", 1)
 		}
 		return nil
 	},
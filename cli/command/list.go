@@ -22,12 +22,13 @@ var ListCommand = cli.Command{
 			return err
 		}
 		w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
-		fmt.Fprint(w, "ID\tPID\tSTATUS\tIP\tBUNDLE\tCREATED\n")
+		fmt.Fprint(w, "ID\tPID\tSTATUS\tEXIT\tIP\tBUNDLE\tCREATED\n")
 		for _, item := range vos {
-			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\n",
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t%s\n",
 				item.ID,
 				item.InitProcessPid,
 				item.Status,
+				formatExit(item),
 				item.IP,
 				item.Bundle,
 				item.Created.Format(time.RFC3339Nano))
@@ -38,3 +39,13 @@ var ListCommand = cli.Command{
 		return nil
 	},
 }
+
+/*
+比如 137(oom-killed) 2019-01-01T00:00:00Z，还没有退出时为-
+*/
+func formatExit(vo *facade.ContainerStateVO) string {
+	if vo.ExitCode == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%d(%s) %s", *vo.ExitCode, vo.StopReason, vo.FinishedAt.Format(time.RFC3339))
+}
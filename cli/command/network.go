@@ -4,9 +4,11 @@ import (
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"github.com/songxinjianqwe/capsule/cli/util"
+	"github.com/songxinjianqwe/capsule/libcapsule/facade"
 	"github.com/songxinjianqwe/capsule/libcapsule/network"
 	"github.com/urfave/cli"
 	"os"
+	"strings"
 	"text/tabwriter"
 )
 
@@ -25,6 +27,8 @@ var NetworkCommand = cli.Command{
 		networkDeleteCommand,
 		networkListCommand,
 		networkShowCommand,
+		networkPruneCommand,
+		networkDNSCommand,
 	},
 }
 
@@ -40,6 +44,23 @@ var networkCreateCommand = cli.Command{
 			Name:  "subnet",
 			Usage: "subnet cidr",
 		},
+		cli.StringFlag{
+			Name:  "gateway",
+			Usage: "gateway ip of the subnet, default is the first ip",
+		},
+		cli.StringFlag{
+			Name:  "ip-range",
+			Usage: "allocate container ip from a sub-range of the subnet",
+		},
+		cli.IntFlag{
+			Name:  "mtu",
+			Usage: "mtu of the bridge and veths",
+		},
+		cli.StringSliceFlag{
+			Name: "opt",
+			Usage: fmt.Sprintf("driver specific options, supported: %s=name, %s=true|false, %s=true|false",
+				network.BridgeNameOption, network.EnableIPMasqueradeOption, network.ICCOption),
+		},
 	},
 	Action: func(ctx *cli.Context) error {
 		if err := util.CheckArgs(ctx, 1, util.ExactArgs); err != nil {
@@ -53,8 +74,22 @@ var networkCreateCommand = cli.Command{
 		if subnet == "" {
 			return fmt.Errorf("subnet cant be empty")
 		}
-		if _, err := network.CreateNetwork(driver, subnet, ctx.Args().First()); err != nil {
-			return nil
+		options := make(map[string]string)
+		for _, opt := range ctx.StringSlice("opt") {
+			splits := strings.SplitN(opt, "=", 2)
+			if len(splits) != 2 {
+				return fmt.Errorf("invalid option %s, should be key=value", opt)
+			}
+			options[splits[0]] = splits[1]
+		}
+		if _, err := network.CreateNetwork(driver, ctx.Args().First(), &network.CreateOptions{
+			Subnet:  subnet,
+			Gateway: ctx.String("gateway"),
+			IpRange: ctx.String("ip-range"),
+			MTU:     ctx.Int("mtu"),
+			Options: options,
+		}); err != nil {
+			return err
 		}
 		return nil
 	},
@@ -136,3 +171,53 @@ var networkShowCommand = cli.Command{
 		return nil
 	},
 }
+
+var networkPruneCommand = cli.Command{
+	Name:  "prune",
+	Usage: "remove network resources not used by any container",
+	Action: func(ctx *cli.Context) error {
+		report, err := facade.PruneNetwork(ctx.GlobalString("root"))
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+		fmt.Fprint(w, "TYPE\tRESOURCE\n")
+		for _, endpoint := range report.Endpoints {
+			fmt.Fprintf(w, "endpoint\t%s\n", endpoint)
+		}
+		for _, link := range report.Links {
+			fmt.Fprintf(w, "link\t%s\n", link)
+		}
+		for _, mapping := range report.PortMappings {
+			fmt.Fprintf(w, "port mapping\t%s\n", mapping)
+		}
+		for _, ip := range report.IPs {
+			fmt.Fprintf(w, "ip\t%s\n", ip)
+		}
+		return w.Flush()
+	},
+}
+
+/*
+网络的DNS server，由容器连接网络时自动在后台启动，不需要手动调用
+*/
+var networkDNSCommand = cli.Command{
+	Name:   "dns",
+	Usage:  "run the embedded dns server of a network",
+	Hidden: true,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "daemon",
+			Usage: "start the dns server in background and return",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		if err := util.CheckArgs(ctx, 1, util.ExactArgs); err != nil {
+			return err
+		}
+		if ctx.Bool("daemon") {
+			return network.StartDNSServerDaemon(ctx.Args().First())
+		}
+		return network.ServeDNS(ctx.Args().First())
+	},
+}
@@ -16,12 +16,17 @@ var PsCommand = cli.Command{
 		if err := util.CheckArgs(ctx, 1, util.ExactArgs); err != nil {
 			return err
 		}
-		if _, err := facade.ExecContainer(
+		if _, _, err := facade.ExecContainer(
 			ctx.GlobalString("root"),
 			ctx.Args().First(),
 			false,
+			false,
+			true,
 			[]string{"ps", "-ef"},
 			"",
+			nil,
+			"",
+			nil,
 			nil); err != nil {
 			return err
 		}
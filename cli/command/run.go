@@ -2,6 +2,7 @@ package command
 
 import (
 	"github.com/songxinjianqwe/capsule/cli/util"
+	"github.com/songxinjianqwe/capsule/libcapsule/configs"
 	"github.com/songxinjianqwe/capsule/libcapsule/facade"
 	"github.com/urfave/cli"
 )
@@ -14,11 +15,27 @@ import (
 var RunCommand = cli.Command{
 	Name:  "run",
 	Usage: "create and start a container",
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		cli.BoolFlag{
 			Name:  "detach, d",
 			Usage: "detach from the container's process",
 		},
+		cli.BoolFlag{
+			Name:  "tty, t",
+			Usage: "allocate a pseudo-TTY, overrides process.terminal in config.json",
+		},
+		cli.BoolTFlag{
+			Name:  "sig-proxy",
+			Usage: "forward signals received by capsule to the container init process, only for foreground, --sig-proxy=false to disable",
+		},
+		cli.StringFlag{
+			Name:  "console-socket",
+			Usage: "path to an AF_UNIX socket which will receive a file descriptor referencing the master end of the console's pseudoterminal",
+		},
+		cli.BoolFlag{
+			Name:  "no-pivot",
+			Usage: "do not use pivot root to jail process inside rootfs, moves the rootfs onto / and chroots instead, use it when the rootfs is on top of a ramdisk",
+		},
 		cli.StringFlag{
 			Name:  "bundle, b",
 			Value: "",
@@ -32,7 +49,7 @@ var RunCommand = cli.Command{
 			Name:  "port, p",
 			Usage: `port mapping, host port:container port`,
 		},
-	},
+	}, util.BandwidthFlags...),
 	Action: func(ctx *cli.Context) error {
 		if err := util.CheckArgs(ctx, 1, util.ExactArgs); err != nil {
 			return err
@@ -44,9 +61,21 @@ var RunCommand = cli.Command{
 		if err != nil {
 			return err
 		}
-		if err := facade.CreateOrRunContainer(ctx.GlobalString("root"), ctx.Args().First(), ctx.String("bundle"), spec, facade.ContainerActRun, ctx.Bool("detach"), ctx.String("network"), ctx.StringSlice("port")); err != nil {
+		if ctx.Bool("tty") {
+			spec.Process.Terminal = true
+		}
+		bandwidth, err := util.ParseBandwidth(ctx)
+		if err != nil {
+			return err
+		}
+		exitStatus, err := facade.CreateOrRunContainer(ctx.GlobalString("root"), ctx.Args().First(), ctx.String("bundle"), spec, facade.ContainerActRun, ctx.Bool("detach"), ctx.String("console-socket"), ctx.BoolT("sig-proxy"), ctx.Bool("no-pivot"), configs.EndpointConfig{
+			NetworkName:  ctx.String("network"),
+			PortMappings: ctx.StringSlice("port"),
+			Bandwidth:    bandwidth,
+		})
+		if err != nil {
 			return err
 		}
-		return nil
+		return util.ExitWithStatus(exitStatus)
 	},
 }
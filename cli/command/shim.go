@@ -0,0 +1,31 @@
+package command
+
+import (
+	"github.com/songxinjianqwe/capsule/cli/util"
+	"github.com/songxinjianqwe/capsule/libcapsule"
+	"github.com/urfave/cli"
+)
+
+/*
+每个容器的shim进程，由capsule在创建容器时自动启动，不需要手动调用
+*/
+var ShimCommand = cli.Command{
+	Name:   "shim",
+	Usage:  "start the container process, reap it and relay its stdio",
+	Hidden: true,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "daemon",
+			Usage: "start the shim in background and return",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		if err := util.CheckArgs(ctx, 1, util.ExactArgs); err != nil {
+			return err
+		}
+		if ctx.Bool("daemon") {
+			return libcapsule.StartShimDaemon(ctx.GlobalString("root"), ctx.Args().First())
+		}
+		return libcapsule.ServeShim(ctx.GlobalString("root"), ctx.Args().First())
+	},
+}
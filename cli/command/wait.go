@@ -0,0 +1,51 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"github.com/songxinjianqwe/capsule/cli/util"
+	"github.com/songxinjianqwe/capsule/libcapsule/facade"
+	"github.com/urfave/cli"
+)
+
+/*
+阻塞直至容器停止，依次打印每个容器init进程的退出码
+*/
+var WaitCommand = cli.Command{
+	Name:      "wait",
+	Usage:     "block until one or more containers stop, then print their exit codes",
+	ArgsUsage: `<container-id> [container-id...]`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "condition",
+			Value: facade.WaitConditionStopped,
+			Usage: "wait until the container is stopped or removed",
+		},
+		cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "give up waiting after this duration, 0 means no timeout",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		if err := util.CheckArgs(ctx, 1, util.MinArgs); err != nil {
+			return err
+		}
+		waitCtx := context.Background()
+		if timeout := ctx.Duration("timeout"); timeout > 0 {
+			var cancel context.CancelFunc
+			waitCtx, cancel = context.WithTimeout(waitCtx, timeout)
+			defer cancel()
+		}
+		for _, id := range ctx.Args() {
+			exitStatus, err := facade.WaitContainer(waitCtx, ctx.GlobalString("root"), id, ctx.String("condition"))
+			if err == context.DeadlineExceeded {
+				return fmt.Errorf("timed out waiting for container %s", id)
+			}
+			if err != nil {
+				return err
+			}
+			fmt.Println(exitStatus.ExitCode)
+		}
+		return nil
+	},
+}
@@ -2,6 +2,7 @@ package util
 
 import (
 	"fmt"
+	"github.com/songxinjianqwe/capsule/libcapsule"
 	"github.com/urfave/cli"
 	"os"
 )
@@ -47,3 +48,13 @@ func CheckNoFile(fileName string) error {
 	}
 	return nil
 }
+
+/*
+前台运行的容器进程退出后，capsule以同样的退出码退出，被信号杀死时为128+信号值
+*/
+func ExitWithStatus(status *libcapsule.ExitStatus) error {
+	if status == nil || status.ExitCode == 0 {
+		return nil
+	}
+	return cli.NewExitError("", status.ExitCode)
+}
@@ -0,0 +1,65 @@
+package util
+
+import (
+	"fmt"
+	"github.com/songxinjianqwe/capsule/libcapsule/configs"
+	"github.com/songxinjianqwe/capsule/libcapsule/network"
+	"github.com/urfave/cli"
+)
+
+// run、create、image runc共用的限速参数
+var BandwidthFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "ingress-rate",
+		Usage: "limit the rate of traffic into the container, example: 10mbit, 1mbps",
+	},
+	cli.StringFlag{
+		Name:  "ingress-burst",
+		Usage: "burst size of ingress rate limit, example: 32kb",
+	},
+	cli.StringFlag{
+		Name:  "egress-rate",
+		Usage: "limit the rate of traffic out of the container, example: 10mbit, 1mbps",
+	},
+	cli.StringFlag{
+		Name:  "egress-burst",
+		Usage: "burst size of egress rate limit, example: 32kb",
+	},
+}
+
+/*
+没有指定任何限速时返回nil，burst只能与同一方向的rate一起使用
+*/
+func ParseBandwidth(ctx *cli.Context) (*configs.Bandwidth, error) {
+	for _, direction := range []string{"ingress", "egress"} {
+		if ctx.String(direction+"-burst") != "" && ctx.String(direction+"-rate") == "" {
+			return nil, fmt.Errorf("--%s-burst requires --%s-rate", direction, direction)
+		}
+	}
+	if ctx.String("ingress-rate") == "" && ctx.String("egress-rate") == "" {
+		return nil, nil
+	}
+	bandwidth := &configs.Bandwidth{}
+	var err error
+	if rate := ctx.String("ingress-rate"); rate != "" {
+		if bandwidth.IngressRate, err = network.ParseRate(rate); err != nil {
+			return nil, err
+		}
+	}
+	if burst := ctx.String("ingress-burst"); burst != "" {
+		if bandwidth.IngressBurst, err = network.ParseSize(burst); err != nil {
+			return nil, err
+		}
+	}
+	if rate := ctx.String("egress-rate"); rate != "" {
+		if bandwidth.EgressRate, err = network.ParseRate(rate); err != nil {
+			return nil, err
+		}
+	}
+	if burst := ctx.String("egress-burst"); burst != "" {
+		if bandwidth.EgressBurst, err = network.ParseSize(burst); err != nil {
+			return nil, err
+		}
+	}
+	return bandwidth, nil
+}
@@ -23,4 +23,7 @@ type CgroupManager interface {
 
 	// Sets the cgroup as configured.
 	SetConfig(cgroupConfig *configs.Cgroup) error
+
+	// Returns how many times the OOM killer has killed a process in the memory cgroup.
+	OOMKillCount() (uint64, error)
 }
@@ -1,6 +1,7 @@
 package cgroups
 
 import (
+	"fmt"
 	"github.com/sirupsen/logrus"
 	"github.com/songxinjianqwe/capsule/libcapsule/configs"
 	"sync"
@@ -67,3 +68,13 @@ func (m *LinuxCgroupManager) SetConfig(cgroupConfig *configs.Cgroup) error {
 	}
 	return nil
 }
+
+func (m *LinuxCgroupManager) OOMKillCount() (uint64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	memoryPath, ok := m.Paths[(&MemorySubsystem{}).Name()]
+	if !ok {
+		return 0, fmt.Errorf("cgroup set %s has not joined memory subsystem", m.CgroupName)
+	}
+	return readOOMKillCount(memoryPath)
+}
@@ -1,9 +1,14 @@
 package cgroups
 
 import (
+	"bufio"
+	"fmt"
 	"github.com/sirupsen/logrus"
 	"github.com/songxinjianqwe/capsule/libcapsule/configs"
+	"os"
+	"path"
 	"strconv"
+	"strings"
 )
 
 type MemorySubsystem struct {
@@ -22,3 +27,28 @@ func (subsys *MemorySubsystem) SetConfig(cgroupName string, cgroupConfig *config
 	}
 	return nil
 }
+
+/*
+memory.oom_control的格式如下，oom_kill这一行需要4.13以上的内核
+oom_kill_disable 0
+under_oom 0
+oom_kill 1
+*/
+func readOOMKillCount(cgroupPath string) (uint64, error) {
+	file, err := os.Open(path.Join(cgroupPath, "memory.oom_control"))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			return strconv.ParseUint(fields[1], 10, 64)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("oom_kill not found in %s", path.Join(cgroupPath, "memory.oom_control"))
+}
@@ -8,6 +8,13 @@ type ContainerConfig struct {
 	// bind mounts are writtable.
 	Readonlyfs bool `json:"readonlyfs"`
 
+	// RootPropagation specifies the propagation of the mounts under the container's root, rslave if not set
+	RootPropagation int `json:"rootfs_propagation"`
+
+	// NoPivotRoot will use MS_MOVE and a chroot to jail the process into the container's rootfs
+	// This is a common option when the container is running in ramdisk
+	NoPivotRoot bool `json:"no_pivot_root"`
+
 	// Mounts specify additional source and destination paths that will be mounted inside the container's
 	// rootfs and mount namespace if specified
 	Mounts []*Mount `json:"mounts"`
@@ -34,6 +41,17 @@ type ContainerConfig struct {
 	// sysctl -w my.property.name value in Linux.
 	Sysctl map[string]string `json:"sysctl"`
 
+	// MaskPaths specifies paths within the container's rootfs to mask over with a bind
+	// mount pointing to /dev/null as to prevent reads of the file.
+	MaskPaths []string `json:"mask_paths"`
+
+	// ReadonlyPaths specifies paths within the container's rootfs to remount as read-only
+	// so that these files prevent any writes.
+	ReadonlyPaths []string `json:"readonly_paths"`
+
+	// Seccomp specifies the syscall filter of the container processes, nil means unconfined
+	Seccomp *Seccomp `json:"seccomp"`
+
 	// Version is the version of opencontainer specification that is supported.
 	Version string `json:"version"`
 
@@ -15,4 +15,7 @@ type Mount struct {
 
 	// Mount data applied to the mount.
 	Data string `json:"data"`
+
+	// Propagation Flags
+	PropagationFlags []int `json:"propagation_flags"`
 }
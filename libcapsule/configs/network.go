@@ -5,4 +5,21 @@ type EndpointConfig struct {
 	ID           string   `json:"id"`
 	NetworkName  string   `json:"network_name"`
 	PortMappings []string `json:"port_mappings"`
+	// container_id:alias，由网络的DNS server解析
+	Links []string `json:"links"`
+	// 自定义的nameserver
+	DNS []string `json:"dns"`
+	// 带宽限制，为nil时不限制
+	Bandwidth *Bandwidth `json:"bandwidth"`
+}
+
+/*
+容器的带宽限制，ingress/egress均是站在容器的角度
+*/
+type Bandwidth struct {
+	// 单位均为byte，rate为0表示该方向不限制
+	IngressRate  uint64 `json:"ingress_rate"`
+	IngressBurst uint64 `json:"ingress_burst"`
+	EgressRate   uint64 `json:"egress_rate"`
+	EgressBurst  uint64 `json:"egress_burst"`
 }
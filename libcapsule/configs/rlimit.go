@@ -0,0 +1,42 @@
+package configs
+
+import "fmt"
+
+/*
+setrlimit的参数
+*/
+type Rlimit struct {
+	Type int    `json:"type"`
+	Hard uint64 `json:"hard"`
+	Soft uint64 `json:"soft"`
+}
+
+/*
+rlimit的名字与编号，见sys/resource.h
+vendor中的unix包没有全部的常量，这里直接写数字
+*/
+var rlimitTypes = map[string]int{
+	"RLIMIT_CPU":        0,
+	"RLIMIT_FSIZE":      1,
+	"RLIMIT_DATA":       2,
+	"RLIMIT_STACK":      3,
+	"RLIMIT_CORE":       4,
+	"RLIMIT_RSS":        5,
+	"RLIMIT_NPROC":      6,
+	"RLIMIT_NOFILE":     7,
+	"RLIMIT_MEMLOCK":    8,
+	"RLIMIT_AS":         9,
+	"RLIMIT_LOCKS":      10,
+	"RLIMIT_SIGPENDING": 11,
+	"RLIMIT_MSGQUEUE":   12,
+	"RLIMIT_NICE":       13,
+	"RLIMIT_RTPRIO":     14,
+	"RLIMIT_RTTIME":     15,
+}
+
+func ParseRlimitType(name string) (int, error) {
+	if t, ok := rlimitTypes[name]; ok {
+		return t, nil
+	}
+	return -1, fmt.Errorf("unknown rlimit type %q", name)
+}
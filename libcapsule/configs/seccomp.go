@@ -0,0 +1,34 @@
+package configs
+
+/*
+与OCI的linux.seccomp一致，可以直接从config.json中解析
+vendor中的runtime-spec还没有errnoRet，所以单独定义
+*/
+type Seccomp struct {
+	// DefaultAction is the action taken when no syscall rule matches
+	DefaultAction string `json:"defaultAction"`
+	// DefaultErrnoRet is the errno returned by the default action, EPERM if not set
+	DefaultErrnoRet *uint `json:"defaultErrnoRet,omitempty"`
+	// Architectures are the architectures the filter applies to
+	Architectures []string `json:"architectures,omitempty"`
+	// Syscalls are the syscall rules
+	Syscalls []*Syscall `json:"syscalls,omitempty"`
+}
+
+type Syscall struct {
+	// Names are the syscall names the rule applies to
+	Names []string `json:"names"`
+	// Action is the action taken when the syscall matches
+	Action string `json:"action"`
+	// ErrnoRet is the errno returned by SCMP_ACT_ERRNO, EPERM if not set
+	ErrnoRet *uint `json:"errnoRet,omitempty"`
+	// Args are the conditions on syscall arguments, all of them must match
+	Args []*SeccompArg `json:"args,omitempty"`
+}
+
+type SeccompArg struct {
+	Index    uint   `json:"index"`
+	Value    uint64 `json:"value"`
+	ValueTwo uint64 `json:"valueTwo,omitempty"`
+	Op       string `json:"op"`
+}
@@ -3,8 +3,9 @@ package constant
 const (
 	// 容器状态文件的文件名
 	// 存放在 $RuntimeRoot/$containerId/下
-	StateFilename       = "state.json"
-	NotExecFlagFilename = "not-exec.flag"
+	StateFilename = "state.json"
+	// Created状态的容器init进程阻塞在打开该fifo的写端上，capsule start打开读端后开始执行命令
+	ExecFifoFilename = "exec.fifo"
 
 	// 运行时文件的存放目录
 	DefaultRuntimeRoot = "/var/run/capsule"
@@ -17,7 +18,20 @@ const (
 	ContainerInitLogFilename = "container.log"
 	// 容器Exec进程的日志名模板
 	ContainerExecLogFilenamePattern = "exec-%s.log"
-	IPAMDefaultAllocatorPath        = "/network/ipam/subnet.json"
+	// 后台运行的容器的stdio relay监听的socket，capsule attach连接到这里
+	ContainerAttachSocketFilename = "attach.sock"
+	// 每个容器的shim进程的控制socket和日志
+	ContainerShimSocketFilename = "shim.sock"
+	ContainerShimLogFilename    = "shim.log"
+	IPAMDefaultAllocatorPath    = "/network/ipam/subnet.json"
+	// 各个网络的配置，存放在 $RuntimeRoot/network/networks/$networkName.json
+	NetworkNetworksDir = "/network/networks"
+	// 各个网络的endpoint，存放在 $RuntimeRoot/network/endpoints/$networkName/$endpointName.json
+	NetworkEndpointsDir = "/network/endpoints"
+	// 各个网络的DNS server的pid文件和日志
+	NetworkDNSDir = "/network/dns"
+	// Connect与Prune互斥的文件锁，即 $RuntimeRoot/network/network.lock
+	NetworkLockPath = "/network/network"
 
 	// 重新执行本应用的command，相当于 重新执行./capsule
 	ContainerInitCmd = "/proc/self/exe"
@@ -27,6 +41,12 @@ const (
 	// 容器初始化相关的常量
 	EnvConfigPipe      = "_LIBCAPSULE_CONFIG_PIPE"
 	EnvInitializerType = "_LIBCAPSULE_INITIALIZER_TYPE"
+	// 终端模式下，容器进程通过该socket将pty master发送给parent
+	EnvConsoleSocket = "_LIBCAPSULE_CONSOLE_SOCKET"
+	// 容器init进程通过该fd(O_PATH)重新打开exec.fifo
+	EnvExecFifo = "_LIBCAPSULE_EXEC_FIFO"
+	// shim启动容器进程所需的信息
+	EnvShimConfig = "_LIBCAPSULE_SHIM_CONFIG"
 	/*
 		一个进程默认有三个文件描述符，stdin、stdout、stderr
 		外带的文件描述符在这三个fd之后
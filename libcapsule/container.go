@@ -1,8 +1,10 @@
 package libcapsule
 
 import (
+	"context"
 	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/songxinjianqwe/capsule/libcapsule/configs"
+	"io"
 	"os"
 )
 
@@ -61,4 +63,21 @@ type Container interface {
 	// errors:
 	// SystemError - System util.
 	Start() error
+
+	// 连接到后台运行的容器的stdin、stdout、stderr，stdin为nil时只读取输出
+	// 按下detachKeys时返回ErrDetached
+	// errors:
+	// SystemError - System util.
+	Attach(stdin io.Reader, detachKeys []byte) error
+
+	// 调整容器终端的窗口大小，仅对分配了终端的容器有效
+	// errors:
+	// SystemError - System util.
+	Resize(width uint16, height uint16) error
+
+	// 阻塞直至容器init进程退出，返回其退出状态，容器已经停止时立即返回
+	// errors:
+	// ContainerNotExists - Container no longer exists,
+	// SystemError - System util.
+	Wait(ctx context.Context) (*ExitStatus, error)
 }
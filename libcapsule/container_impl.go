@@ -1,16 +1,20 @@
 package libcapsule
 
 import (
+	"context"
+	"fmt"
 	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/sirupsen/logrus"
 	"github.com/songxinjianqwe/capsule/libcapsule/cgroups"
 	"github.com/songxinjianqwe/capsule/libcapsule/configs"
+	"github.com/songxinjianqwe/capsule/libcapsule/constant"
 	"github.com/songxinjianqwe/capsule/libcapsule/network"
 	"github.com/songxinjianqwe/capsule/libcapsule/util"
 	"github.com/songxinjianqwe/capsule/libcapsule/util/exception"
+	"github.com/songxinjianqwe/capsule/libcapsule/util/proc"
 	"os"
+	"path/filepath"
 	"sync"
-	"syscall"
 	"time"
 )
 
@@ -25,6 +29,7 @@ type LinuxContainer struct {
 	parentProcess  ParentProcess
 	statusBehavior ContainerStatusBehavior
 	createdTime    time.Time
+	exitStatus     *ExitStatus
 	mutex          sync.Mutex
 }
 
@@ -71,6 +76,7 @@ func (c *LinuxContainer) Create(process *Process) error {
 /*
 CreateAndStart
 如果是exec（即不是init cmd），则在start中就会执行cmd，不需要exec再通知
+前台运行时，返回后process.ExitStatus即为进程的退出状态
 */
 func (c *LinuxContainer) Run(process *Process) error {
 	c.mutex.Lock()
@@ -82,6 +88,7 @@ func (c *LinuxContainer) Run(process *Process) error {
 		if err := c.start(); err != nil {
 			return err
 		}
+		process.ExitStatus = c.exitStatus
 	}
 	return nil
 }
@@ -118,23 +125,44 @@ func (c *LinuxContainer) Signal(s os.Signal) error {
 	return exception.NewGenericErrorWithContext(err, exception.ContainerNotRunningError, "signaling init process")
 }
 
+func (c *LinuxContainer) Resize(width uint16, height uint16) error {
+	if !shimRunning(c.containerRoot) {
+		return exception.NewGenericError(fmt.Errorf("container %s is not running", c.id), exception.ContainerNotRunningError)
+	}
+	return shimResize(c.containerRoot, width, height)
+}
+
+func (c *LinuxContainer) Wait(ctx context.Context) (*ExitStatus, error) {
+	c.mutex.Lock()
+	status, err := c.currentStatus()
+	c.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if status != Stopped {
+		logrus.Infof("waiting init process %d exit...", c.parentProcess.pid())
+		if err := proc.WaitExit(ctx, c.parentProcess.pid()); err != nil {
+			return nil, err
+		}
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.loadExitStatus()
+}
+
 // ************************************************************************************************
 // private
 // ************************************************************************************************
 
 /*
-1. parent create child
-2.1 parent init, then send config
-2.2 child init, then wait config
-3. child wait parent config
-4. parent send config
-5.1 parent continue to init, then wait child SIGUSR1/SIGCHLD signal
-5.2 child continue to init, then send signal
-6. child init complete/failed, send SIGUSR1/SIGCHLD signal to parent
-7. parent received signal, then refresh state
-8. child wait parent SIGUSR2 signal
-9. if create, then parent exit; if run, then parent send SIGUSR2 signal to child
-10. child received SIGUSR2 signal, then start command
+1. parent create child(init process is started by shim)
+2. child wait parent config
+3. parent send config over the socketpair
+4. child init, then reply ready over the socketpair, or reply error if failed
+5. parent received ready, then save state
+6. child open exec.fifo for write, blocked until parent opens it for read
+7. if create, then parent exit; if run(or start later), then parent open exec.fifo for read
+8. child write one byte to exec.fifo, then start command
 */
 func (c *LinuxContainer) create(process *Process) error {
 	logrus.Infof("LinuxContainer starting...")
@@ -159,14 +187,10 @@ func (c *LinuxContainer) create(process *Process) error {
 		c.statusBehavior = &CreatedStatusBehavior{
 			c: c,
 		}
-		// 4、持久化容器状态
+		// 4、持久化容器状态，exec.fifo存在即表示Created
 		if err = c.saveState(); err != nil {
 			return err
 		}
-		// 5、创建标记文件，表示Created
-		if err := c.createFlagFile(); err != nil {
-			return err
-		}
 	}
 	logrus.Infof("create/exec container complete!")
 	return nil
@@ -178,13 +202,9 @@ func (c *LinuxContainer) start() error {
 	// 目前一定是Created状态
 	util.PrintSubsystemPids("memory", c.id, "before container start", false)
 
-	logrus.Infof("send SIGUSR2 to child process...")
-	if err := c.parentProcess.signal(syscall.SIGUSR2); err != nil {
-		return err
-	}
-	// 这里不好判断是否是之前在运行的是否是init process，索性就 有就删，没有就算了
-	if err := c.deleteFlagFileIfExists(); err != nil {
-		return err
+	logrus.Infof("opening exec fifo...")
+	if err := c.openExecFifo(); err != nil {
+		return exception.NewGenericErrorWithContext(err, exception.PipeError, "opening exec fifo")
 	}
 	logrus.Infof("refreshing container status...")
 	if err := c.refreshStatus(); err != nil {
@@ -193,9 +213,11 @@ func (c *LinuxContainer) start() error {
 	// 对于前台进程来说，这里必须wait，否则在仅有容器进程存活情况下，它在输入任何命令后立即退出，并且ssh进程退出/登录用户注销
 	if !c.parentProcess.detach() {
 		logrus.Infof("wait child process exit...")
-		if err := c.parentProcess.wait(); err != nil {
+		status, err := c.parentProcess.wait()
+		if err != nil {
 			return exception.NewGenericErrorWithContext(err, exception.ParentProcessWaitError, "waiting child process exit")
 		}
+		c.exitStatus = status
 		logrus.Infof("child process exited")
 	}
 	return nil
@@ -213,6 +235,7 @@ func (c *LinuxContainer) currentState() (*StateStorage, error) {
 		CgroupPaths:          c.cgroupManager.GetPaths(),
 		NamespacePaths:       make(map[configs.NamespaceType]string),
 		Endpoint:             c.endpoint,
+		ExitStatus:           c.exitStatus,
 	}
 	if initProcessPid > 0 {
 		for _, ns := range c.config.Namespaces {
@@ -255,3 +278,31 @@ func (c *LinuxContainer) currentStatus() (ContainerStatus, error) {
 	}
 	return c.statusBehavior.status(), nil
 }
+
+/*
+容器init进程退出后，shim先在state.json中记录退出状态再退出
+shim还在运行时直接向它要，否则从state.json中读取
+*/
+func (c *LinuxContainer) loadExitStatus() (*ExitStatus, error) {
+	if c.exitStatus != nil {
+		return c.exitStatus, nil
+	}
+	if shimRunning(c.containerRoot) {
+		if status, err := shimWait(c.containerRoot); err == nil {
+			c.exitStatus = status
+			return status, nil
+		}
+	}
+	state, err := loadStateStorage(filepath.Join(c.containerRoot, constant.StateFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, exception.NewGenericError(fmt.Errorf("container %s does not exist", c.id), exception.ContainerNotExistsError)
+		}
+		return nil, err
+	}
+	if state.ExitStatus == nil {
+		return nil, fmt.Errorf("exit status of container %s was not recorded", c.id)
+	}
+	c.exitStatus = state.ExitStatus
+	return c.exitStatus, nil
+}
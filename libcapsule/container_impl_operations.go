@@ -1,24 +1,30 @@
 package libcapsule
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"github.com/songxinjianqwe/capsule/libcapsule/configs"
 	"github.com/songxinjianqwe/capsule/libcapsule/constant"
 	"github.com/songxinjianqwe/capsule/libcapsule/util"
+	"github.com/songxinjianqwe/capsule/libcapsule/util/exception"
+	"github.com/songxinjianqwe/capsule/libcapsule/util/filelock"
 	"github.com/songxinjianqwe/capsule/libcapsule/util/proc"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 /*
 可以根据容器进程状态判断:
 1. 如果进程不存在，或状态异常，则说明为Stopped
 2. 如果进程存在，那么有可能是Created或Running，从进程状态没有办法区别
-3. parent process在创建容器之后会创建一个标记文件，标记容器尚未执行init process命令
+3. parent process在创建容器时会创建exec.fifo，容器init进程阻塞在打开它的写端上，尚未执行命令
 4. parent process在启动容器之后会删除该文件。
 */
 func (c *LinuxContainer) detectContainerStatus() (ContainerStatus, error) {
@@ -35,9 +41,9 @@ func (c *LinuxContainer) detectContainerStatus() (ContainerStatus, error) {
 		return Stopped, nil
 	}
 	// 容器进程存在的话，会有两种情况：一种是调用完create方法，容器进程阻塞在cmd之前；一种是容器进程解除阻塞，执行了cmd
-	// 在容器创建后，会创建该标记；在容器启动后，会删除该标记
-	// 如果标记存在，则说明是创建容器之后，启动容器之前
-	if _, err := os.Stat(filepath.Join(c.containerRoot, constant.NotExecFlagFilename)); err == nil {
+	// 在容器创建时，会创建exec.fifo；在容器启动后，会删除exec.fifo
+	// 如果exec.fifo存在，则说明是创建容器之后，启动容器之前
+	if _, err := os.Stat(filepath.Join(c.containerRoot, constant.ExecFifoFilename)); err == nil {
 		return Created, nil
 	}
 	return Running, nil
@@ -65,7 +71,7 @@ func (c *LinuxContainer) refreshStatus() error {
 
 /*
 更新容器状态文件state.json
-这个文件中不存储真正容器的状态，只需要在创建容器后创建文件即可，此后不再修改
+这个文件中不存储真正容器的状态，只需要在创建容器后创建文件即可，此后只有shim会在容器init进程退出后写入退出状态
 */
 func (c *LinuxContainer) saveState() error {
 	state, err := c.currentState()
@@ -75,43 +81,98 @@ func (c *LinuxContainer) saveState() error {
 	logrus.Infof("current state is %#v", state)
 	stateFilePath := filepath.Join(c.containerRoot, constant.StateFilename)
 	logrus.Infof("saving state in file: %s", stateFilePath)
-	file, err := os.Create(stateFilePath)
+	// 写临时文件再rename，其他进程(比如capsule list)不会读到写了一半的state.json
+	fileLock, err := filelock.Lock(stateFilePath)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	defer fileLock.Unlock()
 	bytes, err := json.Marshal(state)
 	if err != nil {
 		return err
 	}
-	if _, err = file.WriteString(string(bytes)); err != nil {
+	if err := filelock.WriteFileAtomic(stateFilePath, bytes, 0644); err != nil {
 		return err
 	}
 	logrus.Infof("save state complete")
 	return nil
 }
 
-func (c *LinuxContainer) createFlagFile() error {
-	flagFilePath := filepath.Join(c.containerRoot, constant.NotExecFlagFilename)
-	logrus.Infof("creating not exec flag in file: %s", flagFilePath)
-	file, err := os.Create(flagFilePath)
+/*
+创建exec.fifo，并以O_PATH打开传给容器init进程
+O_PATH打开fifo不会阻塞，容器init进程通过/proc/self/fd重新打开它的写端
+*/
+func (c *LinuxContainer) createExecFifo(cmd *exec.Cmd) error {
+	fifoPath := filepath.Join(c.containerRoot, constant.ExecFifoFilename)
+	logrus.Infof("creating exec fifo: %s", fifoPath)
+	if err := unix.Mkfifo(fifoPath, 0622); err != nil {
+		return err
+	}
+	// 容器进程可能已经切换为非root用户，需要other可写，不受umask影响
+	if err := os.Chmod(fifoPath, 0622); err != nil {
+		os.Remove(fifoPath)
+		return err
+	}
+	fd, err := unix.Open(fifoPath, unix.O_PATH|unix.O_CLOEXEC, 0)
 	if err != nil {
+		os.Remove(fifoPath)
 		return err
 	}
-	defer file.Close()
-	logrus.Infof("save flag complete")
+	cmd.ExtraFiles = append(cmd.ExtraFiles, os.NewFile(uintptr(fd), fifoPath))
+	cmd.Env = append(cmd.Env,
+		fmt.Sprintf(constant.EnvExecFifo+"=%d", constant.DefaultStdFdCount+len(cmd.ExtraFiles)-1),
+	)
 	return nil
 }
 
-func (c *LinuxContainer) deleteFlagFileIfExists() error {
-	flagFilePath := filepath.Join(c.containerRoot, constant.NotExecFlagFilename)
-	_, err := os.Stat(flagFilePath)
-	if err == nil {
-		// 如果文件存在，则删除
-		logrus.Infof("deleting flag :%s", flagFilePath)
-		return os.Remove(flagFilePath)
+/*
+打开exec.fifo的读端，容器init进程随之打开写端并写入一个字节，然后执行命令
+容器init进程如果在此之前就已经退出，open会一直阻塞，所以同时等待它退出
+*/
+func (c *LinuxContainer) openExecFifo() error {
+	fifoPath := filepath.Join(c.containerRoot, constant.ExecFifoFilename)
+	type fifoResult struct {
+		data []byte
+		err  error
 	}
-	return nil
+	opened := make(chan fifoResult, 1)
+	go func() {
+		fifo, err := os.OpenFile(fifoPath, os.O_RDONLY, 0)
+		if err != nil {
+			opened <- fifoResult{err: err}
+			return
+		}
+		defer fifo.Close()
+		data, err := ioutil.ReadAll(fifo)
+		opened <- fifoResult{data: data, err: err}
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	exited := make(chan error, 1)
+	go func() {
+		exited <- proc.WaitExit(ctx, c.parentProcess.pid())
+	}()
+	var result fifoResult
+	select {
+	case result = <-opened:
+	case err := <-exited:
+		if err != nil {
+			return err
+		}
+		// 容器进程有可能是写入之后才退出的(命令很快就结束了)，再给读端一点时间
+		select {
+		case result = <-opened:
+		case <-time.After(100 * time.Millisecond):
+			return fmt.Errorf("container init process exited before start")
+		}
+	}
+	if result.err != nil {
+		return result.err
+	}
+	if len(result.data) == 0 {
+		return fmt.Errorf("container init process exited before start")
+	}
+	return os.Remove(fifoPath)
 }
 
 /*
@@ -149,7 +210,27 @@ func (c *LinuxContainer) newParentProcess(process *Process) (ParentProcess, erro
 	if err != nil {
 		return nil, err
 	}
+	var parentConsoleSocket, childConsoleSocket *os.File
+	if process.Terminal {
+		if parentConsoleSocket, childConsoleSocket, err = util.NewSocketPair("console"); err != nil {
+			return nil, err
+		}
+		cmd.ExtraFiles = append(cmd.ExtraFiles, childConsoleSocket)
+		cmd.Env = append(cmd.Env,
+			fmt.Sprintf(constant.EnvConsoleSocket+"=%d", constant.DefaultStdFdCount+len(cmd.ExtraFiles)-1),
+		)
+	}
+	// 后台运行且没有终端的容器，stdio交给shim中的relay
+	var childStdio, relayFiles []*os.File
+	if process.Init && process.Detach && !process.Terminal {
+		if childStdio, relayFiles, err = c.newStdioRelay(cmd); err != nil {
+			return nil, exception.NewGenericErrorWithContext(err, exception.StdioRelayError, "creating stdio relay")
+		}
+	}
 	if process.Init {
+		if err := c.createExecFifo(cmd); err != nil {
+			return nil, exception.NewGenericErrorWithContext(err, exception.ParentProcessCreateError, "creating exec fifo")
+		}
 		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", constant.EnvInitializerType, string(InitInitializer)))
 		logrus.Infof("build command complete, command: %#v", cmd)
 		logrus.Infof("new parent init process...")
@@ -160,13 +241,17 @@ func (c *LinuxContainer) newParentProcess(process *Process) (ParentProcess, erro
 			}
 		}
 		initProcess := &ParentAbstractProcess{
-			processCmd:       cmd,
-			parentConfigPipe: childConfigPipe,
-			container:        c,
-			process:          process,
-			cloneFlags:       c.config.Namespaces.CloneFlagsOfEmptyPath(),
-			namespacePathMap: namepaces,
-			startHook:        initStartHook,
+			processCmd:         cmd,
+			parentConfigPipe:   childConfigPipe,
+			container:          c,
+			process:            process,
+			cloneFlags:         c.config.Namespaces.CloneFlagsOfEmptyPath(),
+			namespacePathMap:   namepaces,
+			startHook:          initStartHook,
+			consoleSocket:      parentConsoleSocket,
+			childConsoleSocket: childConsoleSocket,
+			childStdio:         childStdio,
+			relayFiles:         relayFiles,
 		}
 		// exec process不会赋到container.parentProcess,因为它的pid,startTime返回的都是exec process的,而非nochild process(反映的是init process的)
 		c.parentProcess = initProcess
@@ -180,13 +265,15 @@ func (c *LinuxContainer) newParentProcess(process *Process) (ParentProcess, erro
 			return nil, err
 		}
 		return &ParentAbstractProcess{
-			processCmd:       cmd,
-			parentConfigPipe: childConfigPipe,
-			container:        c,
-			process:          process,
-			cloneFlags:       0,
-			namespacePathMap: currentState.NamespacePaths,
-			startHook:        execStartHook,
+			processCmd:         cmd,
+			parentConfigPipe:   childConfigPipe,
+			container:          c,
+			process:            process,
+			cloneFlags:         0,
+			namespacePathMap:   currentState.NamespacePaths,
+			startHook:          execStartHook,
+			consoleSocket:      parentConsoleSocket,
+			childConsoleSocket: childConsoleSocket,
 		}, nil
 	}
 }
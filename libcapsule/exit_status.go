@@ -0,0 +1,66 @@
+package libcapsule
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"time"
+)
+
+/*
+容器停止的原因
+*/
+const (
+	// 容器进程自己退出
+	StopReasonExited = "exited"
+	// 被信号杀死，且不是通过capsule kill发出的
+	StopReasonSignaled = "signaled"
+	// 被capsule kill/delete发出的信号杀死
+	StopReasonKilled = "killed"
+	// 因为超出memory cgroup的限制被内核杀死
+	StopReasonOOMKilled = "oom-killed"
+)
+
+/*
+容器init进程的退出状态，由shim在回收容器init进程后写入state.json
+*/
+type ExitStatus struct {
+	ExitCode   int       `json:"exit_code"`
+	ExitSignal string    `json:"exit_signal,omitempty"`
+	FinishedAt time.Time `json:"finished_at"`
+	OOMKilled  bool      `json:"oom_killed"`
+	StopReason string    `json:"stop_reason"`
+}
+
+func (status *ExitStatus) String() string {
+	if status.ExitSignal != "" {
+		return fmt.Sprintf("exit code %d(%s by %s)", status.ExitCode, status.StopReason, status.ExitSignal)
+	}
+	return fmt.Sprintf("exit code %d", status.ExitCode)
+}
+
+/*
+killSignal是shim通过kill发给容器init进程的最后一个信号，没有发过则为0
+*/
+func newExitStatus(waitStatus unix.WaitStatus, killSignal unix.Signal, oomKilled bool) *ExitStatus {
+	status := &ExitStatus{
+		ExitCode:   waitStatus.ExitStatus(),
+		FinishedAt: time.Now(),
+		StopReason: StopReasonExited,
+	}
+	if !waitStatus.Signaled() {
+		return status
+	}
+	// 与shell一致，被信号杀死时退出码为128+信号值
+	status.ExitCode = 128 + int(waitStatus.Signal())
+	status.ExitSignal = unix.SignalName(waitStatus.Signal())
+	switch {
+	case waitStatus.Signal() == unix.SIGKILL && oomKilled:
+		status.OOMKilled = true
+		status.StopReason = StopReasonOOMKilled
+	case waitStatus.Signal() == killSignal:
+		status.StopReason = StopReasonKilled
+	default:
+		status.StopReason = StopReasonSignaled
+	}
+	return status
+}
@@ -1,17 +1,23 @@
 package facade
 
 import (
+	"context"
 	"fmt"
 	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/satori/go.uuid"
 	"github.com/sirupsen/logrus"
 	"github.com/songxinjianqwe/capsule/libcapsule"
+	"github.com/songxinjianqwe/capsule/libcapsule/configs"
 	"github.com/songxinjianqwe/capsule/libcapsule/constant"
+	"github.com/songxinjianqwe/capsule/libcapsule/network"
+	"github.com/songxinjianqwe/capsule/libcapsule/util/capabilities"
 	"github.com/songxinjianqwe/capsule/libcapsule/util/exception"
 	specutil "github.com/songxinjianqwe/capsule/libcapsule/util/spec"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
+	"time"
 )
 
 type ContainerAction uint8
@@ -21,6 +27,11 @@ const (
 	ContainerActRun
 )
 
+const (
+	WaitConditionStopped = "stopped"
+	WaitConditionRemoved = "removed"
+)
+
 func (action ContainerAction) String() string {
 	switch action {
 	case ContainerActCreate:
@@ -34,37 +45,43 @@ func (action ContainerAction) String() string {
 
 /*
 进入容器执行一个Process
+前台运行时返回exec进程的退出状态，后台运行时为nil
 */
-func ExecContainer(runtimeRoot string, id string, detach bool, args []string, cwd string, env []string) (string, error) {
-	logrus.Infof("exec container: %s, detach: %t, args: %v, cwd: %s, env: %v", id, detach, args, cwd, env)
+func ExecContainer(runtimeRoot string, id string, detach bool, tty bool, sigProxy bool, args []string, cwd string, env []string, user string, capAdd []string, capDrop []string) (string, *libcapsule.ExitStatus, error) {
+	logrus.Infof("exec container: %s, detach: %t, tty: %t, args: %v, cwd: %s, env: %v, user: %s, cap add: %v, cap drop: %v", id, detach, tty, args, cwd, env, user, capAdd, capDrop)
 	container, err := GetContainer(runtimeRoot, id)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 	containerStatus, err := container.Status()
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 	// exec时,先检查容器状态是否为Stopped
 	if containerStatus == libcapsule.Stopped {
-		return "", fmt.Errorf("cant exec in a stopped container ")
+		return "", nil, fmt.Errorf("cant exec in a stopped container ")
 	}
 	execId, err := uuid.NewV4()
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 	ociState, err := container.OCIState()
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 	spec, err := LoadSpec(ociState.Bundle)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 	// 构造一个Process，由命令行输入的参数会覆盖spec中的Init Process Config
-	process, err := newProcess(execId.String(), spec.Process, false, detach)
+	execSpecProcess := *spec.Process
+	execSpecProcess.Terminal = tty
+	if execSpecProcess.Capabilities, err = capabilities.Adjust(execSpecProcess.Capabilities, capAdd, capDrop); err != nil {
+		return "", nil, err
+	}
+	process, err := newProcess(execId.String(), &execSpecProcess, false, detach, "", sigProxy)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 	// override
 	process.Args = args
@@ -72,10 +89,21 @@ func ExecContainer(runtimeRoot string, id string, detach bool, args []string, cw
 		process.Cwd = cwd
 	}
 	process.Env = append(process.Env, env...)
+	// spec中的附加组是给init进程的用户配置的，指定了用户时只使用该用户在/etc/group中所属的组
+	if user != "" {
+		process.User = user
+		process.AdditionalGroups = nil
+	}
+	if process.Umask, err = loadUmask(ociState.Bundle); err != nil {
+		return "", nil, err
+	}
 
 	logrus.Infof("new exec process complete, libcapsule.Process: %#v", process)
 	// 无论是否是daemon运行，在执行完exec process后，都不会销毁容器。
-	return execId.String(), container.Run(process)
+	if err := container.Run(process); err != nil {
+		return "", nil, err
+	}
+	return execId.String(), process.ExitStatus, nil
 }
 
 /*
@@ -84,18 +112,26 @@ create
 or
 create and start
 Process一定为Init Process
+前台run时返回容器init进程的退出状态，否则为nil
 */
-func CreateOrRunContainer(runtimeRoot string, id string, bundle string, spec *specs.Spec, action ContainerAction, detach bool, network string, portMappings []string) error {
+func CreateOrRunContainer(runtimeRoot string, id string, bundle string, spec *specs.Spec, action ContainerAction, detach bool, consoleSocket string, sigProxy bool, noPivot bool, endpointConfig configs.EndpointConfig) (*libcapsule.ExitStatus, error) {
 	logrus.Infof("create or run container: %s, action: %s", id, action)
-	container, err := CreateContainer(runtimeRoot, id, bundle, spec, network, portMappings)
-	if err != nil {
-		return err
+	// create之后parent就退出了，没有进程来持有pty master，只能交给console socket另一端的进程
+	if spec.Process.Terminal && action == ContainerActCreate && consoleSocket == "" {
+		return nil, fmt.Errorf("cant allocate a terminal for create without --console-socket")
 	}
-	// 将specs.Process转为libcapsule.Process
-	process, err := newProcess(id, spec.Process, true, detach)
+	// 将specs.Process转为libcapsule.Process，在创建容器之前转换，转换失败时不需要清理容器
+	process, err := newProcess(id, spec.Process, true, detach, consoleSocket, sigProxy)
 	logrus.Infof("new init process complete, libcapsule.Process: %#v", process)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	container, err := CreateContainer(runtimeRoot, id, bundle, spec, noPivot, endpointConfig)
+	if err != nil {
+		return nil, err
+	}
+	if process.Umask, err = loadUmask(bundle); err != nil {
+		return nil, handleContainerCreateOrRunErr(container, err)
 	}
 	var containerErr error
 	switch action {
@@ -107,15 +143,15 @@ func CreateOrRunContainer(runtimeRoot string, id string, bundle string, spec *sp
 		containerErr = container.Run(process)
 	}
 	if containerErr != nil {
-		return handleContainerCreateOrRunErr(container, containerErr)
+		return nil, handleContainerCreateOrRunErr(container, containerErr)
 	}
 	// 如果是Run命令运行容器吗，并且是前台运行，那么Run结束，即为容器进程结束，则删除容器
 	if action == ContainerActRun && !detach {
 		if err := container.Destroy(); err != nil {
-			return err
+			return nil, err
 		}
 	}
-	return nil
+	return process.ExitStatus, nil
 }
 
 func handleContainerCreateOrRunErr(container libcapsule.Container, containerErr error) error {
@@ -167,20 +203,69 @@ func GetContainerIds(runtimeRoot string) ([]string, error) {
 	return ids, nil
 }
 
+/*
+等待容器停止并返回容器init进程的退出状态，condition为removed时还要等到容器被删除
+*/
+func WaitContainer(ctx context.Context, runtimeRoot string, id string, condition string) (*libcapsule.ExitStatus, error) {
+	if condition != WaitConditionStopped && condition != WaitConditionRemoved {
+		return nil, fmt.Errorf("invalid condition %q, should be %s or %s", condition, WaitConditionStopped, WaitConditionRemoved)
+	}
+	container, err := GetContainer(runtimeRoot, id)
+	if err != nil {
+		return nil, err
+	}
+	exitStatus, err := container.Wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if condition == WaitConditionRemoved {
+		if runtimeRoot == "" {
+			runtimeRoot = constant.DefaultRuntimeRoot
+		}
+		containerRoot := filepath.Join(runtimeRoot, constant.ContainerDir, id)
+		for {
+			if _, err := os.Stat(containerRoot); os.IsNotExist(err) {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+	}
+	return exitStatus, nil
+}
+
+/*
+回收不属于任何容器的网络资源
+*/
+func PruneNetwork(runtimeRoot string) (*network.PruneReport, error) {
+	factory, err := libcapsule.NewFactory(runtimeRoot, false)
+	if err != nil {
+		return nil, err
+	}
+	return factory.PruneNetwork()
+}
+
 /*
 创建容器实例
 */
-func CreateContainer(runtimeRoot string, id string, bundle string, spec *specs.Spec, network string, portMappings []string) (libcapsule.Container, error) {
+func CreateContainer(runtimeRoot string, id string, bundle string, spec *specs.Spec, noPivot bool, endpointConfig configs.EndpointConfig) (libcapsule.Container, error) {
 	logrus.Infof("creating container: %s", id)
 	if id == "" {
 		return nil, fmt.Errorf("container id cannot be empty")
 	}
 	// 1、将spec转为容器config
-	config, err := specutil.CreateContainerConfig(bundle, spec, network, portMappings)
+	config, err := specutil.CreateContainerConfig(bundle, spec, endpointConfig)
 	logrus.Infof("convert complete, config: %#v", config)
 	if err != nil {
 		return nil, err
 	}
+	if err := loadSeccompErrnoRet(bundle, config.Seccomp); err != nil {
+		return nil, err
+	}
+	config.NoPivotRoot = noPivot
 	// 2、创建容器工厂
 	factory, err := libcapsule.NewFactory(runtimeRoot, true)
 	if err != nil {
@@ -197,15 +282,66 @@ func CreateContainer(runtimeRoot string, id string, bundle string, spec *specs.S
 /*
 将specs.Process转为libcapsule.Process
 */
-func newProcess(id string, p *specs.Process, init, detach bool) (*libcapsule.Process, error) {
+func newProcess(id string, p *specs.Process, init, detach bool, consoleSocket string, sigProxy bool) (*libcapsule.Process, error) {
 	logrus.Infof("converting specs.Process to libcapsule.Process")
+	if consoleSocket != "" && !p.Terminal {
+		return nil, fmt.Errorf("--console-socket requires process.terminal to be true")
+	}
+	// detach时parent不会等待容器进程，也就没有进程来转发终端的输入输出
+	if p.Terminal && detach && consoleSocket == "" {
+		return nil, fmt.Errorf("cant allocate a terminal for a detached process without --console-socket")
+	}
 	libcapsuleProcess := &libcapsule.Process{
-		ID:     id,
-		Args:   p.Args,
-		Env:    p.Env,
-		Cwd:    p.Cwd,
-		Init:   init,
-		Detach: detach,
+		ID:       id,
+		Args:     p.Args,
+		Env:      p.Env,
+		Cwd:      p.Cwd,
+		User:     processUser(p.User),
+		Init:     init,
+		Detach:   detach,
+		Terminal: p.Terminal,
+		// 指定了console socket时，pty master发送给socket另一端的进程，parent不再代理终端
+		ConsoleSocket: consoleSocket,
+		// 后台运行时parent不会等待容器进程，也就不需要转发信号
+		SigProxy: sigProxy && !detach,
+	}
+	if p.Capabilities != nil {
+		libcapsuleProcess.Capabilities = &configs.Capabilities{
+			Bounding:    p.Capabilities.Bounding,
+			Effective:   p.Capabilities.Effective,
+			Inheritable: p.Capabilities.Inheritable,
+			Permitted:   p.Capabilities.Permitted,
+			Ambient:     p.Capabilities.Ambient,
+		}
+	}
+	libcapsuleProcess.NoNewPrivileges = p.NoNewPrivileges
+	libcapsuleProcess.OomScoreAdj = p.OOMScoreAdj
+	for _, rlimit := range p.Rlimits {
+		rlimitType, err := configs.ParseRlimitType(rlimit.Type)
+		if err != nil {
+			return nil, err
+		}
+		libcapsuleProcess.Rlimits = append(libcapsuleProcess.Rlimits, configs.Rlimit{
+			Type: rlimitType,
+			Hard: rlimit.Hard,
+			Soft: rlimit.Soft,
+		})
+	}
+	for _, gid := range p.User.AdditionalGids {
+		libcapsuleProcess.AdditionalGroups = append(libcapsuleProcess.AdditionalGroups, strconv.FormatUint(uint64(gid), 10))
 	}
 	return libcapsuleProcess, nil
 }
+
+/*
+specs.User转为user[:group]，指定了username时优先使用username
+*/
+func processUser(u specs.User) string {
+	if u.Username != "" {
+		if u.GID != 0 {
+			return fmt.Sprintf("%s:%d", u.Username, u.GID)
+		}
+		return u.Username
+	}
+	return fmt.Sprintf("%d:%d", u.UID, u.GID)
+}
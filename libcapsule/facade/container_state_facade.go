@@ -25,6 +25,16 @@ type ContainerStateVO struct {
 	IP string `json:"ip"`
 	// Created is the unix timestamp for the creation time of the container in UTC
 	Created time.Time `json:"created"`
+	// ExitCode is the exit code of the init process, 128+signal if it was killed by a signal
+	ExitCode *int `json:"exitCode,omitempty"`
+	// ExitSignal is the signal which killed the init process
+	ExitSignal string `json:"exitSignal,omitempty"`
+	// FinishedAt is the time when the init process exited
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	// OOMKilled is whether the init process was killed by the OOM killer
+	OOMKilled bool `json:"oomKilled,omitempty"`
+	// StopReason is why the container stopped: exited, signaled, killed or oom-killed
+	StopReason string `json:"stopReason,omitempty"`
 	// GetAnnotations is the user defined annotations added to the config.
 	Annotations map[string]string        `json:"annotations,omitempty"`
 	Detail      *libcapsule.StateStorage `json:"detail"`
@@ -60,7 +70,7 @@ func GetContainerStateVO(runtimeRoot string, id string) (*ContainerStateVO, erro
 
 func convertContainerStateToVO(status libcapsule.ContainerStatus, state *libcapsule.StateStorage) *ContainerStateVO {
 	bundle, annotations := util.GetAnnotations(state.Config.Labels)
-	return &ContainerStateVO{
+	vo := &ContainerStateVO{
 		Created:        state.Created,
 		Status:         status.String(),
 		InitProcessPid: state.InitProcessPid,
@@ -72,4 +82,12 @@ func convertContainerStateToVO(status libcapsule.ContainerStatus, state *libcaps
 		Annotations:    annotations,
 		Detail:         state,
 	}
+	if state.ExitStatus != nil {
+		vo.ExitCode = &state.ExitStatus.ExitCode
+		vo.ExitSignal = state.ExitStatus.ExitSignal
+		vo.FinishedAt = &state.ExitStatus.FinishedAt
+		vo.OOMKilled = state.ExitStatus.OOMKilled
+		vo.StopReason = state.ExitStatus.StopReason
+	}
+	return vo
 }
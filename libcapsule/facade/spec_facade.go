@@ -4,19 +4,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/sirupsen/logrus"
+	"github.com/songxinjianqwe/capsule/libcapsule/configs"
 	"github.com/songxinjianqwe/capsule/libcapsule/constant"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 )
 
 func LoadSpec(bundle string) (spec *specs.Spec, err error) {
-	// 如果bundle不为空，则open路径为bundle下的config.json
-	// 如果为空，那么open默认是在当前路径下打开
-	path := constant.ContainerConfigFilename
-	if bundle != "" {
-		path = filepath.Join(bundle, path)
-	}
-	file, err := os.Open(path)
+	file, err := os.Open(specPath(bundle))
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, fmt.Errorf("JSON specification file %s not found, bundle is %s", constant.ContainerConfigFilename, bundle)
@@ -30,6 +27,71 @@ func LoadSpec(bundle string) (spec *specs.Spec, err error) {
 	return spec, validateProcessSpec(spec.Process)
 }
 
+/*
+vendor中的runtime-spec(v1.0.1)还没有process.user.umask，只能单独从config.json中读取
+没有设置时返回nil
+*/
+func loadUmask(bundle string) (*uint32, error) {
+	bytes, err := ioutil.ReadFile(specPath(bundle))
+	if err != nil {
+		return nil, err
+	}
+	var spec struct {
+		Process *struct {
+			User struct {
+				Umask *uint32 `json:"umask,omitempty"`
+			} `json:"user"`
+		} `json:"process"`
+	}
+	if err := json.Unmarshal(bytes, &spec); err != nil {
+		return nil, err
+	}
+	if spec.Process == nil {
+		return nil, nil
+	}
+	return spec.Process.User.Umask, nil
+}
+
+/*
+seccomp由spec.Linux.Seccomp转换而来，但vendor中的runtime-spec(v1.0.1)没有errnoRet，只能单独从config.json中读取
+config.json中的规则与spec中的规则一一对应，数量不一致时说明spec不是从config.json中加载的，此时不做补充
+*/
+func loadSeccompErrnoRet(bundle string, seccomp *configs.Seccomp) error {
+	if seccomp == nil {
+		return nil
+	}
+	bytes, err := ioutil.ReadFile(specPath(bundle))
+	if err != nil {
+		return err
+	}
+	var spec struct {
+		Linux *struct {
+			Seccomp *configs.Seccomp `json:"seccomp,omitempty"`
+		} `json:"linux"`
+	}
+	if err := json.Unmarshal(bytes, &spec); err != nil {
+		return err
+	}
+	if spec.Linux == nil || spec.Linux.Seccomp == nil || len(spec.Linux.Seccomp.Syscalls) != len(seccomp.Syscalls) {
+		logrus.Warnf("seccomp of spec does not match %s, errnoRet is ignored", specPath(bundle))
+		return nil
+	}
+	seccomp.DefaultErrnoRet = spec.Linux.Seccomp.DefaultErrnoRet
+	for i, syscall := range spec.Linux.Seccomp.Syscalls {
+		seccomp.Syscalls[i].ErrnoRet = syscall.ErrnoRet
+	}
+	return nil
+}
+
+// 如果bundle不为空，则为bundle下的config.json
+// 如果为空，那么默认是当前路径下的config.json
+func specPath(bundle string) string {
+	if bundle == "" {
+		return constant.ContainerConfigFilename
+	}
+	return filepath.Join(bundle, constant.ContainerConfigFilename)
+}
+
 func validateProcessSpec(spec *specs.Process) error {
 	if spec.Cwd == "" {
 		return fmt.Errorf("cwd property must not be empty")
@@ -2,6 +2,7 @@ package libcapsule
 
 import (
 	"github.com/songxinjianqwe/capsule/libcapsule/configs"
+	"github.com/songxinjianqwe/capsule/libcapsule/network"
 )
 
 type Factory interface {
@@ -18,4 +19,7 @@ type Factory interface {
 
 	// 返回运行时文件的根目录
 	GetRuntimeRoot() string
+
+	// 回收不属于任何容器的网络资源
+	PruneNetwork() (*network.PruneReport, error)
 }
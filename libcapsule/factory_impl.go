@@ -9,12 +9,14 @@ import (
 	"github.com/songxinjianqwe/capsule/libcapsule/constant"
 	"github.com/songxinjianqwe/capsule/libcapsule/network"
 	"github.com/songxinjianqwe/capsule/libcapsule/util/exception"
+	"golang.org/x/sys/unix"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 func NewFactory(runtimeRoot string, init bool) (Factory, error) {
@@ -38,9 +40,23 @@ func NewFactory(runtimeRoot string, init bool) (Factory, error) {
 	if err := network.InitNetworkDrivers(runtimeRoot); err != nil {
 		return nil, err
 	}
+	if init {
+		// 顺便回收遗留的网络资源(宿主机重启、capsule崩溃等)，失败不影响正常流程
+		onceForPruneNetwork.Do(func() {
+			if _, err := factory.PruneNetwork(); err != nil {
+				if e, ok := err.(exception.Error); ok && e.Code() == exception.NetworkPruneSkippedError {
+					logrus.Infof("skip pruning network, cause: %s", err.Error())
+				} else {
+					logrus.Warnf("prune network failed, cause: %s", err.Error())
+				}
+			}
+		})
+	}
 	return factory, nil
 }
 
+var onceForPruneNetwork sync.Once
+
 type LinuxContainerFactory struct {
 	root string
 }
@@ -49,6 +65,35 @@ func (factory *LinuxContainerFactory) GetRuntimeRoot() string {
 	return factory.root
 }
 
+/*
+以所有存在的容器的endpoint为准回收网络资源
+如果有容器的state.json还不存在，说明它正在创建中(可能正在Connect)，此时放弃回收
+*/
+func (factory *LinuxContainerFactory) PruneNetwork() (*network.PruneReport, error) {
+	containersRoot := filepath.Join(factory.root, constant.ContainerDir)
+	report, err := network.Prune(func() ([]*network.Endpoint, error) {
+		files, err := ioutil.ReadDir(containersRoot)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		var liveEndpoints []*network.Endpoint
+		for _, file := range files {
+			state, err := factory.loadContainerState(filepath.Join(containersRoot, file.Name()), file.Name())
+			if err != nil {
+				return nil, exception.NewGenericError(fmt.Errorf("container %s may be creating, skip pruning, cause: %s", file.Name(), err.Error()), exception.NetworkPruneSkippedError)
+			}
+			if state.Endpoint != nil {
+				liveEndpoints = append(liveEndpoints, state.Endpoint)
+			}
+		}
+		return liveEndpoints, nil
+	})
+	if err != nil {
+		return report, exception.NewGenericError(err, exception.NetworkPruneError)
+	}
+	return report, nil
+}
+
 func (factory *LinuxContainerFactory) Create(id string, config *configs.ContainerConfig) (Container, error) {
 	logrus.Infof("container factory creating container: %s", id)
 	containerRoot := filepath.Join(factory.root, constant.ContainerDir, id)
@@ -99,6 +144,7 @@ func (factory *LinuxContainerFactory) Load(id string) (Container, error) {
 		config:        state.Config,
 		endpoint:      state.Endpoint,
 		cgroupManager: cgroups.NewCroupManager(id, state.CgroupPaths),
+		exitStatus:    state.ExitStatus,
 	}
 	container.parentProcess = NewParentNoChildProcess(state.InitProcessPid, state.InitProcessStartTime, container)
 	detectedStatus, err := container.detectContainerStatus()
@@ -113,7 +159,7 @@ func (factory *LinuxContainerFactory) Load(id string) (Container, error) {
 	return container, nil
 }
 
-func (factory *LinuxContainerFactory) StartInitialization() error {
+func (factory *LinuxContainerFactory) StartInitialization() (err error) {
 	logrus.Infof("capsule init/StartInitialization...")
 	defer func() {
 		if e := recover(); e != nil {
@@ -132,16 +178,23 @@ func (factory *LinuxContainerFactory) StartInitialization() error {
 	// 读取config
 	configPipe := os.NewFile(uintptr(initPipeFd), "configPipe")
 	logrus.WithField("init", true).Infof("open child pipe: %#v", configPipe)
+	// 执行命令时自动关闭，exec进程的parent以读到EOF作为执行成功
+	unix.CloseOnExec(initPipeFd)
+	defer func() {
+		// 初始化失败时把错误回复给parent
+		if err != nil {
+			if e := writeSyncError(configPipe, err); e != nil {
+				logrus.WithField("init", true).Errorf("reply error to parent failed: %s", e.Error())
+			}
+		}
+	}()
 	logrus.WithField("init", true).Infof("starting to read init config from child pipe")
 	bytes, err := ioutil.ReadAll(configPipe)
 	if err != nil {
 		logrus.WithField("init", true).Errorf("read init config failed: %s", err.Error())
 		return exception.NewGenericErrorWithContext(err, exception.PipeError, "reading init config from configPipe")
 	}
-	// child 读完就关
-	if err = configPipe.Close(); err != nil {
-		logrus.Errorf("closing parent pipe failed: %s", err.Error())
-	}
+	// 读完后不关闭，容器进程还需要通过它回复parent
 	logrus.Infof("read init config complete, unmarshal bytes")
 	initConfig := &InitExecConfig{}
 	if err = json.Unmarshal(bytes, initConfig); err != nil {
@@ -186,17 +239,12 @@ func populateProcessEnvironment(env []string) error {
 
 func (factory *LinuxContainerFactory) loadContainerState(containerRoot, id string) (*StateStorage, error) {
 	stateFilePath := filepath.Join(containerRoot, constant.StateFilename)
-	f, err := os.Open(stateFilePath)
+	state, err := loadStateStorage(stateFilePath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, exception.NewGenericError(fmt.Errorf("container %s does not exist", id), exception.ContainerNotExistsError)
 		}
 		return nil, exception.NewGenericError(err, exception.ContainerLoadError)
 	}
-	defer f.Close()
-	var state *StateStorage
-	if err := json.NewDecoder(f).Decode(&state); err != nil {
-		return nil, exception.NewGenericError(err, exception.ContainerLoadError)
-	}
 	return state, nil
 }
@@ -1,6 +1,9 @@
 package image
 
-import "time"
+import (
+	"github.com/songxinjianqwe/capsule/libcapsule/configs"
+	"time"
+)
 
 type Image struct {
 	Id         string
@@ -10,11 +13,18 @@ type Image struct {
 }
 
 type ImageRunArgs struct {
-	ImageId      string
-	ContainerId  string
-	Args         []string
-	Env          []string
-	Cwd          string
+	ImageId     string
+	ContainerId string
+	Args        []string
+	Env         []string
+	Cwd         string
+	User        string
+	CapAdd      []string
+	CapDrop     []string
+	// seccomp=<file|unconfined>
+	SecurityOpt []string
+	// <type>=<soft>[:<hard>]
+	Ulimits      []string
 	Hostname     string
 	Cpushare     uint64
 	Memory       int64
@@ -22,6 +32,14 @@ type ImageRunArgs struct {
 	Network      string
 	PortMappings []string
 	Detach       bool
+	Tty          bool
+	SigProxy     bool
 	Volumes      []string
 	Links        []string
+	Dns          []string
+	DnsSearch    []string
+	DnsOptions   []string
+	// hostname:ip
+	ExtraHosts []string
+	Bandwidth  *configs.Bandwidth
 }
@@ -7,10 +7,16 @@ import (
 	"github.com/satori/go.uuid"
 	"github.com/sirupsen/logrus"
 	"github.com/songxinjianqwe/capsule/libcapsule"
+	"github.com/songxinjianqwe/capsule/libcapsule/configs"
 	"github.com/songxinjianqwe/capsule/libcapsule/constant"
 	"github.com/songxinjianqwe/capsule/libcapsule/facade"
+	"github.com/songxinjianqwe/capsule/libcapsule/network"
+	"github.com/songxinjianqwe/capsule/libcapsule/util/capabilities"
 	"github.com/songxinjianqwe/capsule/libcapsule/util/exception"
+	"github.com/songxinjianqwe/capsule/libcapsule/util/filelock"
+	specutil "github.com/songxinjianqwe/capsule/libcapsule/util/spec"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -31,7 +37,8 @@ type ImageService interface {
 	Delete(id string) error
 	List() ([]Image, error)
 	Get(id string) (Image, error)
-	Run(imageRunArgs *ImageRunArgs) error
+	// 前台运行时返回容器init进程的退出状态
+	Run(imageRunArgs *ImageRunArgs) (*libcapsule.ExitStatus, error)
 	Destroy(container libcapsule.Container) error
 }
 
@@ -51,30 +58,17 @@ func NewImageService(runtimeRoot string) (ImageService, error) {
 			return nil, exception.NewGenericError(err, exception.ImageServiceError)
 		}
 	}
-	repositoriesPath := filepath.Join(imageRoot, constant.ImageRepositoriesFilename)
-	repositories := make(map[string]string)
-	if _, err := os.Stat(repositoriesPath); err != nil {
-		if !os.IsNotExist(err) {
-			// 如果文件存在,但stat返回错误,则退出
-			return nil, exception.NewGenericError(err, exception.ImageServiceError)
-		}
-		// 文件不存在,则不动
-	} else {
-		// 文件存在,则读取
-		bytes, err := ioutil.ReadFile(repositoriesPath)
-		if err != nil {
-			return nil, exception.NewGenericError(err, exception.ImageServiceError)
-		}
-		if err := json.Unmarshal(bytes, &repositories); err != nil {
-			return nil, exception.NewGenericError(err, exception.ImageServiceError)
-		}
+	service := &imageService{
+		factory:          factory,
+		imageRoot:        imageRoot,
+		repositoriesPath: filepath.Join(imageRoot, constant.ImageRepositoriesFilename),
 	}
-	//logrus.Infof("loaded repositories.json: %#v", repositories)
-	return &imageService{
-		factory:      factory,
-		imageRoot:    imageRoot,
-		repositories: repositories,
-	}, nil
+	fileLock, err := service.lockRepositories(false)
+	if err != nil {
+		return nil, err
+	}
+	defer fileLock.Unlock()
+	return service, nil
 }
 
 type imageService struct {
@@ -83,7 +77,39 @@ type imageService struct {
 	imageRoot string
 	// key -> image id
 	// value -> layer id
-	repositories map[string]string
+	repositories     map[string]string
+	repositoriesPath string
+}
+
+/*
+其他capsule进程可能同时在创建、删除镜像，所以每次访问repositories之前都要加文件锁并重新读取
+exclusive为true时加排他锁，之后会调用flushRepositories
+*/
+func (service *imageService) lockRepositories(exclusive bool) (*filelock.FileLock, error) {
+	lock := filelock.RLock
+	if exclusive {
+		lock = filelock.Lock
+	}
+	fileLock, err := lock(service.repositoriesPath)
+	if err != nil {
+		return nil, exception.NewGenericError(err, exception.ImageServiceError)
+	}
+	repositories := make(map[string]string)
+	bytes, err := ioutil.ReadFile(service.repositoriesPath)
+	if err != nil && !os.IsNotExist(err) {
+		// 如果文件存在,但读取失败,则退出
+		fileLock.Unlock()
+		return nil, exception.NewGenericError(err, exception.ImageServiceError)
+	}
+	// 文件不存在,则为空
+	if err == nil {
+		if err := json.Unmarshal(bytes, &repositories); err != nil {
+			fileLock.Unlock()
+			return nil, exception.NewGenericError(err, exception.ImageServiceError)
+		}
+	}
+	service.repositories = repositories
+	return fileLock, nil
 }
 
 func (service *imageService) Destroy(container libcapsule.Container) error {
@@ -163,19 +189,19 @@ func (service *imageService) cleanContainer(containerId string) error {
 	return nil
 }
 
-func (service *imageService) Run(imageRunArgs *ImageRunArgs) (err error) {
+func (service *imageService) Run(imageRunArgs *ImageRunArgs) (exitStatus *libcapsule.ExitStatus, err error) {
 	// 1. 检查是否已经存在该容器
 	if exists := service.factory.Exists(imageRunArgs.ContainerId); exists {
-		return exception.NewGenericError(fmt.Errorf("container already exists: %s", imageRunArgs.ContainerId), exception.ContainerIdExistsError)
+		return nil, exception.NewGenericError(fmt.Errorf("container already exists: %s", imageRunArgs.ContainerId), exception.ContainerIdExistsError)
 	}
 	// 2. 创建bundle目录
 	// /var/run/capsule/images/containers/$container_id
 	bundle := filepath.Join(service.imageRoot, constant.ImageContainersDir, imageRunArgs.ContainerId)
 	if _, err := os.Stat(bundle); err != nil && !os.IsNotExist(err) {
-		return exception.NewGenericError(err, exception.ContainerIdExistsError)
+		return nil, exception.NewGenericError(err, exception.ContainerIdExistsError)
 	}
 	if err := os.MkdirAll(bundle, 0644); err != nil {
-		return exception.NewGenericError(err, exception.BundleCreateError)
+		return nil, exception.NewGenericError(err, exception.BundleCreateError)
 	}
 	defer func() {
 		if err != nil {
@@ -188,51 +214,64 @@ func (service *imageService) Run(imageRunArgs *ImageRunArgs) (err error) {
 	var rootfsPath string
 	var spec *specs.Spec
 	// 3. 准备/etc/hosts,会在/var/run/capsule/images/containers/$container_id下创建一个hosts
-	hostsMount, err := service.prepareHosts(imageRunArgs.ContainerId, imageRunArgs.Links)
+	hostsMount, err := service.prepareHosts(imageRunArgs.ContainerId, imageRunArgs.Links, imageRunArgs.ExtraHosts)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// 4. 准备/etc/resolv.conf,会在/var/run/capsule/images/containers/$container_id下创建一个resolv.conf
-	dnsMount, err := service.prepareDns(imageRunArgs.ContainerId)
+	dnsMount, err := service.prepareDns(imageRunArgs.ContainerId, imageRunArgs.Network, imageRunArgs.Dns, imageRunArgs.DnsSearch, imageRunArgs.DnsOptions)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// 5. 准备volume
 	volumeMounts, err := service.prepareVolumes(imageRunArgs.Volumes)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// 6. 准备rootfs
 	if rootfsPath, err = service.prepareUnionFs(imageRunArgs.ContainerId, imageRunArgs.ImageId); err != nil {
-		return err
+		return nil, err
 	}
 
 	// 7. 准备spec
 	specMounts := []specs.Mount{hostsMount, dnsMount}
 	specMounts = append(specMounts, volumeMounts...)
 	if spec, err = service.prepareSpec(rootfsPath, bundle, imageRunArgs, specMounts); err != nil {
-		return err
+		return nil, err
 	}
 
 	// 8. 运行容器,如果运行出错,或者前台运行正常退出,则清理
-	if err = facade.CreateOrRunContainer(service.factory.GetRuntimeRoot(), imageRunArgs.ContainerId, bundle, spec, facade.ContainerActRun, imageRunArgs.Detach, imageRunArgs.Network, imageRunArgs.PortMappings); err != nil {
+	if exitStatus, err = facade.CreateOrRunContainer(service.factory.GetRuntimeRoot(), imageRunArgs.ContainerId, bundle, spec, facade.ContainerActRun, imageRunArgs.Detach, "", imageRunArgs.SigProxy, false, configs.EndpointConfig{
+		NetworkName:  imageRunArgs.Network,
+		PortMappings: imageRunArgs.PortMappings,
+		Links:        imageRunArgs.Links,
+		DNS:          imageRunArgs.Dns,
+		Bandwidth:    imageRunArgs.Bandwidth,
+	}); err != nil {
 		if cleanErr := service.cleanContainer(imageRunArgs.ContainerId); cleanErr != nil {
 			logrus.Warnf(cleanErr.Error())
 		}
-		return err
+		return nil, err
 	}
 	if !imageRunArgs.Detach {
 		if cleanErr := service.cleanContainer(imageRunArgs.ContainerId); cleanErr != nil {
 			logrus.Warnf(cleanErr.Error())
 		}
 	}
-	return nil
+	return exitStatus, nil
 }
 
 func (service *imageService) prepareUnionFs(containerId string, imageId string) (string, error) {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	fileLock, err := service.lockRepositories(false)
+	if err != nil {
+		return "", err
+	}
+	defer fileLock.Unlock()
 	// 1. 拿到read only layer path, 并将其作为容器的read only layer
 	if _, exists := service.repositories[imageId]; !exists {
 		return "", exception.NewGenericError(fmt.Errorf("image %s not exists", imageId), exception.ImageIdNotExistsError)
@@ -279,12 +318,30 @@ func (service *imageService) prepareUnionFs(containerId string, imageId string)
 
 func (service *imageService) prepareSpec(rootfsPath string, bundle string, imageRunArgs *ImageRunArgs, mounts []specs.Mount) (*specs.Spec, error) {
 	spec := buildSpec(rootfsPath, imageRunArgs.Args, imageRunArgs.Env, imageRunArgs.Cwd, imageRunArgs.Hostname, imageRunArgs.Cpushare, imageRunArgs.Memory, imageRunArgs.Annotations, mounts)
+	spec.Process.Terminal = imageRunArgs.Tty
+	caps, err := capabilities.Adjust(spec.Process.Capabilities, imageRunArgs.CapAdd, imageRunArgs.CapDrop)
+	if err != nil {
+		return nil, exception.NewGenericError(err, exception.CapabilitiesError)
+	}
+	spec.Process.Capabilities = caps
+	// 镜像中的用户名只能在容器的/etc/passwd中解析，原样放在username中
+	if imageRunArgs.User != "" {
+		spec.Process.User = specs.User{Username: imageRunArgs.User}
+	}
+	if spec.Process.Rlimits, err = parseUlimits(imageRunArgs.Ulimits); err != nil {
+		return nil, exception.NewGenericError(err, exception.RlimitError)
+	}
+	seccompProfile, err := parseSecurityOpt(imageRunArgs.SecurityOpt)
+	if err != nil {
+		return nil, exception.NewGenericError(err, exception.SeccompError)
+	}
+	spec.Linux.Seccomp = specutil.SeccompToSpec(seccompProfile)
 	specFile, err := os.OpenFile(filepath.Join(bundle, constant.ContainerConfigFilename), os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
 		return nil, exception.NewGenericError(err, exception.SpecSaveError)
 	}
 	defer specFile.Close()
-	bytes, err := json.Marshal(spec)
+	bytes, err := marshalSpec(spec, seccompProfile)
 	if err != nil {
 		return nil, exception.NewGenericError(err, exception.SpecSaveError)
 	}
@@ -329,7 +386,7 @@ func (service *imageService) prepareMountPath(containerId string, layerId string
 	return layerPath, nil
 }
 
-func (service *imageService) prepareHosts(containerId string, links []string) (specs.Mount, error) {
+func (service *imageService) prepareHosts(containerId string, links []string, extraHosts []string) (specs.Mount, error) {
 	hostsPath := filepath.Join(service.imageRoot, constant.ImageContainersDir, containerId, "hosts")
 	file, err := os.OpenFile(hostsPath, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
@@ -339,20 +396,23 @@ func (service *imageService) prepareHosts(containerId string, links []string) (s
 	if _, err := file.WriteString("127.0.0.1 localhost\n"); err != nil {
 		return specs.Mount{}, exception.NewGenericError(err, exception.HostsError)
 	}
+	// link的别名由网络的DNS server解析,不再写入hosts,否则被link的容器重启后IP会过期
+	// 这里只检查被link的容器是否存在
 	for _, link := range links {
 		splits := strings.SplitN(link, ":", 2)
-		linkedContainerId := splits[0]
-		alias := splits[1]
-		container, err := service.factory.Load(linkedContainerId)
-		if err != nil {
+		if len(splits) != 2 {
+			return specs.Mount{}, exception.NewGenericError(fmt.Errorf("invalid link %s, should be container_id:alias", link), exception.HostsError)
+		}
+		if _, err := service.factory.Load(splits[0]); err != nil {
 			return specs.Mount{}, exception.NewGenericError(err, exception.HostsError)
 		}
-		stateStorage, err := container.State()
+	}
+	for _, extraHost := range extraHosts {
+		hostname, ip, err := parseExtraHost(extraHost)
 		if err != nil {
 			return specs.Mount{}, exception.NewGenericError(err, exception.HostsError)
 		}
-		ip := stateStorage.Endpoint.IpAddress.String()
-		if _, err := file.WriteString(fmt.Sprintf("%s %s\n", ip, alias)); err != nil {
+		if _, err := file.WriteString(fmt.Sprintf("%s %s\n", ip, hostname)); err != nil {
 			return specs.Mount{}, exception.NewGenericError(err, exception.HostsError)
 		}
 	}
@@ -367,18 +427,30 @@ func (service *imageService) prepareHosts(containerId string, links []string) (s
 	}, nil
 }
 
-func (service *imageService) prepareDns(containerId string) (specs.Mount, error) {
+/*
+nameserver指向网络的DNS server(bridge的网关IP)，格式见buildResolvConf
+*/
+func (service *imageService) prepareDns(containerId string, networkName string, dns []string, dnsSearch []string, dnsOptions []string) (specs.Mount, error) {
+	for _, nameserver := range dns {
+		if net.ParseIP(nameserver) == nil {
+			return specs.Mount{}, exception.NewGenericError(fmt.Errorf("invalid dns server %s", nameserver), exception.DnsError)
+		}
+	}
+	gatewayIP, err := service.prepareNetworkGateway(networkName)
+	if err != nil {
+		return specs.Mount{}, exception.NewGenericError(err, exception.DnsError)
+	}
 	resolvPath := filepath.Join(service.imageRoot, constant.ImageContainersDir, containerId, "resolv.conf")
 	file, err := os.OpenFile(resolvPath, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
 		return specs.Mount{}, exception.NewGenericError(err, exception.DnsError)
 	}
 	defer file.Close()
-	bytes, err := ioutil.ReadFile("/etc/resolv.conf")
+	hostConf, err := loadHostResolvConf()
 	if err != nil {
 		return specs.Mount{}, exception.NewGenericError(err, exception.DnsError)
 	}
-	if _, err := file.Write(bytes); err != nil {
+	if _, err := file.WriteString(buildResolvConf(gatewayIP, hostConf, dns, dnsSearch, dnsOptions)); err != nil {
 		return specs.Mount{}, exception.NewGenericError(err, exception.DnsError)
 	}
 	return specs.Mount{
@@ -392,6 +464,25 @@ func (service *imageService) prepareDns(containerId string) (specs.Mount, error)
 	}, nil
 }
 
+/*
+默认网络在第一个容器启动时才会创建，这里需要提前创建出来以得到网关IP
+*/
+func (service *imageService) prepareNetworkGateway(networkName string) (string, error) {
+	if networkName == "" {
+		networkName = network.DefaultBridgeName
+	}
+	bridge, err := network.LoadNetworkByName(networkName)
+	if err != nil {
+		if networkName != network.DefaultBridgeName {
+			return "", err
+		}
+		if bridge, err = network.CreateNetwork("bridge", network.DefaultBridgeName, &network.CreateOptions{Subnet: network.DefaultSubnet}); err != nil {
+			return "", err
+		}
+	}
+	return bridge.GatewayIP().String(), nil
+}
+
 func (service *imageService) prepareVolumes(volumes []string) ([]specs.Mount, error) {
 	var mounts []specs.Mount
 	for _, volume := range volumes {
@@ -431,17 +522,15 @@ func (service *imageService) prepareVolumes(volumes []string) ([]specs.Mount, er
 	return mounts, nil
 }
 
+/*
+调用方需要持有排他锁
+*/
 func (service *imageService) flushRepositories() error {
-	file, err := os.OpenFile(filepath.Join(service.imageRoot, constant.ImageRepositoriesFilename), os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0644)
-	if err != nil {
-		return exception.NewGenericError(err, exception.ImageRepositoriesDumpError)
-	}
-	defer file.Close()
 	bytes, err := json.Marshal(service.repositories)
 	if err != nil {
 		return exception.NewGenericError(err, exception.ImageRepositoriesDumpError)
 	}
-	if _, err := file.Write(bytes); err != nil {
+	if err := filelock.WriteFileAtomic(service.repositoriesPath, bytes, 0644); err != nil {
 		return exception.NewGenericError(err, exception.ImageRepositoriesDumpError)
 	}
 	return nil
@@ -450,6 +539,11 @@ func (service *imageService) flushRepositories() error {
 func (service *imageService) Create(id string, tarPath string) (err error) {
 	service.mutex.Lock()
 	defer service.mutex.Unlock()
+	fileLock, err := service.lockRepositories(true)
+	if err != nil {
+		return err
+	}
+	defer fileLock.Unlock()
 	if _, exist := service.repositories[id]; exist {
 		return exception.NewGenericError(fmt.Errorf("image with id exists: %v", id), exception.ImageIdExistsError)
 	}
@@ -489,7 +583,12 @@ func (service *imageService) Create(id string, tarPath string) (err error) {
 
 func (service *imageService) Delete(id string) error {
 	service.mutex.Lock()
-	service.mutex.Unlock()
+	defer service.mutex.Unlock()
+	fileLock, err := service.lockRepositories(true)
+	if err != nil {
+		return err
+	}
+	defer fileLock.Unlock()
 	if _, exist := service.repositories[id]; !exist {
 		return exception.NewGenericError(fmt.Errorf("image %s not exists", id), exception.ImageIdNotExistsError)
 	}
@@ -510,7 +609,12 @@ func (service *imageService) Delete(id string) error {
 
 func (service *imageService) List() ([]Image, error) {
 	service.mutex.Lock()
-	service.mutex.Unlock()
+	defer service.mutex.Unlock()
+	fileLock, err := service.lockRepositories(false)
+	if err != nil {
+		return nil, err
+	}
+	defer fileLock.Unlock()
 	var images []Image
 	for id := range service.repositories {
 		fileInfo, err := os.Stat(service.generateLayerPath(id))
@@ -529,7 +633,12 @@ func (service *imageService) List() ([]Image, error) {
 
 func (service *imageService) Get(id string) (Image, error) {
 	service.mutex.Lock()
-	service.mutex.Unlock()
+	defer service.mutex.Unlock()
+	fileLock, err := service.lockRepositories(false)
+	if err != nil {
+		return Image{}, err
+	}
+	defer fileLock.Unlock()
 	if _, exist := service.repositories[id]; !exist {
 		return Image{}, exception.NewGenericError(fmt.Errorf("image %s not exists", id), exception.ImageLoadError)
 	}
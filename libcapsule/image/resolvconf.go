@@ -0,0 +1,116 @@
+package image
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+const (
+	hostResolvConf = "/etc/resolv.conf"
+	// glibc最多只使用3个nameserver
+	maxNameservers = 3
+)
+
+// 宿主机上没有可用的nameserver时使用
+var defaultNameservers = []string{"8.8.8.8", "8.8.4.4"}
+
+type resolvConf struct {
+	nameservers []string
+	searches    []string
+	options     []string
+}
+
+func loadHostResolvConf() (*resolvConf, error) {
+	bytes, err := ioutil.ReadFile(hostResolvConf)
+	if err != nil {
+		return nil, err
+	}
+	return parseResolvConf(string(bytes)), nil
+}
+
+func parseResolvConf(content string) *resolvConf {
+	conf := &resolvConf{}
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			conf.nameservers = append(conf.nameservers, fields[1])
+		case "search", "domain":
+			// 后出现的search/domain会覆盖前面的
+			conf.searches = fields[1:]
+		case "options":
+			conf.options = append(conf.options, fields[1:]...)
+		}
+	}
+	return conf
+}
+
+/*
+容器有自己的network namespace，宿主机上的127.0.0.53(systemd-resolved)之类的loopback地址在容器中是访问不到的
+过滤后如果没有剩余的nameserver，则使用默认的公共DNS
+*/
+func filterLoopbackNameservers(nameservers []string) []string {
+	var result []string
+	for _, nameserver := range nameservers {
+		ip := net.ParseIP(nameserver)
+		if ip == nil || ip.IsLoopback() {
+			continue
+		}
+		result = append(result, nameserver)
+	}
+	if len(result) == 0 {
+		return defaultNameservers
+	}
+	return result
+}
+
+/*
+1. nameserver: 第一个是网络的DNS server(网关IP)，用于解析容器名，之后是--dns或宿主机的nameserver，作为DNS server不可用时的备用
+2. search、options: 优先使用--dns-search、--dns-option，否则沿用宿主机的配置
+*/
+func buildResolvConf(gatewayIP string, host *resolvConf, dns []string, dnsSearch []string, dnsOptions []string) string {
+	nameservers := []string{gatewayIP}
+	if len(dns) > 0 {
+		nameservers = append(nameservers, dns...)
+	} else {
+		nameservers = append(nameservers, filterLoopbackNameservers(host.nameservers)...)
+	}
+	if len(nameservers) > maxNameservers {
+		nameservers = nameservers[:maxNameservers]
+	}
+	searches := host.searches
+	if len(dnsSearch) > 0 {
+		searches = dnsSearch
+	}
+	options := host.options
+	if len(dnsOptions) > 0 {
+		options = dnsOptions
+	}
+	var content strings.Builder
+	for _, nameserver := range nameservers {
+		content.WriteString(fmt.Sprintf("nameserver %s\n", nameserver))
+	}
+	if len(searches) > 0 {
+		content.WriteString(fmt.Sprintf("search %s\n", strings.Join(searches, " ")))
+	}
+	if len(options) > 0 {
+		content.WriteString(fmt.Sprintf("options %s\n", strings.Join(options, " ")))
+	}
+	return content.String()
+}
+
+/*
+--add-host的格式为hostname:ip
+*/
+func parseExtraHost(extraHost string) (string, string, error) {
+	splits := strings.SplitN(extraHost, ":", 2)
+	if len(splits) != 2 || splits[0] == "" || net.ParseIP(splits[1]) == nil {
+		return "", "", fmt.Errorf("invalid extra host %s, should be hostname:ip", extraHost)
+	}
+	return splits[0], splits[1], nil
+}
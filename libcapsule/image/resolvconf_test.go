@@ -0,0 +1,113 @@
+package image
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseResolvConf(t *testing.T) {
+	conf := parseResolvConf(`# Generated by NetworkManager
+nameserver 127.0.0.53
+nameserver 10.0.0.2
+domain example.com
+search corp.example.com example.com
+options edns0
+options ndots:2 timeout:1
+nameserver
+`)
+	assert.Equal(t, []string{"127.0.0.53", "10.0.0.2"}, conf.nameservers)
+	assert.Equal(t, []string{"corp.example.com", "example.com"}, conf.searches)
+	assert.Equal(t, []string{"edns0", "ndots:2", "timeout:1"}, conf.options)
+}
+
+func TestFilterLoopbackNameservers(t *testing.T) {
+	for _, c := range []struct {
+		nameservers []string
+		expected    []string
+	}{
+		{[]string{"10.0.0.2", "1.1.1.1"}, []string{"10.0.0.2", "1.1.1.1"}},
+		{[]string{"127.0.0.53", "10.0.0.2"}, []string{"10.0.0.2"}},
+		{[]string{"127.0.0.1", "::1", "10.0.0.2", "127.1.2.3"}, []string{"10.0.0.2"}},
+		{[]string{"fe80::1", "::1"}, []string{"fe80::1"}},
+		// 不是IP的nameserver也被过滤
+		{[]string{"dns.example.com", "10.0.0.2"}, []string{"10.0.0.2"}},
+		// 没有剩余时使用默认的公共DNS
+		{[]string{"127.0.0.53"}, []string{"8.8.8.8", "8.8.4.4"}},
+		{[]string{"::1", "127.0.0.1"}, []string{"8.8.8.8", "8.8.4.4"}},
+		{nil, []string{"8.8.8.8", "8.8.4.4"}},
+	} {
+		assert.Equal(t, c.expected, filterLoopbackNameservers(c.nameservers), "%v", c.nameservers)
+	}
+}
+
+func TestBuildResolvConf(t *testing.T) {
+	host := &resolvConf{
+		nameservers: []string{"127.0.0.53", "10.0.0.2", "10.0.0.3", "10.0.0.4"},
+		searches:    []string{"example.com"},
+		options:     []string{"edns0"},
+	}
+	for _, c := range []struct {
+		name       string
+		host       *resolvConf
+		dns        []string
+		dnsSearch  []string
+		dnsOptions []string
+		expected   string
+	}{
+		{
+			// 网关之后最多再保留2个nameserver
+			name:     "host nameservers capped at 3",
+			host:     host,
+			expected: "nameserver 192.168.1.1\nnameserver 10.0.0.2\nnameserver 10.0.0.3\nsearch example.com\noptions edns0\n",
+		},
+		{
+			name:     "only loopback nameservers on host",
+			host:     &resolvConf{nameservers: []string{"127.0.0.53"}},
+			expected: "nameserver 192.168.1.1\nnameserver 8.8.8.8\nnameserver 8.8.4.4\n",
+		},
+		{
+			name:     "empty host resolv.conf",
+			host:     &resolvConf{},
+			expected: "nameserver 192.168.1.1\nnameserver 8.8.8.8\nnameserver 8.8.4.4\n",
+		},
+		{
+			// --dns不做loopback过滤
+			name:     "dns overrides host nameservers",
+			host:     host,
+			dns:      []string{"1.1.1.1"},
+			expected: "nameserver 192.168.1.1\nnameserver 1.1.1.1\nsearch example.com\noptions edns0\n",
+		},
+		{
+			name:     "dns capped at 3",
+			host:     host,
+			dns:      []string{"1.1.1.1", "1.0.0.1", "9.9.9.9"},
+			expected: "nameserver 192.168.1.1\nnameserver 1.1.1.1\nnameserver 1.0.0.1\nsearch example.com\noptions edns0\n",
+		},
+		{
+			name:       "dns search and options override host",
+			host:       host,
+			dnsSearch:  []string{"a.com", "b.com"},
+			dnsOptions: []string{"ndots:1", "rotate"},
+			expected:   "nameserver 192.168.1.1\nnameserver 10.0.0.2\nnameserver 10.0.0.3\nsearch a.com b.com\noptions ndots:1 rotate\n",
+		},
+	} {
+		assert.Equal(t, c.expected, buildResolvConf("192.168.1.1", c.host, c.dns, c.dnsSearch, c.dnsOptions), c.name)
+	}
+}
+
+func TestParseExtraHost(t *testing.T) {
+	hostname, ip, err := parseExtraHost("db:10.0.0.5")
+	assert.Nil(t, err)
+	assert.Equal(t, "db", hostname)
+	assert.Equal(t, "10.0.0.5", ip)
+
+	hostname, ip, err = parseExtraHost("v6:fe80::1")
+	assert.Nil(t, err)
+	assert.Equal(t, "v6", hostname)
+	assert.Equal(t, "fe80::1", ip)
+
+	for _, extraHost := range []string{"db", "db:", ":10.0.0.5", "db:not-an-ip"} {
+		_, _, err := parseExtraHost(extraHost)
+		assert.NotNil(t, err, extraHost)
+	}
+}
@@ -1,6 +1,17 @@
 package image
 
-import "github.com/opencontainers/runtime-spec/specs-go"
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/songxinjianqwe/capsule/libcapsule/configs"
+	"github.com/songxinjianqwe/capsule/libcapsule/util/capabilities"
+	"github.com/songxinjianqwe/capsule/libcapsule/util/rootfs"
+	"github.com/songxinjianqwe/capsule/libcapsule/util/seccomp"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
 
 var defaultMounts = []specs.Mount{
 	{
@@ -52,14 +63,17 @@ func buildSpec(rootfsPath string, args []string, env []string, cwd string, hostn
 			Readonly: false,
 		},
 		Process: &specs.Process{
-			Args: args,
-			Env:  env,
-			Cwd:  cwd,
+			Args:         args,
+			Env:          env,
+			Cwd:          cwd,
+			Capabilities: capabilities.DefaultSpecCapabilities(),
 		},
 		Hostname:    hostname,
 		Mounts:      mounts,
 		Annotations: annotations,
 		Linux: &specs.Linux{
+			MaskedPaths:   rootfs.DefaultMaskedPaths,
+			ReadonlyPaths: rootfs.DefaultReadonlyPaths,
 			Resources: &specs.LinuxResources{
 				Devices: []specs.LinuxDeviceCgroup{
 					{
@@ -94,3 +108,84 @@ func buildSpec(rootfsPath string, args []string, env []string, cwd string, hostn
 		},
 	}
 }
+
+/*
+解析--security-opt，目前只支持seccomp
+seccomp=unconfined不做限制，seccomp=<file>使用文件中的profile，没有指定时使用默认的profile
+*/
+func parseSecurityOpt(securityOpts []string) (*configs.Seccomp, error) {
+	profile := seccomp.DefaultProfile()
+	for _, opt := range securityOpts {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 || kv[0] != "seccomp" {
+			return nil, fmt.Errorf("invalid --security-opt %s", opt)
+		}
+		if kv[1] == "unconfined" {
+			profile = nil
+			continue
+		}
+		bytes, err := ioutil.ReadFile(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		profile = &configs.Seccomp{}
+		if err := json.Unmarshal(bytes, profile); err != nil {
+			return nil, fmt.Errorf("parsing seccomp profile %s: %s", kv[1], err.Error())
+		}
+	}
+	return profile, nil
+}
+
+/*
+vendor中的specs.LinuxSeccomp没有errnoRet，seccomp需要单独写入linux.seccomp
+*/
+func marshalSpec(spec *specs.Spec, seccompProfile *configs.Seccomp) ([]byte, error) {
+	bytes, err := json.Marshal(spec)
+	if err != nil || seccompProfile == nil {
+		return bytes, err
+	}
+	var raw map[string]interface{}
+	if err := json.Unmarshal(bytes, &raw); err != nil {
+		return nil, err
+	}
+	linux, _ := raw["linux"].(map[string]interface{})
+	if linux == nil {
+		linux = make(map[string]interface{})
+		raw["linux"] = linux
+	}
+	linux["seccomp"] = seccompProfile
+	return json.Marshal(raw)
+}
+
+/*
+解析--ulimit，格式为<type>=<soft>[:<hard>]，比如nofile=1024:2048，没有hard时与soft一致
+*/
+func parseUlimits(ulimits []string) ([]specs.POSIXRlimit, error) {
+	var rlimits []specs.POSIXRlimit
+	for _, ulimit := range ulimits {
+		kv := strings.SplitN(ulimit, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid --ulimit %s", ulimit)
+		}
+		rlimitType := "RLIMIT_" + strings.ToUpper(kv[0])
+		if _, err := configs.ParseRlimitType(rlimitType); err != nil {
+			return nil, err
+		}
+		limits := strings.SplitN(kv[1], ":", 2)
+		soft, err := strconv.ParseUint(limits[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid soft limit of --ulimit %s", ulimit)
+		}
+		hard := soft
+		if len(limits) == 2 {
+			if hard, err = strconv.ParseUint(limits[1], 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid hard limit of --ulimit %s", ulimit)
+			}
+		}
+		if soft > hard {
+			return nil, fmt.Errorf("soft limit is greater than hard limit in --ulimit %s", ulimit)
+		}
+		rlimits = append(rlimits, specs.POSIXRlimit{Type: rlimitType, Soft: soft, Hard: hard})
+	}
+	return rlimits, nil
+}
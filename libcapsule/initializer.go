@@ -3,9 +3,16 @@ package libcapsule
 import (
 	"fmt"
 	"github.com/songxinjianqwe/capsule/libcapsule/constant"
+	"github.com/songxinjianqwe/capsule/libcapsule/util/capabilities"
+	"github.com/songxinjianqwe/capsule/libcapsule/util/console"
+	"github.com/songxinjianqwe/capsule/libcapsule/util/exception"
+	"github.com/songxinjianqwe/capsule/libcapsule/util/user"
 	"golang.org/x/sys/unix"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
+	"syscall"
 )
 
 type InitializerType string
@@ -19,6 +26,121 @@ type Initializer interface {
 	Init() error
 }
 
+/*
+终端模式下，在容器中创建pty，将master通过console socket发送给parent，slave作为当前进程的控制终端和标准输入输出
+*/
+func setupConsole() error {
+	socketFd, err := strconv.Atoi(os.Getenv(constant.EnvConsoleSocket))
+	if err != nil {
+		return exception.NewGenericErrorWithContext(err, exception.EnvError, "converting EnvConsoleSocket to int")
+	}
+	socket := os.NewFile(uintptr(socketFd), "console-socket")
+	defer socket.Close()
+	master, slavePath, err := console.OpenPty()
+	if err != nil {
+		return exception.NewGenericErrorWithContext(err, exception.ConsoleError, "opening pty")
+	}
+	defer master.Close()
+	if err := console.SendFd(socket, master); err != nil {
+		return exception.NewGenericErrorWithContext(err, exception.ConsoleError, "sending pty master")
+	}
+	if err := console.SetupSlave(slavePath); err != nil {
+		return exception.NewGenericErrorWithContext(err, exception.ConsoleError, "setting up pty slave")
+	}
+	return nil
+}
+
+/*
+设置oom_score_adj、rlimit和no_new_privs
+降低oom_score_adj和调高hard limit都需要CAP_SYS_RESOURCE，所以要在降低权限之前调用
+*/
+func setupProcessLimits(process *Process) error {
+	if process.OomScoreAdj != nil {
+		if err := ioutil.WriteFile("/proc/self/oom_score_adj", []byte(strconv.Itoa(*process.OomScoreAdj)), 0); err != nil {
+			return exception.NewGenericErrorWithContext(err, exception.OomScoreAdjError, "writing oom_score_adj")
+		}
+	}
+	// 需要使用syscall.Setrlimit，否则syscall.Exec时go会将RLIMIT_NOFILE恢复为capsule启动时的值
+	for _, rlimit := range process.Rlimits {
+		if err := syscall.Setrlimit(rlimit.Type, &syscall.Rlimit{Cur: rlimit.Soft, Max: rlimit.Hard}); err != nil {
+			return exception.NewGenericErrorWithContext(err, exception.RlimitError, fmt.Sprintf("setting rlimit type %d", rlimit.Type))
+		}
+	}
+	if process.NoNewPrivileges {
+		if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+			return exception.NewGenericErrorWithContext(err, exception.NoNewPrivilegesError, "setting no_new_privs")
+		}
+	}
+	return nil
+}
+
+/*
+设置容器进程的capability并切换用户，需要在容器的其他设置都完成之后调用
+*/
+func finalizeProcess(process *Process) error {
+	if process.Capabilities == nil {
+		return setupUser(process)
+	}
+	caps, err := capabilities.New(process.Capabilities)
+	if err != nil {
+		return exception.NewGenericErrorWithContext(err, exception.CapabilitiesError, "parsing capabilities")
+	}
+	if err := caps.ApplyBoundingSet(); err != nil {
+		return exception.NewGenericErrorWithContext(err, exception.CapabilitiesError, "applying bounding set")
+	}
+	// setuid为非root时会清空permitted，需要保留下来，之后再设置为配置的capability
+	if err := unix.Prctl(unix.PR_SET_KEEPCAPS, 1, 0, 0, 0); err != nil {
+		return exception.NewGenericErrorWithContext(err, exception.CapabilitiesError, "setting keep caps")
+	}
+	if err := setupUser(process); err != nil {
+		return err
+	}
+	if err := unix.Prctl(unix.PR_SET_KEEPCAPS, 0, 0, 0, 0); err != nil {
+		return exception.NewGenericErrorWithContext(err, exception.CapabilitiesError, "clearing keep caps")
+	}
+	if err := caps.ApplyCaps(); err != nil {
+		return exception.NewGenericErrorWithContext(err, exception.CapabilitiesError, "applying capabilities")
+	}
+	return nil
+}
+
+/*
+切换到容器进程的用户，需要在pivot root之后调用，用户和组从容器的/etc/passwd和/etc/group中解析
+*/
+func setupUser(process *Process) error {
+	execUser, err := user.GetExecUser(process.User, process.AdditionalGroups, user.PasswdPath, user.GroupPath)
+	if err != nil {
+		return exception.NewGenericErrorWithContext(err, exception.UserError, "resolving user")
+	}
+	// 终端属于root，切换用户之前交给容器进程的用户
+	if process.Terminal {
+		if err := unix.Fchown(0, execUser.Uid, execUser.Gid); err != nil {
+			return exception.NewGenericErrorWithContext(err, exception.ConsoleError, "chown pty slave")
+		}
+	}
+	// 先设置附加组和gid，setuid之后就没有权限了
+	// syscall中的Setgroups/Setgid/Setuid会作用于所有线程
+	if err := syscall.Setgroups(execUser.Sgids); err != nil {
+		return exception.NewGenericErrorWithContext(err, exception.UserError, "setgroups")
+	}
+	if err := syscall.Setgid(execUser.Gid); err != nil {
+		return exception.NewGenericErrorWithContext(err, exception.UserError, "setgid")
+	}
+	if err := syscall.Setuid(execUser.Uid); err != nil {
+		return exception.NewGenericErrorWithContext(err, exception.UserError, "setuid")
+	}
+	if process.Umask != nil {
+		unix.Umask(int(*process.Umask))
+	}
+	// 没有指定HOME时使用用户的home目录
+	if os.Getenv("HOME") == "" {
+		if err := os.Setenv("HOME", execUser.Home); err != nil {
+			return exception.NewGenericErrorWithContext(err, exception.EnvError, "setting HOME")
+		}
+	}
+	return nil
+}
+
 func NewInitializer(initializerType InitializerType, config *InitExecConfig, configPipe *os.File, runtimeRoot string) (Initializer, error) {
 	containerRoot := filepath.Join(runtimeRoot, constant.ContainerDir, config.ID)
 	switch initializerType {
@@ -26,7 +148,6 @@ func NewInitializer(initializerType InitializerType, config *InitExecConfig, con
 		return &InitializerStandardImpl{
 			config:        config,
 			configPipe:    configPipe,
-			parentPid:     unix.Getppid(),
 			containerRoot: containerRoot,
 		}, nil
 	case ExecInitializer:
@@ -5,6 +5,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/songxinjianqwe/capsule/libcapsule/constant"
 	"github.com/songxinjianqwe/capsule/libcapsule/util/exception"
+	"github.com/songxinjianqwe/capsule/libcapsule/util/seccomp"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -19,6 +20,7 @@ type InitializerExecImpl struct {
 
 func (initializer *InitializerExecImpl) Init() error {
 	logrus.WithField("exec", true).Infof("InitializerExecImpl Init()")
+	// exec进程成功时不需要回复parent，执行命令时config pipe随之关闭
 	// 如果后台运行，则将stdout输出到日志文件中
 	if initializer.config.ProcessConfig.Detach {
 		// 输出重定向
@@ -34,12 +36,35 @@ func (initializer *InitializerExecImpl) Init() error {
 			return err
 		}
 	}
+	if initializer.config.ProcessConfig.Terminal {
+		if err := setupConsole(); err != nil {
+			return err
+		}
+	}
+	if err := setupProcessLimits(&initializer.config.ProcessConfig); err != nil {
+		return err
+	}
+	// 没有设置no_new_privs时，加载seccomp需要CAP_SYS_ADMIN，只能在降低权限之前加载
+	if !initializer.config.ProcessConfig.NoNewPrivileges {
+		if err := seccomp.InitSeccomp(initializer.config.ContainerConfig.Seccomp); err != nil {
+			return exception.NewGenericErrorWithContext(err, exception.SeccompError, "exec process/init seccomp")
+		}
+	}
+	if err := finalizeProcess(&initializer.config.ProcessConfig); err != nil {
+		return err
+	}
 	// look path 可以在系统的PATH里面寻找命令的绝对路径
 	name, err := exec.LookPath(initializer.config.ProcessConfig.Args[0])
 	if err != nil {
 		return exception.NewGenericErrorWithContext(err, exception.LookPathError, "exec process/look path cmd")
 	}
 	logrus.WithField("exec", true).Infof("look path: %s", name)
+	// 设置了no_new_privs时在exec之前才加载seccomp，尽量减少需要seccomp放行的系统调用
+	if initializer.config.ProcessConfig.NoNewPrivileges {
+		if err := seccomp.InitSeccomp(initializer.config.ContainerConfig.Seccomp); err != nil {
+			return exception.NewGenericErrorWithContext(err, exception.SeccompError, "exec process/init seccomp")
+		}
+	}
 	// syscall.Exec与cmd.Start不同，后者是启动一个新的进程来执行命令
 	// 而前者会在覆盖当前进程的镜像、数据、堆栈等信息，包括PID。
 	logrus.WithField("exec", true).Infof("syscall.Exec(name: %s, args: %v, env: %v)...", name, initializer.config.ProcessConfig.Args, os.Environ())
@@ -3,17 +3,17 @@ package libcapsule
 import (
 	"fmt"
 	"github.com/sirupsen/logrus"
-	"github.com/songxinjianqwe/capsule/libcapsule/configs"
 	"github.com/songxinjianqwe/capsule/libcapsule/constant"
 	"github.com/songxinjianqwe/capsule/libcapsule/util"
 	"github.com/songxinjianqwe/capsule/libcapsule/util/exception"
 	"github.com/songxinjianqwe/capsule/libcapsule/util/rootfs"
+	"github.com/songxinjianqwe/capsule/libcapsule/util/seccomp"
 	"golang.org/x/sys/unix"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
-	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 )
@@ -21,7 +21,6 @@ import (
 type InitializerStandardImpl struct {
 	config        *InitExecConfig
 	configPipe    *os.File
-	parentPid     int
 	containerRoot string
 }
 
@@ -34,44 +33,17 @@ type InitializerStandardImpl struct {
 */
 func (initializer *InitializerStandardImpl) Init() (err error) {
 	logrus.WithField("init", true).Infof("InitializerStandardImpl Init()")
-	// 如果后台运行，则将stdout输出到日志文件中
-	if initializer.config.ProcessConfig.Detach {
-		logrus.Infof("detach -> replace stdout to log file")
-		// 输出重定向
-		// /var/run/capsule/containers/$container_id/container.log
-		logFile, err := os.OpenFile(filepath.Join(initializer.containerRoot, constant.ContainerInitLogFilename), os.O_WRONLY|os.O_CREATE|os.O_SYNC, 0644)
-		if err != nil {
-			return err
-		}
-		if err := syscall.Dup2(int(logFile.Fd()), 1); err != nil {
-			return err
-		}
-		if err := syscall.Dup2(int(logFile.Fd()), 2); err != nil {
-			return err
-		}
-	}
-
-	defer func() {
-		// 后面再出现err就不管了
-		if err != nil {
-			logrus.WithField("init", true).Errorf("init process failed, send SIGCHLD signal to parent")
-			// 告诉parent，init process已经初始化完毕，马上要执行命令了
-			if err := unix.Kill(initializer.parentPid, syscall.SIGCHLD); err != nil {
-				logrus.WithField("init", true).Errorf("send SIGABRT signal to parent failed")
-			}
-		}
-	}()
+	// 如果后台运行，stdio已经由parent连接到了relay进程，由relay写入日志文件
+	// 初始化失败时由StartInitialization把错误通过config pipe回复给parent
 
 	// 初始化rootfs
 	if err = initializer.setUpRootfs(); err != nil {
 		return exception.NewGenericErrorWithContext(err, exception.RootfsError, "init process/prepare rootfs")
 	}
 
-	// 如果有设置Mount的Namespace，则设置rootfs与mount为read only（如果需要的话）
-	if initializer.config.ContainerConfig.Namespaces.Contains(configs.NEWNS) {
-		if err := initializer.SetRootfsReadOnlyIfSpecified(); err != nil {
-			return err
-		}
+	// 设置rootfs与mount为read only（如果需要的话）
+	if err := initializer.SetRootfsReadOnlyIfSpecified(); err != nil {
+		return err
 	}
 
 	// 初始化hostname
@@ -89,6 +61,39 @@ func (initializer *InitializerStandardImpl) Init() (err error) {
 		}
 	}
 
+	// 屏蔽和只读需要在设置sysctl之后，否则无法写入/proc/sys
+	for _, path := range initializer.config.ContainerConfig.ReadonlyPaths {
+		if err = rootfs.ReadonlyPath(path); err != nil {
+			return exception.NewGenericErrorWithContext(err, exception.MountError, fmt.Sprintf("init process/remount %s as readonly", path))
+		}
+	}
+	for _, path := range initializer.config.ContainerConfig.MaskPaths {
+		if err = rootfs.MaskPath(path); err != nil {
+			return exception.NewGenericErrorWithContext(err, exception.MountError, fmt.Sprintf("init process/mask %s", path))
+		}
+	}
+
+	// 需要在回复ready之前完成，parent收到ready后会接收pty master
+	if initializer.config.ProcessConfig.Terminal {
+		if err = setupConsole(); err != nil {
+			return err
+		}
+	}
+
+	if err = setupProcessLimits(&initializer.config.ProcessConfig); err != nil {
+		return err
+	}
+	// 没有设置no_new_privs时，加载seccomp需要CAP_SYS_ADMIN，只能在降低权限之前加载
+	if !initializer.config.ProcessConfig.NoNewPrivileges {
+		if err = seccomp.InitSeccomp(initializer.config.ContainerConfig.Seccomp); err != nil {
+			return exception.NewGenericErrorWithContext(err, exception.SeccompError, "init process/init seccomp")
+		}
+	}
+	// 降低权限之后就没有权限再修改容器的环境了，所以放在最后
+	if err = finalizeProcess(&initializer.config.ProcessConfig); err != nil {
+		return err
+	}
+
 	// look path 可以在系统的PATH里面寻找命令的绝对路径
 	name, err := exec.LookPath(initializer.config.ProcessConfig.Args[0])
 	if err != nil {
@@ -99,17 +104,25 @@ func (initializer *InitializerStandardImpl) Init() (err error) {
 	logrus.WithField("init", true).Infof("sync parent ready...")
 	// child --------------> parent
 	// 告诉parent，init process已经初始化完毕，马上要执行命令了
-	if err := util.SyncSignal(initializer.parentPid, syscall.SIGUSR1); err != nil {
-		return exception.NewGenericErrorWithContext(err, exception.SignalError, "init process/sync parent ready")
+	if err = writeSync(initializer.configPipe, syncReady); err != nil {
+		return exception.NewGenericErrorWithContext(err, exception.PipeError, "init process/sync parent ready")
 	}
 
 	// child <-------------- parent
-	// 等待parent给一个继续执行命令，即exec的信号
-	logrus.WithField("init", true).Info("start waiting parent continue(SIGUSR2) signal...")
-	util.WaitSignal(syscall.SIGUSR2)
-	logrus.WithField("init", true).Info("received parent continue(SIGUSR2) signal")
+	// 等待parent打开exec.fifo，即start
+	logrus.WithField("init", true).Info("start waiting parent open exec.fifo...")
+	if err = waitExecFifo(); err != nil {
+		return exception.NewGenericErrorWithContext(err, exception.PipeError, "init process/wait exec.fifo")
+	}
+	logrus.WithField("init", true).Info("parent opened exec.fifo")
 
 	logrus.WithField("init", true).Info("execute real command and cover capsule init config")
+	// 设置了no_new_privs时在exec之前才加载seccomp，尽量减少需要seccomp放行的系统调用
+	if initializer.config.ProcessConfig.NoNewPrivileges {
+		if err = seccomp.InitSeccomp(initializer.config.ContainerConfig.Seccomp); err != nil {
+			return exception.NewGenericErrorWithContext(err, exception.SeccompError, "init process/init seccomp")
+		}
+	}
 	// syscall.Exec与cmd.Start不同，后者是启动一个新的进程来执行命令
 	// 而前者会在覆盖当前进程的镜像、数据、堆栈等信息，包括PID。
 	logrus.WithField("init", true).Infof("syscall.Exec(name: %s, args: %v, env: %v)...", name, initializer.config.ProcessConfig.Args, os.Environ())
@@ -123,6 +136,25 @@ func (initializer *InitializerStandardImpl) Init() (err error) {
 // private
 // **************************************************************************************************
 
+/*
+exec.fifo在容器rootfs之外，只能通过parent传进来的O_PATH fd重新打开
+以只写方式打开会一直阻塞，直到capsule start以只读方式打开它，然后写入一个字节表示开始执行命令
+*/
+func waitExecFifo() error {
+	fifoFd, err := strconv.Atoi(os.Getenv(constant.EnvExecFifo))
+	if err != nil {
+		return exception.NewGenericErrorWithContext(err, exception.EnvError, "converting EnvExecFifo to int")
+	}
+	defer unix.Close(fifoFd)
+	fifo, err := os.OpenFile(fmt.Sprintf("/proc/self/fd/%d", fifoFd), os.O_WRONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer fifo.Close()
+	_, err = fifo.Write([]byte{0})
+	return err
+}
+
 func (initializer *InitializerStandardImpl) setUpRootfs() error {
 	logrus.WithField("init", true).Info("setting up rootfs...")
 	containerRootfs := initializer.config.ContainerConfig.Rootfs
@@ -138,19 +170,37 @@ func (initializer *InitializerStandardImpl) setUpRootfs() error {
 	}
 
 	// 设备
-	for _, node := range initializer.config.ContainerConfig.Devices {
-		// containers running in a user namespace are not allowed to mknod
-		// devices so we can just bind mount it from the host.
-		if err := rootfs.CreateDeviceNode(containerRootfs, node); err != nil {
+	if rootfs.NeedsSetupDev(&initializer.config.ContainerConfig) {
+		for _, node := range initializer.config.ContainerConfig.Devices {
+			// containers running in a user namespace are not allowed to mknod
+			// devices so we can just bind mount it from the host.
+			if err := rootfs.CreateDeviceNode(containerRootfs, node); err != nil {
+				return exception.NewGenericErrorWithContext(err, exception.RootfsError, fmt.Sprintf("creating device %s", node.Path))
+			}
+		}
+		if err := rootfs.SetupDevSymlinks(containerRootfs); err != nil {
+			return exception.NewGenericErrorWithContext(err, exception.RootfsError, "creating /dev symlinks")
+		}
+		// /dev/ptmx指向容器自己的devpts
+		if err := rootfs.SetupPtmx(containerRootfs); err != nil {
 			return err
 		}
 	}
-	// 如果使用了Mount的namespace，则使用pivot_root命令
+	// 使用pivot_root命令切换rootfs，指定了no pivot时使用MS_MOVE + chroot
+	// 转换spec时已经保证了有mount namespace，这些操作不会影响宿主机
 	// pivot root放在mount之前的话，会报错invalid argument
-	if initializer.config.ContainerConfig.Namespaces.Contains(configs.NEWNS) {
-		if err := rootfs.PivotRoot(containerRootfs); err != nil {
+	if initializer.config.ContainerConfig.NoPivotRoot {
+		if err := rootfs.MsMoveRoot(containerRootfs); err != nil {
 			return err
 		}
+	} else if err := rootfs.PivotRoot(containerRootfs); err != nil {
+		return err
+	}
+	// 传播类型作用于当前的根目录，所以在pivot root之后设置
+	if propagation := initializer.config.ContainerConfig.RootPropagation; propagation != 0 {
+		if err := unix.Mount("", "/", "", uintptr(propagation), ""); err != nil {
+			return exception.NewGenericErrorWithContext(err, exception.MountError, "setting rootfs propagation")
+		}
 	}
 	return nil
 }
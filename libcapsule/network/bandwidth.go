@@ -0,0 +1,225 @@
+package network
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// tbf允许数据包在队列中等待的最长时间
+	tbfLatencyInMillis = 50
+	// 没有指定burst时，允许10ms的突发流量
+	defaultBurstDivisor = 100
+	minBurstInBytes     = 32 * 1024
+)
+
+var rateUnits = map[string]float64{
+	"bit":  1.0 / 8,
+	"kbit": 1000.0 / 8,
+	"mbit": 1000 * 1000.0 / 8,
+	"gbit": 1000 * 1000 * 1000.0 / 8,
+	"bps":  1,
+	"kbps": 1000,
+	"mbps": 1000 * 1000,
+	"gbps": 1000 * 1000 * 1000,
+}
+
+var sizeUnits = map[string]float64{
+	"b":  1,
+	"k":  1024,
+	"kb": 1024,
+	"m":  1024 * 1024,
+	"mb": 1024 * 1024,
+	"g":  1024 * 1024 * 1024,
+	"gb": 1024 * 1024 * 1024,
+}
+
+/*
+与tc的写法一致，比如10mbit、100kbps，没有单位时表示bit/s
+返回值的单位为byte/s
+*/
+func ParseRate(rate string) (uint64, error) {
+	return parseWithUnits(rate, rateUnits, "bit")
+}
+
+/*
+比如32kb、1mb，没有单位时表示byte
+*/
+func ParseSize(size string) (uint64, error) {
+	return parseWithUnits(size, sizeUnits, "b")
+}
+
+func parseWithUnits(value string, units map[string]float64, defaultUnit string) (uint64, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	index := strings.IndexFunc(value, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	number, unit := value, defaultUnit
+	if index >= 0 {
+		number, unit = value[:index], value[index:]
+	}
+	multiplier, exists := units[unit]
+	if !exists {
+		return 0, fmt.Errorf("invalid unit %q in %q", unit, value)
+	}
+	parsed, err := strconv.ParseFloat(number, 64)
+	if err != nil || parsed <= 0 {
+		return 0, fmt.Errorf("invalid value %q", value)
+	}
+	return uint64(parsed * multiplier), nil
+}
+
+func (endpoint *Endpoint) GetIfbName() string {
+	return ifbName(endpoint.GetHostVethName())
+}
+
+/*
+ifb的名称由宿主机一侧的veth名称推导出来
+*/
+func ifbName(hostVethName string) string {
+	return fmt.Sprintf("ifb-%s", hostVethName)
+}
+
+/*
+限速都在宿主机一侧的veth上做:
+1. 容器的ingress即宿主机veth的egress，直接在veth上挂tbf
+2. 容器的egress即宿主机veth的ingress，ingress方向没有队列，需要将流量重定向到ifb设备上，再在ifb上挂tbf
+*/
+func setupBandwidth(endpoint *Endpoint) error {
+	bandwidth := endpoint.Bandwidth
+	if bandwidth == nil {
+		return nil
+	}
+	hostVeth, err := netlink.LinkByName(endpoint.GetHostVethName())
+	if err != nil {
+		return err
+	}
+	if bandwidth.IngressRate > 0 {
+		logrus.Infof("limit ingress rate of %s to %d bytes/s", endpoint.Name, bandwidth.IngressRate)
+		if err := createTbf(hostVeth.Attrs().Index, bandwidth.IngressRate, bandwidth.IngressBurst); err != nil {
+			return err
+		}
+	}
+	if bandwidth.EgressRate > 0 {
+		logrus.Infof("limit egress rate of %s to %d bytes/s", endpoint.Name, bandwidth.EgressRate)
+		ifb, err := createIfb(endpoint.GetIfbName(), hostVeth.Attrs().MTU)
+		if err != nil {
+			return err
+		}
+		if err := redirectIngressToIfb(hostVeth.Attrs().Index, ifb.Attrs().Index); err != nil {
+			return err
+		}
+		if err := createTbf(ifb.Attrs().Index, bandwidth.EgressRate, bandwidth.EgressBurst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+容器的net namespace销毁后，宿主机的veth和挂在上面的qdisc会随之销毁，但ifb需要手动删除
+*/
+func deleteBandwidth(endpoint *Endpoint) error {
+	if endpoint.Bandwidth == nil {
+		return nil
+	}
+	if hostVeth, err := netlink.LinkByName(endpoint.GetHostVethName()); err == nil {
+		qdiscs, err := netlink.QdiscList(hostVeth)
+		if err != nil {
+			return err
+		}
+		for _, qdisc := range qdiscs {
+			switch qdisc.(type) {
+			case *netlink.Tbf, *netlink.Ingress:
+				if err := netlink.QdiscDel(qdisc); err != nil && err != syscall.ENOENT {
+					return err
+				}
+			}
+		}
+	}
+	if endpoint.Bandwidth.EgressRate > 0 {
+		ifb, err := netlink.LinkByName(endpoint.GetIfbName())
+		if err != nil {
+			if _, ok := err.(netlink.LinkNotFoundError); ok {
+				return nil
+			}
+			return err
+		}
+		logrus.Infof("deleting ifb %s", endpoint.GetIfbName())
+		return netlink.LinkDel(ifb)
+	}
+	return nil
+}
+
+func createIfb(name string, mtu int) (netlink.Link, error) {
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = name
+	attrs.MTU = mtu
+	ifb := &netlink.Ifb{LinkAttrs: attrs}
+	if err := netlink.LinkAdd(ifb); err != nil {
+		return nil, err
+	}
+	if err := netlink.LinkSetUp(ifb); err != nil {
+		return nil, err
+	}
+	return netlink.LinkByName(name)
+}
+
+/*
+tc qdisc add dev $veth handle ffff: ingress
+tc filter add dev $veth parent ffff: protocol all u32 match u32 0 0 action mirred egress redirect dev $ifb
+*/
+func redirectIngressToIfb(linkIndex int, ifbIndex int) error {
+	ingress := &netlink.Ingress{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: linkIndex,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_INGRESS,
+		},
+	}
+	if err := netlink.QdiscAdd(ingress); err != nil {
+		return err
+	}
+	// Sel为nil时匹配所有的包
+	filter := &netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: linkIndex,
+			Parent:    ingress.Handle,
+			Priority:  1,
+			Protocol:  syscall.ETH_P_ALL,
+		},
+		Actions: []netlink.Action{netlink.NewMirredAction(ifbIndex)},
+	}
+	return netlink.FilterAdd(filter)
+}
+
+/*
+tc qdisc add dev $link root tbf rate $rate burst $burst latency 50ms
+*/
+func createTbf(linkIndex int, rate uint64, burst uint64) error {
+	if burst == 0 {
+		burst = rate / defaultBurstDivisor
+		if burst < minBurstInBytes {
+			burst = minBurstInBytes
+		}
+	}
+	// buffer是以tick为单位的发送burst字节所需的时间
+	buffer := uint32(netlink.Xmittime(rate, uint32(burst)))
+	latency := float64(netlink.TIME_UNITS_PER_SEC) * tbfLatencyInMillis / 1000
+	limit := uint32(float64(rate)*latency/float64(netlink.TIME_UNITS_PER_SEC)) + uint32(burst)
+	tbf := &netlink.Tbf{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: linkIndex,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		Rate:   rate,
+		Limit:  limit,
+		Buffer: buffer,
+	}
+	return netlink.QdiscAdd(tbf)
+}
@@ -0,0 +1,38 @@
+package network
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseRate(t *testing.T) {
+	rate, err := ParseRate("10mbit")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1250000), rate)
+
+	rate, err = ParseRate("1MBps")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1000000), rate)
+
+	rate, err = ParseRate("8000")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1000), rate)
+
+	_, err = ParseRate("10mb")
+	assert.NotNil(t, err)
+	_, err = ParseRate("mbit")
+	assert.NotNil(t, err)
+}
+
+func TestParseSize(t *testing.T) {
+	size, err := ParseSize("32kb")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(32*1024), size)
+
+	size, err = ParseSize("1500")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1500), size)
+
+	_, err = ParseSize("-1k")
+	assert.NotNil(t, err)
+}
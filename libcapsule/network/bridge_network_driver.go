@@ -2,17 +2,19 @@ package network
 
 import (
 	"fmt"
-	"github.com/coreos/go-iptables/iptables"
 	"github.com/sirupsen/logrus"
+	"github.com/songxinjianqwe/capsule/libcapsule/configs"
 	"github.com/songxinjianqwe/capsule/libcapsule/util/exception"
 	"github.com/vishvananda/netlink"
 	"net"
+	"strconv"
 	"strings"
 )
 
 type BridgeNetworkDriver struct {
 	runtimeRoot string
 	allocator   IPAM
+	firewall    Firewall
 }
 
 func (driver *BridgeNetworkDriver) Name() string {
@@ -23,35 +25,44 @@ func (driver *BridgeNetworkDriver) NetworkLabel() string {
 	return "capsule_bridge_label"
 }
 
-func (driver *BridgeNetworkDriver) Create(subnet string, bridgeName string) (*Network, error) {
-	// 如果subnet的格式是192.168.1.2/24，那么parseCIDR的第一个返回值是IP地址,192.168.1.2，第二个返回值是IPNet类型，192.168.1.0/24
-	_, ipRange, err := net.ParseCIDR(subnet)
-	if err != nil {
-		return nil, err
+func (driver *BridgeNetworkDriver) Create(name string, options *CreateOptions) (network *Network, err error) {
+	if _, err := driver.Load(name); err == nil {
+		return nil, exception.NewGenericError(fmt.Errorf("network %s exists", name), exception.BridgeNetworkCreateError)
 	}
+	network, err = parseCreateOptions(name, driver.Name(), options)
 	if err != nil {
-		return nil, err
+		return nil, exception.NewGenericError(err, exception.BridgeNetworkCreateError)
+	}
+	subnet := network.Subnet()
+	// 分配网关IP
+	gatewayIP := network.IpRange.IP
+	if options.Gateway != "" {
+		err = driver.allocator.AllocateIP(subnet, gatewayIP)
+	} else {
+		gatewayIP, err = driver.allocator.Allocate(subnet)
 	}
-	gatewayIP, err := driver.allocator.Allocate(ipRange)
 	if err != nil {
 		return nil, err
 	}
+	defer func() {
+		if err != nil {
+			if releaseErr := driver.allocator.Release(subnet, gatewayIP); releaseErr != nil {
+				logrus.Warnf("release gateway ip failed, cause: %s", releaseErr.Error())
+			}
+		}
+	}()
 	logrus.Infof("allocated gateway ip: %s", gatewayIP.String())
-	ipRange.IP = gatewayIP
-	network := &Network{
-		Name:    bridgeName,
-		ipRange: *ipRange,
-		Driver:  driver.Name(),
-	}
+	network.IpRange.IP = gatewayIP
 	logrus.Infof("network: %s", network)
+	bridgeName := network.GetBridgeName()
 
 	// 1.创建bridge
-	if err := createBridgeInterface(bridgeName, driver.NetworkLabel()); err != nil {
+	if err := createBridgeInterface(bridgeName, network.MTU, driver.NetworkLabel()+"-"+name); err != nil {
 		return nil, exception.NewGenericErrorWithContext(err, exception.BridgeNetworkCreateError, "create bridge")
 	}
 
 	// 2.设置Bridge的IP地址和路由
-	if err := setInterfaceIPAndRoute(bridgeName, *ipRange); err != nil {
+	if err := setInterfaceIPAndRoute(bridgeName, network.IpRange); err != nil {
 		return nil, exception.NewGenericErrorWithContext(err, exception.InterfaceIPAndRouteSetError, "set bridge ip and route")
 	}
 
@@ -60,14 +71,92 @@ func (driver *BridgeNetworkDriver) Create(subnet string, bridgeName string) (*Ne
 		return nil, exception.NewGenericErrorWithContext(err, exception.InterfaceSetUpError, "set bridge UP")
 	}
 
-	// 4.设置iptables SNAT规则（MASQUERADE）
-	if err := setupIPTablesMasquerade(bridgeName, *ipRange); err != nil {
-		return nil, exception.NewGenericErrorWithContext(err, exception.IPTablesSetError, "set iptables SNAT MASQUERADE RULE")
+	// 4.设置SNAT规则（MASQUERADE）
+	if network.EnableIPMasquerade {
+		network.Firewall = driver.firewall.Name()
+		if err := driver.firewall.SetupMasquerade(bridgeName, network.IpRange); err != nil {
+			return nil, exception.NewGenericErrorWithContext(err, exception.FirewallSetError, fmt.Sprintf("set %s SNAT MASQUERADE RULE", driver.firewall.Name()))
+		}
+	}
+
+	// 5.保存网络配置
+	if err := saveNetwork(driver.runtimeRoot, network); err != nil {
+		return nil, exception.NewGenericErrorWithContext(err, exception.BridgeNetworkCreateError, "save network")
+	}
+	return network, nil
+}
+
+/*
+校验network create的参数，--gateway只做解析，由调用方分配
+*/
+func parseCreateOptions(name string, driverName string, options *CreateOptions) (*Network, error) {
+	// 如果subnet的格式是192.168.1.2/24，那么parseCIDR的第一个返回值是IP地址,192.168.1.2，第二个返回值是IPNet类型，192.168.1.0/24
+	_, subnet, err := net.ParseCIDR(options.Subnet)
+	if err != nil {
+		return nil, err
+	}
+	network := &Network{
+		Name:               name,
+		IpRange:            *subnet,
+		Driver:             driverName,
+		MTU:                options.MTU,
+		EnableIPMasquerade: true,
+		ICC:                true,
+	}
+	// 未指定--gateway时IP暂时保留为网络地址，由调用方分配网关后替换
+	if options.Gateway != "" {
+		gatewayIP := net.ParseIP(options.Gateway).To4()
+		if gatewayIP == nil || !subnet.Contains(gatewayIP) {
+			return nil, fmt.Errorf("invalid gateway %s, should be an ip in subnet %s", options.Gateway, subnet)
+		}
+		network.IpRange.IP = gatewayIP
+	}
+	if options.IpRange != "" {
+		_, ipRange, err := net.ParseCIDR(options.IpRange)
+		if err != nil {
+			return nil, err
+		}
+		rangeOnes, _ := ipRange.Mask.Size()
+		subnetOnes, _ := subnet.Mask.Size()
+		if !subnet.Contains(ipRange.IP) || rangeOnes < subnetOnes {
+			return nil, fmt.Errorf("ip range %s is not in subnet %s", ipRange, subnet)
+		}
+		network.AllocatableRange = ipRange
+	}
+	if options.MTU < 0 {
+		return nil, fmt.Errorf("invalid mtu %d", options.MTU)
+	}
+	for key, value := range options.Options {
+		switch key {
+		case BridgeNameOption:
+			network.BridgeName = value
+		case EnableIPMasqueradeOption:
+			if network.EnableIPMasquerade, err = strconv.ParseBool(value); err != nil {
+				return nil, fmt.Errorf("invalid value %s of option %s", value, key)
+			}
+		case ICCOption:
+			if network.ICC, err = strconv.ParseBool(value); err != nil {
+				return nil, fmt.Errorf("invalid value %s of option %s", value, key)
+			}
+		default:
+			return nil, fmt.Errorf("unknown option %s", key)
+		}
 	}
 	return network, nil
 }
 
 func (driver *BridgeNetworkDriver) Load(name string) (*Network, error) {
+	network, err := loadNetwork(driver.runtimeRoot, name)
+	if err != nil {
+		return nil, exception.NewGenericError(err, exception.BridgeNetworkLoadError)
+	}
+	if network != nil {
+		if _, err := netlink.LinkByName(network.GetBridgeName()); err != nil {
+			return nil, exception.NewGenericError(err, exception.NetworkLinkNotFoundError)
+		}
+		return network, nil
+	}
+	// 没有配置文件的网络，bridge名称即为网络名称，从bridge上读取网段
 	iface, err := netlink.LinkByName(name)
 	if err != nil {
 		return nil, exception.NewGenericError(err, exception.NetworkLinkNotFoundError)
@@ -91,9 +180,11 @@ func (driver *BridgeNetworkDriver) Load(name string) (*Network, error) {
 		return nil, exception.NewGenericError(fmt.Errorf("label-matched addresses not found"), exception.BridgeNetworkLoadError)
 	}
 	return &Network{
-		Name:    name,
-		Driver:  driver.Name(),
-		ipRange: *bridgeAddr,
+		Name:               name,
+		Driver:             driver.Name(),
+		IpRange:            *bridgeAddr,
+		EnableIPMasquerade: true,
+		ICC:                true,
 	}, nil
 }
 
@@ -104,8 +195,9 @@ func (driver *BridgeNetworkDriver) List() ([]*Network, error) {
 	}
 	var networks []*Network
 	for _, link := range links {
-		if strings.HasPrefix(link.Attrs().Alias, driver.NetworkLabel()) {
-			instance, err := driver.Load(link.Attrs().Name)
+		// bridge的alias为 label-网络名称
+		if strings.HasPrefix(link.Attrs().Alias, driver.NetworkLabel()+"-") {
+			instance, err := driver.Load(strings.TrimPrefix(link.Attrs().Alias, driver.NetworkLabel()+"-"))
 			if err != nil {
 				return nil, err
 			}
@@ -122,13 +214,10 @@ func (driver *BridgeNetworkDriver) Delete(name string) error {
 	}
 	logrus.Infof("loaded network: %s", network)
 	// 删除SNAT规则
-	tables, err := iptables.New()
-	if err := tables.Delete(
-		"nat",
-		"POSTROUTING",
-		getSNATRuleSpecs(network.Name, network.ipRange)...,
-	); err != nil {
-		return exception.NewGenericError(err, exception.IPTablesDeleteError)
+	if network.EnableIPMasquerade {
+		if err := driver.recordedFirewall(network.Firewall).DeleteMasquerade(network.GetBridgeName(), network.IpRange); err != nil {
+			return exception.NewGenericError(err, exception.FirewallDeleteError)
+		}
 	}
 
 	// 回收gateway IP
@@ -136,18 +225,24 @@ func (driver *BridgeNetworkDriver) Delete(name string) error {
 		return err
 	}
 	// 删除interface
-	iface, err := netlink.LinkByName(name)
+	iface, err := netlink.LinkByName(network.GetBridgeName())
 	if err != nil {
 		return exception.NewGenericError(err, exception.NetworkLinkNotFoundError)
 	}
 	if err := netlink.LinkDel(iface); err != nil {
 		return exception.NewGenericError(err, exception.NetworkLinkDeleteError)
 	}
-	return nil
+	return removeNetwork(driver.runtimeRoot, name)
 }
 
-func (driver *BridgeNetworkDriver) Connect(endpointId string, network *Network, portMappings []string, containerInitPid int) (*Endpoint, error) {
-	endpointIP, err := driver.allocator.Allocate(network.Subnet())
+func (driver *BridgeNetworkDriver) Connect(endpointId string, network *Network, portMappings []string, bandwidth *configs.Bandwidth, containerInitPid int) (*Endpoint, error) {
+	var endpointIP net.IP
+	var err error
+	if network.AllocatableRange != nil {
+		endpointIP, err = driver.allocator.AllocateInRange(network.Subnet(), network.AllocatableRange)
+	} else {
+		endpointIP, err = driver.allocator.Allocate(network.Subnet())
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -156,6 +251,8 @@ func (driver *BridgeNetworkDriver) Connect(endpointId string, network *Network,
 		Network:      network,
 		IpAddress:    endpointIP,
 		PortMappings: portMappings,
+		Firewall:     driver.firewall.Name(),
+		Bandwidth:    bandwidth,
 	}
 	logrus.Infof("connecting network, endpoint: %#v, veth ip: %s", endpoint, endpoint.IpAddress.String())
 	// 创建网络端点veth
@@ -167,15 +264,23 @@ func (driver *BridgeNetworkDriver) Connect(endpointId string, network *Network,
 		return nil, exception.NewGenericErrorWithContext(err, exception.VethInitError, "set veth ip and route")
 	}
 	// config port mapping
-	if err := setupPortMappings(endpoint); err != nil {
+	if err := driver.firewall.SetupPortMappings(endpoint); err != nil {
 		return nil, exception.NewGenericErrorWithContext(err, exception.PortMappingsConfigError, "set up port mappings")
 	}
+	// config bandwidth
+	if err := setupBandwidth(endpoint); err != nil {
+		return nil, exception.NewGenericErrorWithContext(err, exception.BandwidthSetError, "set up bandwidth")
+	}
 	return endpoint, nil
 }
 
 func (driver *BridgeNetworkDriver) Disconnect(endpoint *Endpoint) error {
-	// 删除端口映射,不能放在后面,不知道为啥,endpoint的ip地址会变
-	if err := deletePortMappings(endpoint); err != nil {
+	// 删除端口映射
+	if err := driver.recordedFirewall(endpoint.Firewall).DeletePortMappings(endpoint); err != nil {
+		logrus.Warnf(err.Error())
+	}
+	// 删除限速
+	if err := deleteBandwidth(endpoint); err != nil {
 		logrus.Warnf(err.Error())
 	}
 	// 回收IP地址
@@ -188,3 +293,19 @@ func (driver *BridgeNetworkDriver) Disconnect(endpoint *Endpoint) error {
 	// 删除宿主机上的网络端点(前面kill掉容器init process后,容器net namespace被销毁,容器内veth被销毁,宿主机与之peer的veth也随之被销毁)
 	return nil
 }
+
+/*
+端口映射、SNAT规则需要由创建它的防火墙删除
+endpoint和network中记录了创建时使用的防火墙，如果和当前不同(比如期间修改了--firewall)，则使用记录的防火墙
+*/
+func (driver *BridgeNetworkDriver) recordedFirewall(name string) Firewall {
+	if name == "" || name == driver.firewall.Name() {
+		return driver.firewall
+	}
+	firewall, err := NewFirewall(name)
+	if err != nil {
+		logrus.Warnf("create firewall %s failed, cause: %s, fallback to %s", name, err.Error(), driver.firewall.Name())
+		return driver.firewall
+	}
+	return firewall
+}
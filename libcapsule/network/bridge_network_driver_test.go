@@ -18,7 +18,7 @@ func TestBridgeNetworkDriver_Create_Load_Delete(t *testing.T) {
 	subnet := "192.168.10.0/24"
 	name := "test_bridge0"
 	defer driver.Delete(name)
-	createdNetwork, err := driver.Create(subnet, name)
+	createdNetwork, err := driver.Create(name, &CreateOptions{Subnet: subnet})
 	assert.Nil(t, err)
 	// 如果test失败也要把这个删掉
 	network, err := driver.Load(name)
@@ -93,3 +93,35 @@ func TestBridgeNetworkDriver_Connect(t *testing.T) {
 func TestBridgeNetworkDriver_Disconnect(t *testing.T) {
 
 }
+
+func TestParseCreateOptions(t *testing.T) {
+	network, err := parseCreateOptions("test", "bridge", &CreateOptions{
+		Subnet:  "172.30.0.0/16",
+		Gateway: "172.30.0.254",
+		IpRange: "172.30.5.0/24",
+		MTU:     1400,
+		Options: map[string]string{
+			BridgeNameOption:         "br-test",
+			EnableIPMasqueradeOption: "false",
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "172.30.0.254", network.IpRange.IP.String())
+	assert.Equal(t, "172.30.0.0/16", network.Subnet().String())
+	assert.Equal(t, "172.30.5.0/24", network.AllocatableRange.String())
+	assert.Equal(t, "br-test", network.GetBridgeName())
+	assert.Equal(t, 1400, network.MTU)
+	assert.False(t, network.EnableIPMasquerade)
+	assert.True(t, network.ICC)
+
+	network, err = parseCreateOptions("test", "bridge", &CreateOptions{Subnet: "172.30.0.0/16"})
+	assert.Nil(t, err)
+	assert.Equal(t, "172.30.0.0/16", network.Subnet().String())
+
+	_, err = parseCreateOptions("test", "bridge", &CreateOptions{Subnet: "172.30.0.0/16", Gateway: "10.0.0.1"})
+	assert.NotNil(t, err)
+	_, err = parseCreateOptions("test", "bridge", &CreateOptions{Subnet: "172.30.0.0/16", IpRange: "172.0.0.0/8"})
+	assert.NotNil(t, err)
+	_, err = parseCreateOptions("test", "bridge", &CreateOptions{Subnet: "172.30.0.0/16", Options: map[string]string{"unknown": "1"}})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,319 @@
+package network
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/songxinjianqwe/capsule/libcapsule/constant"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	dnsPort           = 53
+	dnsForwardTimeout = 5 * time.Second
+	hostResolvConf    = "/etc/resolv.conf"
+	dnsServerArg      = "dns"
+)
+
+/*
+每个网络一个DNS server，监听在bridge的网关IP上
+容器的resolv.conf指向该server，可以解析:
+1. 同一网络中的容器id和hostname
+2. 查询方容器通过--link指定的别名
+其他的查询转发给容器通过--dns指定的或宿主机的DNS server
+*/
+type DNSServer struct {
+	network *Network
+	conn    *net.UDPConn
+}
+
+/*
+阻塞运行，由 capsule network dns $networkName 调用
+*/
+func ServeDNS(networkName string) error {
+	network, err := LoadNetworkByName(networkName)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: network.GatewayIP(), Port: dnsPort})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := ioutil.WriteFile(dnsPidPath(networkName), []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+		return err
+	}
+	logrus.Infof("dns server of network %s listening on %s", networkName, conn.LocalAddr())
+	server := &DNSServer{network: network, conn: conn}
+	buf := make([]byte, 4096)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+		go server.handle(packet, addr)
+	}
+}
+
+func (server *DNSServer) handle(packet []byte, addr *net.UDPAddr) {
+	response := server.resolve(packet, addr.IP)
+	if response == nil {
+		return
+	}
+	if _, err := server.conn.WriteToUDP(response, addr); err != nil {
+		logrus.Warnf("write dns response to %s failed, cause: %s", addr, err.Error())
+	}
+}
+
+func (server *DNSServer) resolve(packet []byte, source net.IP) []byte {
+	question, err := parseDNSQuery(packet)
+	if err != nil {
+		logrus.Warnf("parse dns query from %s failed, cause: %s", source, err.Error())
+		if len(packet) < dnsHeaderLen {
+			return nil
+		}
+		return server.forward(packet, source)
+	}
+	if question.qclass == dnsClassINET {
+		ip, found, err := server.lookup(question.name, source)
+		if err != nil {
+			logrus.Warnf("lookup %s failed, cause: %s", question.name, err.Error())
+			return buildDNSResponse(packet, question, dnsRcodeServerFailure, nil)
+		}
+		if found {
+			// 只有IPv4地址，其他类型的查询返回空应答
+			if question.qtype == dnsTypeA {
+				return buildDNSResponse(packet, question, dnsRcodeSuccess, []net.IP{ip})
+			}
+			return buildDNSResponse(packet, question, dnsRcodeSuccess, nil)
+		}
+	}
+	return server.forward(packet, source)
+}
+
+/*
+查询方容器的link别名优先，其次是容器id和hostname
+*/
+func (server *DNSServer) lookup(name string, source net.IP) (net.IP, bool, error) {
+	endpoints, err := loadEndpoints(server.network.Name)
+	if err != nil {
+		return nil, false, err
+	}
+	byContainerId := make(map[string]*Endpoint)
+	var requester *Endpoint
+	for _, endpoint := range endpoints {
+		byContainerId[strings.ToLower(endpoint.ContainerId)] = endpoint
+		if endpoint.IpAddress.Equal(source) {
+			requester = endpoint
+		}
+	}
+	if requester != nil {
+		for _, link := range requester.Links {
+			splits := strings.SplitN(link, ":", 2)
+			if len(splits) != 2 || strings.ToLower(splits[1]) != name {
+				continue
+			}
+			if linked, exists := byContainerId[strings.ToLower(splits[0])]; exists {
+				return linked.IpAddress, true, nil
+			}
+		}
+	}
+	if endpoint, exists := byContainerId[name]; exists {
+		return endpoint.IpAddress, true, nil
+	}
+	for _, endpoint := range endpoints {
+		if endpoint.Hostname != "" && strings.ToLower(endpoint.Hostname) == name {
+			return endpoint.IpAddress, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+/*
+依次尝试查询方容器通过--dns指定的nameserver，没有指定则使用宿主机resolv.conf中的nameserver
+server运行在宿主机的network namespace中，所以127.0.0.53之类的地址也是可以访问的
+*/
+func (server *DNSServer) forward(packet []byte, source net.IP) []byte {
+	nameservers, err := server.upstreams(source)
+	if err != nil {
+		logrus.Warnf("read upstream nameservers failed, cause: %s", err.Error())
+	}
+	for _, nameserver := range nameservers {
+		if nameserver.Equal(server.network.GatewayIP()) {
+			continue
+		}
+		response, err := forwardDNSQuery(packet, nameserver)
+		if err != nil {
+			logrus.Warnf("forward dns query to %s failed, cause: %s", nameserver, err.Error())
+			continue
+		}
+		return response
+	}
+	return buildDNSResponse(packet, nil, dnsRcodeServerFailure, nil)
+}
+
+func (server *DNSServer) upstreams(source net.IP) ([]net.IP, error) {
+	endpoints, err := loadEndpoints(server.network.Name)
+	if err != nil {
+		return nil, err
+	}
+	for _, endpoint := range endpoints {
+		if !endpoint.IpAddress.Equal(source) || len(endpoint.DNS) == 0 {
+			continue
+		}
+		var nameservers []net.IP
+		for _, dns := range endpoint.DNS {
+			if ip := net.ParseIP(dns); ip != nil {
+				nameservers = append(nameservers, ip)
+			}
+		}
+		return nameservers, nil
+	}
+	return hostNameservers()
+}
+
+func forwardDNSQuery(packet []byte, nameserver net.IP) ([]byte, error) {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: nameserver, Port: dnsPort})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(dnsForwardTimeout)); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(packet); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func hostNameservers() ([]net.IP, error) {
+	file, err := os.Open(hostResolvConf)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var nameservers []net.IP
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		if ip := net.ParseIP(fields[1]); ip != nil {
+			nameservers = append(nameservers, ip)
+		}
+	}
+	return nameservers, scanner.Err()
+}
+
+// ************************************************************************************************
+// dns server process
+// ************************************************************************************************
+
+func dnsPidPath(networkName string) string {
+	return filepath.Join(networkRuntimeRoot, constant.NetworkDNSDir, networkName+".pid")
+}
+
+func dnsLogPath(networkName string) string {
+	return filepath.Join(networkRuntimeRoot, constant.NetworkDNSDir, networkName+".log")
+}
+
+/*
+pid文件存在，且进程的cmdline确实是该网络的DNS server，才认为在运行
+*/
+func runningDNSServerPid(networkName string) (int, bool) {
+	bytes, err := ioutil.ReadFile(dnsPidPath(networkName))
+	if err != nil {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(bytes)))
+	if err != nil {
+		return 0, false
+	}
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return 0, false
+	}
+	args := strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00")
+	if len(args) < 2 || args[len(args)-2] != dnsServerArg || args[len(args)-1] != networkName {
+		return 0, false
+	}
+	return pid, true
+}
+
+/*
+如果该网络的DNS server没有运行，则在后台启动一个
+DNS server需要脱离当前进程，否则它退出时发出的SIGCHLD会被当作容器init进程的失败信号
+所以这里先同步执行 capsule network dns --daemon，由它再启动真正的server后立即退出
+*/
+func EnsureDNSServer(networkName string) error {
+	if _, running := runningDNSServerPid(networkName); running {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Join(networkRuntimeRoot, constant.NetworkDNSDir), 0700); err != nil {
+		return err
+	}
+	logrus.Infof("starting dns server of network %s", networkName)
+	cmd := exec.Command(constant.ContainerInitCmd, dnsServerArgs(networkName, true)...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("start dns server failed, cause: %s, output: %s", err.Error(), string(output))
+	}
+	return nil
+}
+
+/*
+由 capsule network dns --daemon 调用，在新的session中启动DNS server
+*/
+func StartDNSServerDaemon(networkName string) error {
+	logFile, err := os.OpenFile(dnsLogPath(networkName), os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+	cmd := exec.Command(constant.ContainerInitCmd, dnsServerArgs(networkName, false)...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
+
+func StopDNSServer(networkName string) error {
+	pid, running := runningDNSServerPid(networkName)
+	if running {
+		logrus.Infof("stopping dns server of network %s, pid: %d", networkName, pid)
+		if err := syscall.Kill(pid, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+			return err
+		}
+	}
+	if err := os.Remove(dnsPidPath(networkName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func dnsServerArgs(networkName string, daemon bool) []string {
+	args := []string{"--root", networkRuntimeRoot, "--firewall", firewallBackend, "network", dnsServerArg}
+	if daemon {
+		args = append(args, "--daemon")
+	}
+	return append(args, networkName)
+}
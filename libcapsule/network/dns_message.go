@@ -0,0 +1,103 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// DNS报文格式见RFC1035，这里只实现了解析单个question和构造A记录应答
+const (
+	dnsHeaderLen = 12
+
+	dnsTypeA     = 1
+	dnsClassINET = 1
+
+	dnsFlagResponse           = 1 << 15
+	dnsFlagRecursionDesired   = 1 << 8
+	dnsFlagRecursionAvailable = 1 << 7
+	dnsOpcodeMask             = 0xF << 11
+
+	dnsRcodeSuccess       = 0
+	dnsRcodeServerFailure = 2
+
+	// 容器IP随时可能变化，不允许客户端缓存
+	dnsAnswerTTL = 0
+)
+
+type dnsQuestion struct {
+	// 小写，不带最后的.
+	name   string
+	qtype  uint16
+	qclass uint16
+	// question部分的原始字节，构造应答时原样带回
+	raw []byte
+}
+
+func parseDNSQuery(packet []byte) (*dnsQuestion, error) {
+	if len(packet) < dnsHeaderLen {
+		return nil, fmt.Errorf("dns packet too short")
+	}
+	if binary.BigEndian.Uint16(packet[2:4])&dnsFlagResponse != 0 {
+		return nil, fmt.Errorf("not a dns query")
+	}
+	if binary.BigEndian.Uint16(packet[4:6]) != 1 {
+		return nil, fmt.Errorf("only one question is supported")
+	}
+	var labels []string
+	offset := dnsHeaderLen
+	for {
+		if offset >= len(packet) {
+			return nil, fmt.Errorf("invalid dns question")
+		}
+		length := int(packet[offset])
+		offset++
+		if length == 0 {
+			break
+		}
+		// question中不应该出现压缩指针
+		if length&0xC0 != 0 || offset+length > len(packet) {
+			return nil, fmt.Errorf("invalid dns label")
+		}
+		labels = append(labels, string(packet[offset:offset+length]))
+		offset += length
+	}
+	if offset+4 > len(packet) {
+		return nil, fmt.Errorf("invalid dns question")
+	}
+	return &dnsQuestion{
+		name:   strings.ToLower(strings.Join(labels, ".")),
+		qtype:  binary.BigEndian.Uint16(packet[offset : offset+2]),
+		qclass: binary.BigEndian.Uint16(packet[offset+2 : offset+4]),
+		raw:    packet[dnsHeaderLen : offset+4],
+	}, nil
+}
+
+/*
+构造应答报文，ips为空时只返回header和question
+*/
+func buildDNSResponse(query []byte, question *dnsQuestion, rcode uint16, ips []net.IP) []byte {
+	flags := binary.BigEndian.Uint16(query[2:4])
+	flags = dnsFlagResponse | flags&(dnsOpcodeMask|dnsFlagRecursionDesired) | dnsFlagRecursionAvailable | rcode
+	response := make([]byte, dnsHeaderLen)
+	copy(response[0:2], query[0:2])
+	binary.BigEndian.PutUint16(response[2:4], flags)
+	if question != nil {
+		binary.BigEndian.PutUint16(response[4:6], 1)
+		binary.BigEndian.PutUint16(response[6:8], uint16(len(ips)))
+		response = append(response, question.raw...)
+	}
+	for _, ip := range ips {
+		answer := make([]byte, 16)
+		// 指向header之后的question name
+		binary.BigEndian.PutUint16(answer[0:2], 0xC000|dnsHeaderLen)
+		binary.BigEndian.PutUint16(answer[2:4], dnsTypeA)
+		binary.BigEndian.PutUint16(answer[4:6], dnsClassINET)
+		binary.BigEndian.PutUint32(answer[6:10], dnsAnswerTTL)
+		binary.BigEndian.PutUint16(answer[10:12], net.IPv4len)
+		copy(answer[12:16], ip.To4())
+		response = append(response, answer...)
+	}
+	return response
+}
@@ -0,0 +1,95 @@
+package network
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+// www.Db.local, A, IN
+var dnsQuery = []byte{
+	0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x03, 'w', 'w', 'w', 0x02, 'D', 'b', 0x05, 'l', 'o', 'c', 'a', 'l', 0x00,
+	0x00, 0x01, 0x00, 0x01,
+}
+
+func TestParseDNSQuery(t *testing.T) {
+	question, err := parseDNSQuery(dnsQuery)
+	assert.Nil(t, err)
+	assert.Equal(t, "www.db.local", question.name)
+	assert.Equal(t, uint16(dnsTypeA), question.qtype)
+	assert.Equal(t, uint16(dnsClassINET), question.qclass)
+
+	_, err = parseDNSQuery(dnsQuery[:20])
+	assert.NotNil(t, err)
+}
+
+func TestBuildDNSResponse(t *testing.T) {
+	question, err := parseDNSQuery(dnsQuery)
+	assert.Nil(t, err)
+	response := buildDNSResponse(dnsQuery, question, dnsRcodeSuccess, []net.IP{net.ParseIP("192.168.1.10")})
+	// id
+	assert.Equal(t, []byte{0x12, 0x34}, response[0:2])
+	// QR + RD + RA
+	assert.Equal(t, []byte{0x81, 0x80}, response[2:4])
+	// 1 question, 1 answer
+	assert.Equal(t, []byte{0x00, 0x01, 0x00, 0x01}, response[4:8])
+	assert.Equal(t, dnsQuery[12:], response[12:len(dnsQuery)])
+	assert.Equal(t, []byte{192, 168, 1, 10}, response[len(response)-4:])
+}
+
+func TestDNSServer_Lookup(t *testing.T) {
+	root, err := ioutil.TempDir("", "capsule-dns")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+	originalRoot := networkRuntimeRoot
+	networkRuntimeRoot = root
+	defer func() { networkRuntimeRoot = originalRoot }()
+
+	network := &Network{Name: "test_bridge"}
+	web := &Endpoint{
+		Name:        "web-endpoint",
+		IpAddress:   net.ParseIP("192.168.1.2"),
+		Network:     network,
+		ContainerId: "web",
+		Links:       []string{"mysql:db"},
+	}
+	mysql := &Endpoint{
+		Name:        "mysql-endpoint",
+		IpAddress:   net.ParseIP("192.168.1.3"),
+		Network:     network,
+		ContainerId: "mysql",
+		Hostname:    "mysql-host",
+	}
+	assert.Nil(t, saveEndpoint(web))
+	assert.Nil(t, saveEndpoint(mysql))
+	server := &DNSServer{network: network}
+
+	ip, found, err := server.lookup("db", web.IpAddress)
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "192.168.1.3", ip.String())
+
+	// 别名只对link的容器可见
+	_, found, err = server.lookup("db", mysql.IpAddress)
+	assert.Nil(t, err)
+	assert.False(t, found)
+
+	ip, found, err = server.lookup("mysql-host", web.IpAddress)
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "192.168.1.3", ip.String())
+
+	ip, found, err = server.lookup("web", mysql.IpAddress)
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "192.168.1.2", ip.String())
+
+	// 容器删除后不再解析
+	assert.Nil(t, removeEndpoint(mysql))
+	_, found, err = server.lookup("db", web.IpAddress)
+	assert.Nil(t, err)
+	assert.False(t, found)
+}
@@ -0,0 +1,68 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/songxinjianqwe/capsule/libcapsule/constant"
+	"github.com/songxinjianqwe/capsule/libcapsule/util/filelock"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 由InitNetworkDrivers设置
+var networkRuntimeRoot string
+
+/*
+将endpoint持久化到 $RuntimeRoot/network/endpoints/$networkName/$endpointName.json
+DNS server每次查询时都会重新读取，所以容器重启后IP变化也能解析到最新的IP
+*/
+func saveEndpoint(endpoint *Endpoint) error {
+	dir := filepath.Join(networkRuntimeRoot, constant.NetworkEndpointsDir, endpoint.Network.Name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	bytes, err := json.Marshal(endpoint)
+	if err != nil {
+		return err
+	}
+	// DNS server随时会读取，写临时文件再rename，避免读到写了一半的内容
+	return filelock.WriteFileAtomic(filepath.Join(dir, endpoint.Name+".json"), bytes, 0644)
+}
+
+func removeEndpoint(endpoint *Endpoint) error {
+	path := filepath.Join(networkRuntimeRoot, constant.NetworkEndpointsDir, endpoint.Network.Name, endpoint.Name+".json")
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func loadEndpoints(networkName string) ([]*Endpoint, error) {
+	dir := filepath.Join(networkRuntimeRoot, constant.NetworkEndpointsDir, networkName)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var endpoints []*Endpoint
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		bytes, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			// 可能刚好被删除
+			continue
+		}
+		endpoint := &Endpoint{}
+		if err := json.Unmarshal(bytes, endpoint); err != nil {
+			return nil, fmt.Errorf("load endpoint %s failed, cause: %s", file.Name(), err.Error())
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, nil
+}
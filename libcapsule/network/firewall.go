@@ -0,0 +1,81 @@
+package network
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+const (
+	FirewallAuto     = "auto"
+	FirewallIPTables = "iptables"
+	FirewallNFTables = "nftables"
+)
+
+/*
+宿主机上的防火墙规则，包括bridge的SNAT(MASQUERADE)和容器的端口映射(DNAT)
+目前有iptables和nftables两种实现
+*/
+type Firewall interface {
+	Name() string
+	SetupMasquerade(bridgeName string, subnet net.IPNet) error
+	DeleteMasquerade(bridgeName string, subnet net.IPNet) error
+	SetupPortMappings(endpoint *Endpoint) error
+	DeletePortMappings(endpoint *Endpoint) error
+	// 删除不属于liveEndpoints的、目的IP在subnets中的端口映射，返回被删除的映射
+	PrunePortMappings(liveEndpoints []*Endpoint, subnets []*net.IPNet) ([]string, error)
+}
+
+// 由全局参数--firewall指定，默认根据宿主机自动检测
+var firewallBackend = FirewallAuto
+
+func SetFirewallBackend(backend string) error {
+	switch backend {
+	case "":
+		firewallBackend = FirewallAuto
+	case FirewallAuto, FirewallIPTables, FirewallNFTables:
+		firewallBackend = backend
+	default:
+		return fmt.Errorf("unknown firewall backend: %s", backend)
+	}
+	return nil
+}
+
+func NewFirewall(backend string) (Firewall, error) {
+	if backend == "" || backend == FirewallAuto {
+		backend = detectFirewallBackend()
+	}
+	switch backend {
+	case FirewallIPTables:
+		return &IPTablesFirewall{}, nil
+	case FirewallNFTables:
+		return &NFTablesFirewall{}, nil
+	default:
+		return nil, fmt.Errorf("unknown firewall backend: %s", backend)
+	}
+}
+
+/*
+1. 宿主机没有iptables命令，说明已经完全迁移到了nftables
+2. iptables是iptables-nft(iptables -V 输出中带有nf_tables)，规则最终也是写到nftables中的，直接使用nftables
+3. 否则使用iptables(legacy)
+*/
+func detectFirewallBackend() string {
+	path, err := exec.LookPath("iptables")
+	if err != nil {
+		logrus.Infof("iptables not found, using nftables firewall")
+		return FirewallNFTables
+	}
+	output, err := exec.Command(path, "-V").CombinedOutput()
+	if err != nil {
+		logrus.Warnf("detect iptables version failed, cause: %s", err.Error())
+		return FirewallIPTables
+	}
+	if strings.Contains(string(output), "nf_tables") {
+		logrus.Infof("iptables is backed by nf_tables, using nftables firewall")
+		return FirewallNFTables
+	}
+	return FirewallIPTables
+}
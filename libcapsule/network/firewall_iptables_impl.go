@@ -0,0 +1,185 @@
+package network
+
+import (
+	"fmt"
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/sirupsen/logrus"
+	"net"
+	"strings"
+)
+
+type IPTablesFirewall struct {
+}
+
+func (firewall *IPTablesFirewall) Name() string {
+	return FirewallIPTables
+}
+
+// SNAT MASQUERADE
+func (firewall *IPTablesFirewall) SetupMasquerade(name string, subnet net.IPNet) error {
+	logrus.Infof("setting up iptables masquerade for %s", name)
+	tables, err := iptables.New()
+	if err != nil {
+		return err
+	}
+	// iptables -t nat -A POSTROUTING -s %s -o %s -j MASQUERADE
+	if err := tables.Append(
+		"nat",
+		"POSTROUTING", getSNATRuleSpecs(name, subnet)...); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (firewall *IPTablesFirewall) DeleteMasquerade(name string, subnet net.IPNet) error {
+	logrus.Infof("deleting iptables masquerade for %s", name)
+	tables, err := iptables.New()
+	if err != nil {
+		return err
+	}
+	return tables.Delete(
+		"nat",
+		"POSTROUTING",
+		getSNATRuleSpecs(name, subnet)...,
+	)
+}
+
+// DNAT
+func (firewall *IPTablesFirewall) SetupPortMappings(endpoint *Endpoint) error {
+	tables, err := iptables.New()
+	if err != nil {
+		return err
+	}
+	for _, mapping := range endpoint.PortMappings {
+		split := strings.Split(mapping, ":")
+		hostPort := split[0]
+		containerPort := split[1]
+		logrus.Infof("setting up %s port mapping %s:%s", endpoint.Name, hostPort, containerPort)
+		if err := tables.Append(
+			"nat",
+			"PREROUTING",
+			getDNATRuleSpecs(endpoint.IpAddress.String(), hostPort, containerPort)...,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (firewall *IPTablesFirewall) DeletePortMappings(endpoint *Endpoint) error {
+	tables, err := iptables.New()
+	if err != nil {
+		return err
+	}
+	for _, mapping := range endpoint.PortMappings {
+		split := strings.Split(mapping, ":")
+		hostPort := split[0]
+		containerPort := split[1]
+		logrus.Infof("delete port mapping:%s", endpoint.IpAddress.String())
+		if err := tables.Delete(
+			"nat",
+			"PREROUTING",
+			getDNATRuleSpecs(endpoint.IpAddress.String(), hostPort, containerPort)...,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+iptables -t nat -S PREROUTING 输出的DNAT规则形如:
+-A PREROUTING -p tcp -m tcp --dport 8080 -j DNAT --to-destination 192.168.1.2:80
+*/
+func (firewall *IPTablesFirewall) PrunePortMappings(liveEndpoints []*Endpoint, subnets []*net.IPNet) ([]string, error) {
+	tables, err := iptables.New()
+	if err != nil {
+		return nil, err
+	}
+	rules, err := tables.List("nat", "PREROUTING")
+	if err != nil {
+		return nil, err
+	}
+	live := make(map[string]bool)
+	for _, endpoint := range liveEndpoints {
+		for _, mapping := range endpoint.PortMappings {
+			live[fmt.Sprintf("%s:%s", endpoint.IpAddress, mapping)] = true
+		}
+	}
+	var pruned []string
+	for _, rule := range rules {
+		hostPort, destination := parseDNATRule(rule)
+		if hostPort == "" || destination == "" {
+			continue
+		}
+		split := strings.Split(destination, ":")
+		if len(split) != 2 || !ipInSubnets(net.ParseIP(split[0]), subnets) {
+			continue
+		}
+		containerIP, containerPort := split[0], split[1]
+		if live[fmt.Sprintf("%s:%s:%s", containerIP, hostPort, containerPort)] {
+			continue
+		}
+		logrus.Infof("pruning orphan port mapping %s -> %s", hostPort, destination)
+		if err := tables.Delete("nat", "PREROUTING", getDNATRuleSpecs(containerIP, hostPort, containerPort)...); err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, fmt.Sprintf("%s -> %s", hostPort, destination))
+	}
+	return pruned, nil
+}
+
+func parseDNATRule(rule string) (string, string) {
+	fields := strings.Fields(rule)
+	var hostPort, destination string
+	isDNAT := false
+	for i := 0; i < len(fields)-1; i++ {
+		switch fields[i] {
+		case "--dport":
+			hostPort = fields[i+1]
+		case "--to-destination":
+			destination = fields[i+1]
+		case "-j":
+			isDNAT = fields[i+1] == "DNAT"
+		}
+	}
+	if !isDNAT {
+		return "", ""
+	}
+	return hostPort, destination
+}
+
+func ipInSubnets(ip net.IP, subnets []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, subnet := range subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func getSNATRuleSpecs(name string, subnet net.IPNet) []string {
+	_, ipNet, _ := net.ParseCIDR(subnet.String())
+	// !的意思是negative,out设备名是除了name之外的其他网络设备
+	// SNAT转换时将源IP转为某设备名,这里我们不清楚有哪些网卡,于是我们将其设置为除了我们bridge外的设备
+	// 因为bridge的IP也是私有IP,外网是不认识的
+	return []string{
+		fmt.Sprintf("-s%s", ipNet.String()),
+		"!",
+		fmt.Sprintf("-o%s", name),
+		"-jMASQUERADE",
+	}
+}
+
+func getDNATRuleSpecs(containerIP string, hostPort string, containerPort string) []string {
+	return []string{"-ptcp",
+		"-mtcp",
+		"-jDNAT",
+		"--dport",
+		hostPort,
+		"--to-destination",
+		fmt.Sprintf("%s:%s", containerIP, containerPort)}
+}
@@ -0,0 +1,195 @@
+package network
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"net"
+	"strings"
+)
+
+const (
+	nftTableName        = "capsule"
+	nftPreroutingChain  = "prerouting"
+	nftPostroutingChain = "postrouting-%s"
+	// host port -> container ip
+	nftPortMapAddrSet = "portmap_addr"
+	// host port -> container port
+	nftPortMapPortSet = "portmap_port"
+)
+
+/*
+基于netlink直接操作nftables，所有规则都放在ip capsule表中:
+
+	table ip capsule {
+		map portmap_addr { type inet_service : ipv4_addr }
+		map portmap_port { type inet_service : inet_service }
+		chain prerouting {
+			type nat hook prerouting priority -100;
+			meta l4proto tcp dnat to tcp dport map @portmap_addr : tcp dport map @portmap_port
+		}
+		chain postrouting-$bridge {
+			type nat hook postrouting priority 100;
+			ip saddr $subnet oifname != $bridge masquerade
+		}
+	}
+
+端口映射只需要增删map中的元素，不需要增删规则
+*/
+type NFTablesFirewall struct {
+}
+
+func (firewall *NFTablesFirewall) Name() string {
+	return FirewallNFTables
+}
+
+func (firewall *NFTablesFirewall) SetupMasquerade(name string, subnet net.IPNet) error {
+	logrus.Infof("setting up nftables masquerade for %s", name)
+	_, ipNet, err := net.ParseCIDR(subnet.String())
+	if err != nil {
+		return err
+	}
+	chain := fmt.Sprintf(nftPostroutingChain, name)
+	batch := newNFTBatch()
+	batch.add(nftMsgNewTable, unix.NLM_F_CREATE, nftTableAttrs(nftTableName)...)
+	batch.add(nftMsgNewChain, unix.NLM_F_CREATE, nftBaseChainAttrs(nftTableName, chain, "nat", nfInetPostRouting, 100)...)
+	// 先清空chain，保证重复调用时不会出现重复的规则
+	batch.add(nftMsgDelRule, 0, nftFlushChainAttrs(nftTableName, chain)...)
+	batch.add(nftMsgNewRule, unix.NLM_F_CREATE|unix.NLM_F_APPEND, nftRuleAttrs(nftTableName, chain,
+		// ip saddr $subnet
+		nftPayloadExpr(nftPayloadNetworkHeader, 12, 4, nftReg1),
+		nftBitwiseExpr(nftReg1, nftReg1, ipNet.Mask, make([]byte, 4)),
+		nftCmpExpr(nftCmpEq, nftReg1, ipNet.IP.To4()),
+		// oifname != $bridge
+		nftMetaExpr(nftMetaOifName, nftReg1),
+		nftCmpExpr(nftCmpNeq, nftReg1, nftIfName(name)),
+		nftMasqExpr(),
+	)...)
+	return batch.commit()
+}
+
+func (firewall *NFTablesFirewall) DeleteMasquerade(name string, subnet net.IPNet) error {
+	logrus.Infof("deleting nftables masquerade for %s", name)
+	chain := fmt.Sprintf(nftPostroutingChain, name)
+	batch := newNFTBatch()
+	batch.add(nftMsgDelRule, 0, nftFlushChainAttrs(nftTableName, chain)...)
+	batch.add(nftMsgDelChain, 0, nftChainAttrs(nftTableName, chain)...)
+	if err := batch.commit(); err != nil {
+		if err == unix.ENOENT {
+			logrus.Warnf("nftables chain %s not found, skip", chain)
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (firewall *NFTablesFirewall) SetupPortMappings(endpoint *Endpoint) error {
+	if len(endpoint.PortMappings) == 0 {
+		return nil
+	}
+	if err := firewall.ensurePortMapChain(); err != nil {
+		return err
+	}
+	batch := newNFTBatch()
+	for _, mapping := range endpoint.PortMappings {
+		hostPort, containerPort, err := parseNFTPortMapping(mapping)
+		if err != nil {
+			return err
+		}
+		logrus.Infof("setting up %s port mapping %s", endpoint.Name, mapping)
+		// 宿主机端口已经被映射，则报错
+		batch.add(nftMsgNewSetElem, unix.NLM_F_CREATE|unix.NLM_F_EXCL, nftMapElemAttrs(nftTableName, nftPortMapAddrSet, hostPort, endpoint.IpAddress.To4())...)
+		batch.add(nftMsgNewSetElem, unix.NLM_F_CREATE|unix.NLM_F_EXCL, nftMapElemAttrs(nftTableName, nftPortMapPortSet, hostPort, containerPort)...)
+	}
+	return batch.commit()
+}
+
+func (firewall *NFTablesFirewall) DeletePortMappings(endpoint *Endpoint) error {
+	if len(endpoint.PortMappings) == 0 {
+		return nil
+	}
+	batch := newNFTBatch()
+	for _, mapping := range endpoint.PortMappings {
+		hostPort, _, err := parseNFTPortMapping(mapping)
+		if err != nil {
+			return err
+		}
+		logrus.Infof("delete port mapping:%s", mapping)
+		batch.add(nftMsgDelSetElem, 0, nftMapElemAttrs(nftTableName, nftPortMapAddrSet, hostPort, nil)...)
+		batch.add(nftMsgDelSetElem, 0, nftMapElemAttrs(nftTableName, nftPortMapPortSet, hostPort, nil)...)
+	}
+	return batch.commit()
+}
+
+/*
+端口映射都在map中，无法区分哪些元素是遗留的，直接在一个batch中清空map再重新添加liveEndpoints的映射
+subnets在这里用不到，所有的端口映射都在capsule表中
+*/
+func (firewall *NFTablesFirewall) PrunePortMappings(liveEndpoints []*Endpoint, subnets []*net.IPNet) ([]string, error) {
+	batch := newNFTBatch()
+	batch.add(nftMsgDelSetElem, 0, nftFlushSetAttrs(nftTableName, nftPortMapAddrSet)...)
+	batch.add(nftMsgDelSetElem, 0, nftFlushSetAttrs(nftTableName, nftPortMapPortSet)...)
+	for _, endpoint := range liveEndpoints {
+		if endpoint.Firewall != firewall.Name() {
+			continue
+		}
+		for _, mapping := range endpoint.PortMappings {
+			hostPort, containerPort, err := parseNFTPortMapping(mapping)
+			if err != nil {
+				return nil, err
+			}
+			batch.add(nftMsgNewSetElem, unix.NLM_F_CREATE, nftMapElemAttrs(nftTableName, nftPortMapAddrSet, hostPort, endpoint.IpAddress.To4())...)
+			batch.add(nftMsgNewSetElem, unix.NLM_F_CREATE, nftMapElemAttrs(nftTableName, nftPortMapPortSet, hostPort, containerPort)...)
+		}
+	}
+	if err := batch.commit(); err != nil {
+		// 还没有创建过端口映射
+		if err == unix.ENOENT {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return nil, nil
+}
+
+/*
+创建capsule表、端口映射的map以及prerouting chain
+整个batch是原子的，重复调用是安全的
+*/
+func (firewall *NFTablesFirewall) ensurePortMapChain() error {
+	batch := newNFTBatch()
+	batch.add(nftMsgNewTable, unix.NLM_F_CREATE, nftTableAttrs(nftTableName)...)
+	batch.add(nftMsgNewSet, unix.NLM_F_CREATE, nftMapAttrs(nftTableName, nftPortMapAddrSet, 1, nftTypeInetService, 2, nftTypeIPAddr, 4)...)
+	batch.add(nftMsgNewSet, unix.NLM_F_CREATE, nftMapAttrs(nftTableName, nftPortMapPortSet, 2, nftTypeInetService, 2, nftTypeInetService, 2)...)
+	batch.add(nftMsgNewChain, unix.NLM_F_CREATE, nftBaseChainAttrs(nftTableName, nftPreroutingChain, "nat", nfInetPreRouting, -100)...)
+	batch.add(nftMsgDelRule, 0, nftFlushChainAttrs(nftTableName, nftPreroutingChain)...)
+	batch.add(nftMsgNewRule, unix.NLM_F_CREATE|unix.NLM_F_APPEND, nftRuleAttrs(nftTableName, nftPreroutingChain,
+		// meta l4proto tcp
+		nftMetaExpr(nftMetaL4Proto, nftReg1),
+		nftCmpExpr(nftCmpEq, nftReg1, []byte{unix.IPPROTO_TCP}),
+		// reg1 = tcp dport
+		nftPayloadExpr(nftPayloadTransportHeader, 2, 2, nftReg1),
+		// reg2 = portmap_port[reg1], reg1 = portmap_addr[reg1]
+		nftLookupExpr(nftPortMapPortSet, nftReg1, nftReg2),
+		nftLookupExpr(nftPortMapAddrSet, nftReg1, nftReg1),
+		nftDNATExpr(nftReg1, nftReg2),
+	)...)
+	return batch.commit()
+}
+
+func parseNFTPortMapping(mapping string) ([]byte, []byte, error) {
+	split := strings.Split(mapping, ":")
+	if len(split) != 2 {
+		return nil, nil, fmt.Errorf("invalid port mapping %q", mapping)
+	}
+	hostPort, err := nftPort(split[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	containerPort, err := nftPort(split[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	return hostPort, containerPort, nil
+}
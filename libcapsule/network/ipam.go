@@ -2,16 +2,24 @@ package network
 
 import (
 	"github.com/songxinjianqwe/capsule/libcapsule/constant"
+	"github.com/songxinjianqwe/capsule/libcapsule/util/exception"
 	"github.com/willf/bitset"
 	"net"
+	"os"
 	"path/filepath"
 )
 
 // ipam is short for ip address management
 type IPAM interface {
 	Allocate(subnet *net.IPNet) (net.IP, error)
+	// 只在subnet的ipRange这一段中分配
+	AllocateInRange(subnet *net.IPNet, ipRange *net.IPNet) (net.IP, error)
+	// 分配指定的IP，比如用户指定的网关IP
+	AllocateIP(subnet *net.IPNet, ip net.IP) error
 	Release(subnet *net.IPNet, ip net.IP) error
 	Allocatable(subnet *net.IPNet) uint
+	// 已分配的IP，包括网关IP
+	Allocated(subnet *net.IPNet) []net.IP
 }
 
 func NewPersistentIPAllocator(runtimeRoot string) (IPAM, error) {
@@ -19,7 +27,11 @@ func NewPersistentIPAllocator(runtimeRoot string) (IPAM, error) {
 		subnetAllocatorPath: filepath.Join(runtimeRoot, constant.IPAMDefaultAllocatorPath),
 		mode:                IPAMPersistentMode,
 	}
-	if err := ipam.load(); err != nil {
+	if err := os.MkdirAll(filepath.Dir(ipam.subnetAllocatorPath), 0700); err != nil {
+		return nil, exception.NewGenericError(err, exception.IPAMLoadError)
+	}
+	// 提前加载一次，尽早暴露subnet.json损坏之类的问题
+	if err := ipam.withLock(false, func() error { return nil }); err != nil {
 		return nil, err
 	}
 	return ipam, nil
@@ -1,15 +1,16 @@
 package network
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"github.com/songxinjianqwe/capsule/libcapsule/util/exception"
+	"github.com/songxinjianqwe/capsule/libcapsule/util/filelock"
 	"github.com/willf/bitset"
 	"io/ioutil"
 	"net"
 	"os"
-	"path"
 	"sync"
 )
 
@@ -33,6 +34,8 @@ func (m IPAMMode) String() string {
 
 // BitSet的文档:
 // https://godoc.org/github.com/willf/bitset#BitSet
+// persistent模式下，每次操作都会在文件锁的保护下重新加载subnet.json，
+// 因为并发执行的多个capsule进程会各自修改这个文件，内存中的subnetMap随时可能过期
 type LocalIPAM struct {
 	mode                IPAMMode
 	subnetAllocatorPath string
@@ -41,87 +44,128 @@ type LocalIPAM struct {
 }
 
 func (ipam *LocalIPAM) Allocatable(subnet *net.IPNet) uint {
-	ipam.mutex.Lock()
-	defer ipam.mutex.Unlock()
 	total := allocatableIPAmount(subnet)
-	if _, exist := ipam.subnetMap[subnet.String()]; !exist {
-		logrus.Infof("subnet %s not found, return full", subnet)
-		return total
+	var allocated uint
+	if err := ipam.withLock(false, func() error {
+		if bitmap, exist := ipam.subnetMap[subnet.String()]; exist {
+			allocated = bitmap.Count()
+		} else {
+			logrus.Infof("subnet %s not found, return full", subnet)
+		}
+		return nil
+	}); err != nil {
+		logrus.Warnf("load ipam failed, cause: %s", err.Error())
 	}
-	bitmap := ipam.subnetMap[subnet.String()]
-	return total - bitmap.Count()
+	return total - allocated
 }
 
 func (ipam *LocalIPAM) Allocate(subnet *net.IPNet) (net.IP, error) {
-	ipam.mutex.Lock()
-	defer ipam.mutex.Unlock()
-	logrus.Infof("allocating ip in subnet:%s", subnet)
-	if _, exist := ipam.subnetMap[subnet.String()]; !exist {
-		amount := allocatableIPAmount(subnet)
-		logrus.Infof("subnet %s do not exist, allocatable ip amount is %d", subnet, amount)
-		ipam.subnetMap[subnet.String()] = bitset.New(amount)
-	}
-	bitmap := ipam.subnetMap[subnet.String()]
-	logrus.Infof("bitmap: %s", bitmap)
-	nextClearIndex, allocatable := bitmap.NextClear(0)
-	if !allocatable {
-		// 说明全部为1,则
-		return nil, exception.NewGenericError(fmt.Errorf("no allocatable ip"), exception.IPRunOutError)
-	}
-	logrus.Infof("nextClearIndex: %d", nextClearIndex)
-	logrus.Infof("count:%d", bitmap.Count())
-	// gotcha!
-	bitmap.Set(nextClearIndex)
-	logrus.Infof("count:%d", bitmap.Count())
-	// 网段IP,注意这里一定要拷贝!!!
-	ip := make([]byte, 4)
-	copy(ip, subnet.IP.To4())
-	// 假设subnet为192.168.1.0/24, index为184,那么IP地址为192.168.1.1+184=192.168.1.185
-	// 184 = 0000 0000 0000 0000 0000 0000 1011 1000
-	// loop0: ip[0] += uint8(0000 0000 0000 0000 0000 0000 1011 1000 >> 24)(即0000)
-	// loop1: ip[1] += uint8(0000 0000 0000 0000 0000 0000 1011 1000 >> 16)(即0000)
-	// loop2: ip[2] += uint8(0000 0000 0000 0000 0000 0000 1011 1000 >>  8)(即0000)
-	// loop3: ip[3] += uint8(0000 0000 0000 0000 0000 0000 1011 1000 >>  0)(即1011 1000,184)
-	for byteIndex := 4; byteIndex > 0; byteIndex-- {
-		ip[4-byteIndex] += uint8(nextClearIndex >> uint8((byteIndex-1)*8))
-	}
-	// ip 从1开始
-	ip[3]++
-	logrus.Infof("allocated ip: %s", net.IP(ip).String())
-	if err := ipam.dump(); err != nil {
+	return ipam.AllocateInRange(subnet, subnet)
+}
+
+func (ipam *LocalIPAM) AllocateInRange(subnet *net.IPNet, ipRange *net.IPNet) (ip net.IP, err error) {
+	err = ipam.withLock(true, func() error {
+		logrus.Infof("allocating ip in subnet:%s, range: %s", subnet, ipRange)
+		bitmap := ipam.subnetBitmap(subnet)
+		logrus.Infof("bitmap: %s", bitmap)
+		// ipRange的第一个IP如果就是网段IP，则从index 0开始
+		var start uint
+		if !ipRange.IP.Equal(subnet.IP) {
+			start = ipToIndex(subnet, ipRange.IP)
+		}
+		end := start + allocatableIPAmount(ipRange)
+		nextClearIndex, allocatable := bitmap.NextClear(start)
+		if !allocatable || nextClearIndex >= end {
+			// 说明全部为1,则
+			return exception.NewGenericError(fmt.Errorf("no allocatable ip"), exception.IPRunOutError)
+		}
+		logrus.Infof("nextClearIndex: %d", nextClearIndex)
+		logrus.Infof("count:%d", bitmap.Count())
+		// gotcha!
+		bitmap.Set(nextClearIndex)
+		logrus.Infof("count:%d", bitmap.Count())
+		ip = indexToIP(subnet, nextClearIndex)
+		logrus.Infof("allocated ip: %s", ip.String())
+		return ipam.dump()
+	})
+	if err != nil {
 		return nil, err
 	}
 	return ip, nil
 }
 
+func (ipam *LocalIPAM) AllocateIP(subnet *net.IPNet, ip net.IP) error {
+	return ipam.withLock(true, func() error {
+		if !subnet.Contains(ip) || ip.Equal(subnet.IP) {
+			return exception.NewGenericError(fmt.Errorf("ip %s is not allocatable in subnet %s", ip, subnet), exception.IPAllocateError)
+		}
+		logrus.Infof("allocating ip %s in subnet:%s", ip, subnet)
+		bitmap := ipam.subnetBitmap(subnet)
+		index := ipToIndex(subnet, ip)
+		if bitmap.Test(index) {
+			return exception.NewGenericError(fmt.Errorf("ip %s already allocated", ip), exception.IPAllocateError)
+		}
+		bitmap.Set(index)
+		return ipam.dump()
+	})
+}
+
+func (ipam *LocalIPAM) Allocated(subnet *net.IPNet) []net.IP {
+	var ips []net.IP
+	if err := ipam.withLock(false, func() error {
+		bitmap, exist := ipam.subnetMap[subnet.String()]
+		if !exist {
+			return nil
+		}
+		for index, found := bitmap.NextSet(0); found; index, found = bitmap.NextSet(index + 1) {
+			ips = append(ips, indexToIP(subnet, index))
+		}
+		return nil
+	}); err != nil {
+		logrus.Warnf("load ipam failed, cause: %s", err.Error())
+	}
+	return ips
+}
+
 func (ipam *LocalIPAM) Release(subnet *net.IPNet, ip net.IP) error {
+	return ipam.withLock(true, func() error {
+		if _, exist := ipam.subnetMap[subnet.String()]; !exist {
+			return exception.NewGenericError(fmt.Errorf("subnet %s not exists", subnet), exception.IPReleaseError)
+		}
+		logrus.Infof("releasing ip %s in subnet:%s", ip, subnet)
+		index := ipToIndex(subnet, ip)
+		bitmap := ipam.subnetMap[subnet.String()]
+		logrus.Infof("count:%d", bitmap.Count())
+		logrus.Infof("index:%d", index)
+		bitmap.Clear(index)
+		logrus.Infof("count:%d", bitmap.Count())
+		return ipam.dump()
+	})
+}
+
+/*
+exclusive为true时加排他锁(会修改subnetMap)，否则加共享锁
+persistent模式下，拿到锁之后先重新load，保证看到的是其他进程最新写入的内容
+*/
+func (ipam *LocalIPAM) withLock(exclusive bool, action func() error) error {
 	ipam.mutex.Lock()
 	defer ipam.mutex.Unlock()
-	if _, exist := ipam.subnetMap[subnet.String()]; !exist {
-		return exception.NewGenericError(fmt.Errorf("subnet %s not exists", subnet), exception.IPReleaseError)
-	}
-	logrus.Infof("releasing ip %s in subnet:%s", ip, subnet)
-	releasingIP := ip.To4()
-	releasingIP[3]--
-	var index uint
-	// 假设subnet为192.168.1.0/24, IP地址为192.168.1.185
-	// releasingIP 此时为[192, 168, 1, 184]
-	// loop0: index += (184 - 0) << 0 -> index = 184
-	// loop1: index += (1 - 1) << 8 -> index = 184
-	// loop2: index += (168 - 168) << 16 -> index = 184
-	// loop3: index += (192 - 192) << 24 -> index = 184
-	for byteIndex := 4; byteIndex > 0; byteIndex-- {
-		index += uint(releasingIP[byteIndex-1]-subnet.IP[byteIndex-1]) << uint((4-byteIndex)*8)
-	}
-	bitmap := ipam.subnetMap[subnet.String()]
-	logrus.Infof("count:%d", bitmap.Count())
-	logrus.Infof("index:%d", index)
-	bitmap.Clear(index)
-	logrus.Infof("count:%d", bitmap.Count())
-	if err := ipam.dump(); err != nil {
+	if ipam.mode == IPAMMemoryMode {
+		return action()
+	}
+	lock := filelock.RLock
+	if exclusive {
+		lock = filelock.Lock
+	}
+	fileLock, err := lock(ipam.subnetAllocatorPath)
+	if err != nil {
+		return exception.NewGenericError(err, exception.IPAMLoadError)
+	}
+	defer fileLock.Unlock()
+	if err := ipam.load(); err != nil {
 		return err
 	}
-	return nil
+	return action()
 }
 
 func (ipam *LocalIPAM) load() error {
@@ -139,9 +183,12 @@ func (ipam *LocalIPAM) load() error {
 	if err != nil {
 		return exception.NewGenericError(err, exception.IPAMLoadError)
 	}
-	if err := json.Unmarshal(bytes, &ipam.subnetMap); err != nil {
+	// 不能直接Unmarshal到原来的Map中，否则其他进程已经删除的subnet会残留下来
+	subnetMap := make(map[string]*bitset.BitSet)
+	if err := json.Unmarshal(bytes, &subnetMap); err != nil {
 		return exception.NewGenericError(err, exception.IPAMLoadError)
 	}
+	ipam.subnetMap = subnetMap
 	logrus.Infof("loaded subnetMap")
 	for subnet, bitmap := range ipam.subnetMap {
 		logrus.Infof("[%s]allocated ip count: %d, bytes:%s", subnet, bitmap.Count(), bitmap.String())
@@ -149,33 +196,55 @@ func (ipam *LocalIPAM) load() error {
 	return nil
 }
 
+/*
+调用方需要持有排他锁
+*/
 func (ipam *LocalIPAM) dump() error {
 	if ipam.mode == IPAMMemoryMode {
 		return nil
 	}
-	if _, err := os.Stat(ipam.subnetAllocatorPath); err != nil && os.IsNotExist(err) {
-		// 如果文件之前不存在，则先创建目录，再创建文件
-		// 否则覆盖原来的文件
-		dir := path.Dir(ipam.subnetAllocatorPath)
-		if err := os.MkdirAll(dir, 0644); err != nil {
-			return exception.NewGenericError(err, exception.IPAMDumpError)
-		}
-	}
-	subnetFile, err := os.OpenFile(ipam.subnetAllocatorPath, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0644)
-	if err != nil {
-		return exception.NewGenericError(err, exception.IPAMDumpError)
-	}
-	defer subnetFile.Close()
 	bytes, err := json.Marshal(ipam.subnetMap)
 	if err != nil {
 		return exception.NewGenericError(err, exception.IPAMDumpError)
 	}
-	if _, err := subnetFile.Write(bytes); err != nil {
+	if err := filelock.WriteFileAtomic(ipam.subnetAllocatorPath, bytes, 0644); err != nil {
 		return exception.NewGenericError(err, exception.IPAMDumpError)
 	}
 	return nil
 }
 
+/*
+subnet不存在时创建
+*/
+func (ipam *LocalIPAM) subnetBitmap(subnet *net.IPNet) *bitset.BitSet {
+	if _, exist := ipam.subnetMap[subnet.String()]; !exist {
+		amount := allocatableIPAmount(subnet)
+		logrus.Infof("subnet %s do not exist, allocatable ip amount is %d", subnet, amount)
+		ipam.subnetMap[subnet.String()] = bitset.New(amount)
+	}
+	return ipam.subnetMap[subnet.String()]
+}
+
+/*
+indexToIP的逆运算，IP从1开始，所以要减一
+假设subnet为192.168.1.0/24, IP地址为192.168.1.185，那么index为185-0-1=184
+按uint32整体相减，跨字节时(比如192.168.2.0)会正确借位
+*/
+func ipToIndex(subnet *net.IPNet, ip net.IP) uint {
+	return uint(binary.BigEndian.Uint32(ip.To4()) - binary.BigEndian.Uint32(subnet.IP.To4()) - 1)
+}
+
+/*
+假设subnet为192.168.1.0/24, index为184,那么IP地址为192.168.1.0+184+1=192.168.1.185
+与ipToIndex一样按uint32整体相加，跨字节时(比如192.168.1.255之后是192.168.2.0)会正确进位
+*/
+func indexToIP(subnet *net.IPNet, index uint) net.IP {
+	// 返回新的IP，不能修改subnet.IP
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(subnet.IP.To4())+uint32(index)+1)
+	return ip
+}
+
 func allocatableIPAmount(subnet *net.IPNet) uint {
 	// IP地址是32位，有子网情况下是 网段:子网，前面n位是网段地址，后面32-n是子网地址
 	// subnet如果是192.168.1.0/24，那么子网掩码为255.255.255.0
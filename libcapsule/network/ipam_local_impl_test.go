@@ -1,8 +1,14 @@
 package network
 
 import (
+	"bytes"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
 	"net"
+	"os"
+	"os/exec"
+	"strings"
 	"testing"
 )
 
@@ -22,3 +28,143 @@ func TestLocalIPAM_Allocate_Release(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, originalAllocatable, allocator.Allocatable(subnet))
 }
+
+func TestLocalIPAM_Allocated(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.2.0/24")
+	first, err := allocator.Allocate(subnet)
+	assert.Nil(t, err)
+	second, err := allocator.Allocate(subnet)
+	assert.Nil(t, err)
+	assert.Equal(t, []net.IP{first, second}, allocator.Allocated(subnet))
+
+	// Release不能修改传入的IP
+	assert.Nil(t, allocator.Release(subnet, first))
+	assert.Equal(t, "192.168.2.1", first.String())
+	assert.Equal(t, []net.IP{second}, allocator.Allocated(subnet))
+	assert.Nil(t, allocator.Release(subnet, second))
+}
+
+const (
+	ipamStressRootEnv     = "CAPSULE_IPAM_STRESS_ROOT"
+	ipamStressSubnet      = "10.10.0.0/24"
+	ipamStressWorkers     = 8
+	ipamStressAllocations = 16
+)
+
+/*
+每个worker都是独立的进程，各自持有一个persistent模式的IPAM，模拟多个capsule run同时分配IP
+*/
+func TestLocalIPAM_ConcurrentProcesses(t *testing.T) {
+	root, err := ioutil.TempDir("", "capsule-ipam")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	outputs := make([]bytes.Buffer, ipamStressWorkers)
+	var cmds []*exec.Cmd
+	for i := 0; i < ipamStressWorkers; i++ {
+		cmd := exec.Command(os.Args[0], "-test.run=^$")
+		cmd.Env = append(os.Environ(), ipamStressRootEnv+"="+root)
+		cmd.Stdout = &outputs[i]
+		assert.Nil(t, cmd.Start())
+		cmds = append(cmds, cmd)
+	}
+	for _, cmd := range cmds {
+		assert.Nil(t, cmd.Wait())
+	}
+
+	allocated := make(map[string]bool)
+	for _, output := range outputs {
+		for _, ip := range strings.Fields(output.String()) {
+			assert.False(t, allocated[ip], "ip %s allocated twice", ip)
+			allocated[ip] = true
+		}
+	}
+	assert.Equal(t, ipamStressWorkers*ipamStressAllocations, len(allocated))
+
+	_, subnet, _ := net.ParseCIDR(ipamStressSubnet)
+	ipam, err := NewPersistentIPAllocator(root)
+	assert.Nil(t, err)
+	assert.Equal(t, ipamStressWorkers*ipamStressAllocations, len(ipam.Allocated(subnet)))
+}
+
+func runIPAMStressWorker(root string) int {
+	_, subnet, _ := net.ParseCIDR(ipamStressSubnet)
+	ipam, err := NewPersistentIPAllocator(root)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for i := 0; i < ipamStressAllocations; i++ {
+		ip, err := ipam.Allocate(subnet)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println(ip)
+	}
+	return 0
+}
+
+func TestLocalIPAM_AllocateInRange(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.20.0.0/16")
+	_, ipRange, _ := net.ParseCIDR("10.20.3.0/24")
+	// 分配完ipRange中的所有IP，都必须在ipRange中且不重复
+	allocated := make(map[string]bool)
+	var ips []net.IP
+	for i := 0; i < 256; i++ {
+		ip, err := allocator.AllocateInRange(subnet, ipRange)
+		assert.Nil(t, err)
+		assert.True(t, ipRange.Contains(ip), "%s is not in %s", ip, ipRange)
+		assert.False(t, allocated[ip.String()], "%s allocated twice", ip)
+		allocated[ip.String()] = true
+		ips = append(ips, ip)
+	}
+	assert.Equal(t, "10.20.3.0", ips[0].String())
+	assert.Equal(t, "10.20.3.255", ips[255].String())
+	_, err := allocator.AllocateInRange(subnet, ipRange)
+	assert.NotNil(t, err)
+	assert.Equal(t, ips, allocator.Allocated(subnet))
+
+	// Release只清除该IP对应的位
+	released := ips[100]
+	assert.Nil(t, allocator.Release(subnet, released))
+	remaining := allocator.Allocated(subnet)
+	assert.Equal(t, 255, len(remaining))
+	for _, ip := range remaining {
+		assert.False(t, ip.Equal(released))
+	}
+	ip, err := allocator.AllocateInRange(subnet, ipRange)
+	assert.Nil(t, err)
+	assert.Equal(t, released.String(), ip.String())
+
+	for _, ip := range ips {
+		assert.Nil(t, allocator.Release(subnet, ip))
+	}
+	assert.Equal(t, 0, len(allocator.Allocated(subnet)))
+}
+
+func TestLocalIPAM_AllocateAcrossBytes(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.21.0.0/16")
+	var ips []net.IP
+	for i := 0; i < 257; i++ {
+		ip, err := allocator.Allocate(subnet)
+		assert.Nil(t, err)
+		ips = append(ips, ip)
+	}
+	// .255之后进位到下一个字节，而不是回到网段地址
+	assert.Equal(t, "10.21.0.1", ips[0].String())
+	assert.Equal(t, "10.21.0.255", ips[254].String())
+	assert.Equal(t, "10.21.1.0", ips[255].String())
+	assert.Equal(t, "10.21.1.1", ips[256].String())
+
+	assert.Nil(t, allocator.Release(subnet, ips[255]))
+	assert.Equal(t, 256, len(allocator.Allocated(subnet)))
+	ip, err := allocator.Allocate(subnet)
+	assert.Nil(t, err)
+	assert.Equal(t, "10.21.1.0", ip.String())
+
+	for _, ip := range ips {
+		assert.Nil(t, allocator.Release(subnet, ip))
+	}
+	assert.Equal(t, 0, len(allocator.Allocated(subnet)))
+}
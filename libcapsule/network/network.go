@@ -3,8 +3,13 @@ package network
 import (
 	"fmt"
 	"github.com/sirupsen/logrus"
+	"github.com/songxinjianqwe/capsule/libcapsule/configs"
+	"github.com/songxinjianqwe/capsule/libcapsule/constant"
+	"github.com/songxinjianqwe/capsule/libcapsule/util/filelock"
 	"github.com/vishvananda/netlink"
 	"net"
+	"os"
+	"path/filepath"
 	"sync"
 )
 
@@ -13,31 +18,71 @@ const (
 	DefaultBridgeName = "capsule_bridge0"
 )
 
+// network create --opt支持的选项
+const (
+	BridgeNameOption         = "com.capsule.bridge.name"
+	EnableIPMasqueradeOption = "enable_ip_masquerade"
+	ICCOption                = "icc"
+)
+
 /*
 对应一个网段，Driver取值有Bridge
 */
 type Network struct {
 	// 网络名称
 	Name string `json:"name"`
-	// 网段
-	ipRange net.IPNet `json:"ip_range"`
+	// 网段，IP为网关IP
+	IpRange net.IPNet `json:"ip_range"`
 	// 网络驱动名（网络类型）
 	Driver string `json:"driver"`
+	// 容器IP的分配范围，为nil时在整个网段中分配
+	AllocatableRange *net.IPNet `json:"allocatable_range,omitempty"`
+	// 宿主机上的bridge名称，为空时与网络名称相同
+	BridgeName string `json:"bridge_name,omitempty"`
+	// bridge和veth的MTU，为0时使用内核默认值
+	MTU int `json:"mtu,omitempty"`
+	// 是否对访问外部的流量做SNAT
+	EnableIPMasquerade bool `json:"enable_ip_masquerade"`
+	// 是否允许同一网络中的容器互相访问
+	ICC bool `json:"icc"`
+	// 设置SNAT规则时使用的防火墙
+	Firewall string `json:"firewall,omitempty"`
+}
+
+/*
+network create的参数
+*/
+type CreateOptions struct {
+	Subnet string
+	// 为空时使用网段中的第一个IP
+	Gateway string
+	IpRange string
+	MTU     int
+	// --opt key=value
+	Options map[string]string
 }
 
 func (network *Network) Subnet() *net.IPNet {
-	_, ipNet, _ := net.ParseCIDR(network.ipRange.String())
+	_, ipNet, _ := net.ParseCIDR(network.IpRange.String())
 	return ipNet
 }
 
 func (network *Network) GatewayIP() net.IP {
-	ip, _, _ := net.ParseCIDR(network.ipRange.String())
+	ip, _, _ := net.ParseCIDR(network.IpRange.String())
 	return ip
 }
 
+func (network *Network) GetBridgeName() string {
+	if network.BridgeName == "" {
+		return network.Name
+	}
+	return network.BridgeName
+}
+
 func (network *Network) String() string {
-	ip, ipNet, _ := net.ParseCIDR(network.ipRange.String())
-	return fmt.Sprintf("[%s]%s(ip:%s,range:%s)", network.Driver, network.Name, ip, ipNet)
+	ip, ipNet, _ := net.ParseCIDR(network.IpRange.String())
+	return fmt.Sprintf("[%s]%s(ip:%s,range:%s,allocatable:%s,bridge:%s,mtu:%d,masquerade:%t,icc:%t)",
+		network.Driver, network.Name, ip, ipNet, network.AllocatableRange, network.GetBridgeName(), network.MTU, network.EnableIPMasquerade, network.ICC)
 }
 
 /*
@@ -49,6 +94,16 @@ type Endpoint struct {
 	Device       *netlink.Veth `json:"device"`
 	Network      *Network      `json:"network"`
 	PortMappings []string      `json:"port_mappings"`
+	// 设置端口映射时使用的防火墙
+	Firewall string `json:"firewall"`
+	// 以下字段用于DNS解析
+	ContainerId string   `json:"container_id"`
+	Hostname    string   `json:"hostname"`
+	Links       []string `json:"links"`
+	// 通过--dns指定的nameserver，DNS server转发查询时使用
+	DNS []string `json:"dns"`
+	// 带宽限制
+	Bandwidth *configs.Bandwidth `json:"bandwidth"`
 }
 
 func (endpoint *Endpoint) String() string {
@@ -73,23 +128,33 @@ var initErr error
 
 func InitNetworkDrivers(runtimeRoot string) error {
 	onceForNetworkDrivers.Do(func() {
+		networkRuntimeRoot = runtimeRoot
 		networkDrivers = make(map[string]NetworkDriver)
 		ipam, err := NewPersistentIPAllocator(runtimeRoot)
-		initErr = err
+		if err != nil {
+			initErr = err
+			return
+		}
+		firewall, err := NewFirewall(firewallBackend)
+		if err != nil {
+			initErr = err
+			return
+		}
 		networkDrivers["bridge"] = &BridgeNetworkDriver{
 			runtimeRoot: runtimeRoot,
 			allocator:   ipam,
+			firewall:    firewall,
 		}
 	})
 	return initErr
 }
 
-func CreateNetwork(driver string, subnet string, name string) (*Network, error) {
+func CreateNetwork(driver string, name string, options *CreateOptions) (*Network, error) {
 	networkDriver, found := networkDrivers[driver]
 	if !found {
 		return nil, fmt.Errorf("network driver not found: %s", driver)
 	}
-	return networkDriver.Create(subnet, name)
+	return networkDriver.Create(name, options)
 }
 
 func DeleteNetwork(driver string, name string) error {
@@ -101,6 +166,9 @@ func DeleteNetwork(driver string, name string) error {
 	if err != nil {
 		return err
 	}
+	if err := StopDNSServer(network.Name); err != nil {
+		logrus.Warnf("stop dns server failed, cause: %s", err.Error())
+	}
 	return networkDriver.Delete(network.Name)
 }
 
@@ -143,7 +211,12 @@ func ListAllNetwork() ([]*Network, error) {
 	return result, nil
 }
 
-func Connect(endpointId string, networkName string, portMappings []string, containerInitPid int) (*Endpoint, error) {
+func Connect(endpointId string, networkName string, portMappings []string, bandwidth *configs.Bandwidth, containerInitPid int) (*Endpoint, error) {
+	fileLock, err := lockNetwork()
+	if err != nil {
+		return nil, err
+	}
+	defer fileLock.Unlock()
 	network, err := LoadNetworkByName(networkName)
 	if err != nil {
 		return nil, err
@@ -153,7 +226,7 @@ func Connect(endpointId string, networkName string, portMappings []string, conta
 	if !found {
 		return nil, fmt.Errorf("network driver not found: %s", network.Driver)
 	}
-	return networkDriverInstance.Connect(endpointId, network, portMappings, containerInitPid)
+	return networkDriverInstance.Connect(endpointId, network, portMappings, bandwidth, containerInitPid)
 }
 
 func Disconnect(endpoint *Endpoint) error {
@@ -162,5 +235,29 @@ func Disconnect(endpoint *Endpoint) error {
 	if !found {
 		return fmt.Errorf("network driver not found: %s", endpoint.Network.Driver)
 	}
+	if err := removeEndpoint(endpoint); err != nil {
+		logrus.Warnf("remove endpoint failed, cause: %s", err.Error())
+	}
 	return networkDriver.Disconnect(endpoint)
 }
+
+/*
+Connect和Prune都要持有这把锁，否则Prune可能会把正在Connect的容器的veth、IP等当作孤儿资源回收掉
+*/
+func lockNetwork() (*filelock.FileLock, error) {
+	lockPath := filepath.Join(networkRuntimeRoot, constant.NetworkLockPath)
+	if err := os.MkdirAll(filepath.Dir(lockPath), 0700); err != nil {
+		return nil, err
+	}
+	return filelock.Lock(lockPath)
+}
+
+/*
+持久化endpoint，并确保该网络的DNS server已经启动
+*/
+func RegisterEndpoint(endpoint *Endpoint) error {
+	if err := saveEndpoint(endpoint); err != nil {
+		return err
+	}
+	return EnsureDNSServer(endpoint.Network.Name)
+}
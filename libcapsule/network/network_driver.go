@@ -1,12 +1,16 @@
 package network
 
+import "github.com/songxinjianqwe/capsule/libcapsule/configs"
+
 type NetworkDriver interface {
 	Name() string
 	NetworkLabel() string
-	Create(subnet string, name string) (*Network, error)
+	Create(name string, options *CreateOptions) (*Network, error)
 	Load(name string) (*Network, error)
 	Delete(name string) error
-	Connect(endpointId string, network *Network, portMappings []string, containerInitPid int) (*Endpoint, error)
+	Connect(endpointId string, network *Network, portMappings []string, bandwidth *configs.Bandwidth, containerInitPid int) (*Endpoint, error)
 	Disconnect(endpoint *Endpoint) error
 	List() ([]*Network, error)
+	// 回收不属于liveEndpoints的网络资源
+	Prune(liveEndpoints []*Endpoint) (*PruneReport, error)
 }
@@ -2,23 +2,28 @@ package network
 
 import (
 	"fmt"
-	"github.com/coreos/go-iptables/iptables"
 	"github.com/sirupsen/logrus"
 	"github.com/songxinjianqwe/capsule/libcapsule/util/exception"
 	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
 	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
 	"net"
 	"os"
 	"runtime"
 	"strings"
 )
 
-func createBridgeInterface(name string, networkLabel string) error {
+/*
+alias用于List时找到capsule创建的bridge，并从中得到网络名称
+*/
+func createBridgeInterface(name string, mtu int, alias string) error {
 	if _, err := net.InterfaceByName(name); err == nil || !strings.Contains(err.Error(), "no such network interface") {
 		return fmt.Errorf("brigde name %s exists", name)
 	}
 	linkAttrs := netlink.NewLinkAttrs()
 	linkAttrs.Name = name
+	linkAttrs.MTU = mtu
 
 	br := &netlink.Bridge{
 		LinkAttrs: linkAttrs,
@@ -26,23 +31,7 @@ func createBridgeInterface(name string, networkLabel string) error {
 	if err := netlink.LinkAdd(br); err != nil {
 		return err
 	}
-	if err := netlink.LinkSetAlias(br, networkLabel+"-"+name); err != nil {
-		return err
-	}
-	return nil
-}
-
-// SNAT MASQUERADE
-func setupIPTablesMasquerade(name string, subnet net.IPNet) error {
-	logrus.Infof("setting up iptables masquerade for %s", name)
-	tables, err := iptables.New()
-	if err != nil {
-		return err
-	}
-	// iptables -t nat -A POSTROUTING -s %s -o %s -j MASQUERADE
-	if err := tables.Append(
-		"nat",
-		"POSTROUTING", getSNATRuleSpecs(name, subnet)...); err != nil {
+	if err := netlink.LinkSetAlias(br, alias); err != nil {
 		return err
 	}
 	return nil
@@ -87,49 +76,6 @@ func setInterfaceIPAndRoute(name string, interfaceIPAndRoute net.IPNet) error {
 	return nil
 }
 
-// DNAT
-func setupPortMappings(endpoint *Endpoint) error {
-	tables, err := iptables.New()
-	if err != nil {
-		return err
-	}
-	for _, mapping := range endpoint.PortMappings {
-		split := strings.Split(mapping, ":")
-		hostPort := split[0]
-		containerPort := split[1]
-		logrus.Infof("setting up %s port mapping %s:%s", endpoint.Name, hostPort, containerPort)
-		if err := tables.Append(
-			"nat",
-			"PREROUTING",
-			getDNATRuleSpecs(endpoint.IpAddress.String(), hostPort, containerPort)...,
-		); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-func deletePortMappings(endpoint *Endpoint) error {
-	tables, err := iptables.New()
-	if err != nil {
-		return err
-	}
-	for _, mapping := range endpoint.PortMappings {
-		split := strings.Split(mapping, ":")
-		hostPort := split[0]
-		containerPort := split[1]
-		logrus.Infof("delete port mapping:%s", endpoint.IpAddress.String())
-		if err := tables.Delete(
-			"nat",
-			"PREROUTING",
-			getDNATRuleSpecs(endpoint.IpAddress.String(), hostPort, containerPort)...,
-		); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
 func setUpContainerVethInNetNs(endpoint *Endpoint, pid int) error {
 	containerVethName := endpoint.GetContainerVethName()
 	containerVeth, err := netlink.LinkByName(containerVethName)
@@ -158,7 +104,7 @@ func setUpContainerVethInNetNs(endpoint *Endpoint, pid int) error {
 	// 3. 配置IP地址与路由
 	// 此时interface的IP地址为endpoint的地址,而网段是bridge的网段
 	// 将来自该网段的网络请求转发到这个网络接口上
-	interfaceIP := endpoint.Network.ipRange
+	interfaceIP := endpoint.Network.IpRange
 	interfaceIP.IP = endpoint.IpAddress
 	if err := setInterfaceIPAndRoute(containerVethName, interfaceIP); err != nil {
 		return exception.NewGenericErrorWithContext(err, exception.InterfaceIPAndRouteSetError, "set veth ip and route")
@@ -179,7 +125,7 @@ func setUpContainerVethInNetNs(endpoint *Endpoint, pid int) error {
 	_, defaultIpRange, _ := net.ParseCIDR("0.0.0.0/0")
 	defaultRoute := &netlink.Route{
 		LinkIndex: containerVeth.Attrs().Index,
-		Gw:        endpoint.Network.ipRange.IP,
+		Gw:        endpoint.Network.IpRange.IP,
 		Dst:       defaultIpRange,
 	}
 	logrus.Infof("add default route in container: %s", defaultIpRange)
@@ -220,7 +166,7 @@ func leaveContainerNetNs(originNetNsHandle netns.NsHandle, netNsFileHandle *os.F
 
 func createVethPairAndSetUp(endpoint *Endpoint) error {
 	logrus.Infof("create veth pair %#v and set it up...", endpoint.Name)
-	bridge, err := netlink.LinkByName(endpoint.Network.Name)
+	bridge, err := netlink.LinkByName(endpoint.Network.GetBridgeName())
 	if err != nil {
 		return err
 	}
@@ -229,6 +175,8 @@ func createVethPairAndSetUp(endpoint *Endpoint) error {
 	vethAttrs.Name = endpoint.Name[:5]
 	// 将一端连接到bridge上
 	vethAttrs.MasterIndex = bridge.Attrs().Index
+	// 两端的MTU都会设置为该值
+	vethAttrs.MTU = endpoint.Network.MTU
 
 	endpoint.Device = &netlink.Veth{
 		LinkAttrs: vethAttrs,
@@ -238,31 +186,33 @@ func createVethPairAndSetUp(endpoint *Endpoint) error {
 		return err
 	}
 	logrus.Infof("veth pair created: %#v", endpoint.Device)
+	if !endpoint.Network.ICC {
+		if err := setBridgePortIsolated(endpoint.Device); err != nil {
+			return err
+		}
+	}
 	if err := netlink.LinkSetUp(endpoint.Device); err != nil {
 		return err
 	}
 	return nil
 }
 
-func getSNATRuleSpecs(name string, subnet net.IPNet) []string {
-	_, ipNet, _ := net.ParseCIDR(subnet.String())
-	// !的意思是negative,out设备名是除了name之外的其他网络设备
-	// SNAT转换时将源IP转为某设备名,这里我们不清楚有哪些网卡,于是我们将其设置为除了我们bridge外的设备
-	// 因为bridge的IP也是私有IP,外网是不认识的
-	return []string{
-		fmt.Sprintf("-s%s", ipNet.String()),
-		"!",
-		fmt.Sprintf("-o%s", name),
-		"-jMASQUERADE",
-	}
-}
-
-func getDNATRuleSpecs(containerIP string, hostPort string, containerPort string) []string {
-	return []string{"-ptcp",
-		"-mtcp",
-		"-jDNAT",
-		"--dport",
-		hostPort,
-		"--to-destination",
-		fmt.Sprintf("%s:%s", containerIP, containerPort)}
+// 内核4.18开始支持，netlink库中还没有这个常量
+const iflaBrportIsolated = 33
+
+/*
+bridge port isolation: 两个isolated的端口之间不能互相转发，但与bridge本身(网关、DNS server)以及外部的通信不受影响
+icc=false时容器的veth都设置为isolated，即禁止了同一网络中容器之间的通信
+`bridge link set dev $link isolated on`
+*/
+func setBridgePortIsolated(link netlink.Link) error {
+	req := nl.NewNetlinkRequest(unix.RTM_SETLINK, unix.NLM_F_ACK)
+	msg := nl.NewIfInfomsg(unix.AF_BRIDGE)
+	msg.Index = int32(link.Attrs().Index)
+	req.AddData(msg)
+	protinfo := nl.NewRtAttr(unix.IFLA_PROTINFO|unix.NLA_F_NESTED, nil)
+	protinfo.AddRtAttr(iflaBrportIsolated, []byte{1})
+	req.AddData(protinfo)
+	_, err := req.Execute(unix.NETLINK_ROUTE, 0)
+	return err
 }
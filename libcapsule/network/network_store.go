@@ -0,0 +1,52 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/songxinjianqwe/capsule/libcapsule/constant"
+	"github.com/songxinjianqwe/capsule/libcapsule/util/filelock"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+/*
+network create的参数(网关、MTU、--opt等)无法全部从bridge上还原，所以持久化到
+$RuntimeRoot/network/networks/$networkName.json
+*/
+func saveNetwork(runtimeRoot string, network *Network) error {
+	bytes, err := json.Marshal(network)
+	if err != nil {
+		return err
+	}
+	return filelock.WriteFileAtomic(networkConfigPath(runtimeRoot, network.Name), bytes, 0644)
+}
+
+/*
+配置文件不存在时返回nil，比如之前版本创建的网络
+*/
+func loadNetwork(runtimeRoot string, name string) (*Network, error) {
+	bytes, err := ioutil.ReadFile(networkConfigPath(runtimeRoot, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	network := &Network{}
+	if err := json.Unmarshal(bytes, network); err != nil {
+		return nil, fmt.Errorf("load network %s failed, cause: %s", name, err.Error())
+	}
+	return network, nil
+}
+
+func removeNetwork(runtimeRoot string, name string) error {
+	if err := os.Remove(networkConfigPath(runtimeRoot, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func networkConfigPath(runtimeRoot string, name string) string {
+	return filepath.Join(runtimeRoot, constant.NetworkNetworksDir, name+".json")
+}
@@ -1,14 +1,19 @@
 package network
 
 import (
+	"os"
 	"os/user"
 	"testing"
 )
 
 func TestMain(m *testing.M) {
+	// 被TestLocalIPAM_ConcurrentProcesses拉起的子进程，只负责分配IP
+	if root := os.Getenv(ipamStressRootEnv); root != "" {
+		os.Exit(runIPAMStressWorker(root))
+	}
 	userObj, _ := user.Current()
 	ipam, _ := NewMemoryIPAllocator()
-	driver = BridgeNetworkDriver{runtimeRoot: userObj.HomeDir, allocator: ipam}
+	driver = BridgeNetworkDriver{runtimeRoot: userObj.HomeDir, allocator: ipam, firewall: &IPTablesFirewall{}}
 
 	allocator, _ = NewMemoryIPAllocator()
 	m.Run()
@@ -0,0 +1,396 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// nftables的netlink协议，见linux/netfilter/nf_tables.h，这里只定义了用到的部分
+const (
+	nftMsgNewTable   = 0
+	nftMsgNewChain   = 3
+	nftMsgDelChain   = 5
+	nftMsgNewRule    = 6
+	nftMsgDelRule    = 8
+	nftMsgNewSet     = 9
+	nftMsgNewSetElem = 12
+	nftMsgDelSetElem = 14
+
+	nfnlMsgBatchBegin = 0x10
+	nfnlMsgBatchEnd   = 0x11
+
+	nftaTableName = 1
+
+	nftaChainTable = 1
+	nftaChainName  = 3
+	nftaChainHook  = 4
+	nftaChainType  = 7
+	nftaHookNum    = 1
+	nftaHookPrio   = 2
+
+	nftaRuleTable       = 1
+	nftaRuleChain       = 2
+	nftaRuleExpressions = 4
+
+	nftaSetTable    = 1
+	nftaSetName     = 2
+	nftaSetFlags    = 3
+	nftaSetKeyType  = 4
+	nftaSetKeyLen   = 5
+	nftaSetDataType = 6
+	nftaSetDataLen  = 7
+	nftaSetId       = 10
+
+	nftaSetElemListTable    = 1
+	nftaSetElemListSet      = 2
+	nftaSetElemListElements = 3
+	nftaSetElemKey          = 1
+	nftaSetElemData         = 2
+
+	nftaListElem  = 1
+	nftaExprName  = 1
+	nftaExprData  = 2
+	nftaDataValue = 1
+
+	nftaMetaDreg       = 1
+	nftaMetaKey        = 2
+	nftaCmpSreg        = 1
+	nftaCmpOp          = 2
+	nftaCmpData        = 3
+	nftaPayloadDreg    = 1
+	nftaPayloadBase    = 2
+	nftaPayloadOffset  = 3
+	nftaPayloadLen     = 4
+	nftaBitwiseSreg    = 1
+	nftaBitwiseDreg    = 2
+	nftaBitwiseLen     = 3
+	nftaBitwiseMask    = 4
+	nftaBitwiseXor     = 5
+	nftaLookupSet      = 1
+	nftaLookupSreg     = 2
+	nftaLookupDreg     = 3
+	nftaNatType        = 1
+	nftaNatFamily      = 2
+	nftaNatRegAddrMin  = 3
+	nftaNatRegProtoMin = 5
+
+	nftReg1 = 1
+	nftReg2 = 2
+
+	nftCmpEq  = 0
+	nftCmpNeq = 1
+
+	nftMetaOifName = 7
+	nftMetaL4Proto = 16
+
+	nftPayloadNetworkHeader   = 1
+	nftPayloadTransportHeader = 2
+
+	nftNatDNAT = 1
+
+	nftSetMap = 0x8
+
+	// nft命令行工具中的数据类型，内核并不关心，只是为了nft list时可以正确显示
+	nftTypeIPAddr      = 7
+	nftTypeInetService = 13
+
+	nfInetPreRouting  = 0
+	nfInetPostRouting = 4
+
+	ifNameSize = 16
+)
+
+var nftSeq = uint32(time.Now().Unix())
+
+type nftMessage struct {
+	msgType uint16
+	flags   uint16
+	attrs   []*nl.RtAttr
+}
+
+/*
+nftables的修改必须放在一个batch中提交，batch中的消息要么全部生效，要么全部不生效
+*/
+type nftBatch struct {
+	family   uint8
+	messages []nftMessage
+}
+
+func newNFTBatch() *nftBatch {
+	return &nftBatch{family: unix.AF_INET}
+}
+
+func (batch *nftBatch) add(msgType uint16, flags uint16, attrs ...*nl.RtAttr) {
+	batch.messages = append(batch.messages, nftMessage{
+		msgType: msgType,
+		flags:   flags,
+		attrs:   attrs,
+	})
+}
+
+func (batch *nftBatch) commit() error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_NETFILTER)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+	timeout := unix.NsecToTimeval((5 * time.Second).Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout); err != nil {
+		return err
+	}
+
+	beginSeq := atomic.AddUint32(&nftSeq, 1)
+	buf := serializeNFTMessage(nfnlMsgBatchBegin, unix.NLM_F_REQUEST, beginSeq, unix.AF_UNSPEC, nil)
+	for _, msg := range batch.messages {
+		msgType := uint16(unix.NFNL_SUBSYS_NFTABLES<<8) | msg.msgType
+		flags := unix.NLM_F_REQUEST | unix.NLM_F_ACK | msg.flags
+		buf = append(buf, serializeNFTMessage(msgType, flags, atomic.AddUint32(&nftSeq, 1), batch.family, msg.attrs)...)
+	}
+	buf = append(buf, serializeNFTMessage(nfnlMsgBatchEnd, unix.NLM_F_REQUEST, atomic.AddUint32(&nftSeq, 1), unix.AF_UNSPEC, nil)...)
+	if err := unix.Sendto(fd, buf, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	// 每条消息都带有NLM_F_ACK，无论成功失败内核都会回复一条NLMSG_ERROR
+	var firstErr error
+	pending := len(batch.messages)
+	recvBuf := make([]byte, 64*1024)
+	for pending > 0 {
+		n, _, err := unix.Recvfrom(fd, recvBuf, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(recvBuf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Type != unix.NLMSG_ERROR {
+				continue
+			}
+			errno := int32(nl.NativeEndian().Uint32(m.Data[0:4]))
+			if errno != 0 && firstErr == nil {
+				logrus.Warnf("nftables message(seq %d) failed, cause: %s", m.Header.Seq, syscall.Errno(-errno))
+				firstErr = syscall.Errno(-errno)
+			}
+			// batch本身不合法，内核只会回复这一条
+			if m.Header.Seq == beginSeq {
+				return firstErr
+			}
+			pending--
+		}
+	}
+	return firstErr
+}
+
+func serializeNFTMessage(msgType uint16, flags uint16, seq uint32, family uint8, attrs []*nl.RtAttr) []byte {
+	var payload []byte
+	// struct nfgenmsg
+	payload = append(payload, family, 0)
+	resId := make([]byte, 2)
+	binary.BigEndian.PutUint16(resId, unix.NFNL_SUBSYS_NFTABLES)
+	payload = append(payload, resId...)
+	for _, attr := range attrs {
+		payload = append(payload, attr.Serialize()...)
+	}
+	header := make([]byte, unix.SizeofNlMsghdr)
+	native := nl.NativeEndian()
+	native.PutUint32(header[0:4], uint32(unix.SizeofNlMsghdr+len(payload)))
+	native.PutUint16(header[4:6], msgType)
+	native.PutUint16(header[6:8], flags)
+	native.PutUint32(header[8:12], seq)
+	native.PutUint32(header[12:16], 0)
+	return append(header, payload...)
+}
+
+// ************************************************************************************************
+// attributes
+// ************************************************************************************************
+
+func nftStringAttr(attrType int, value string) *nl.RtAttr {
+	return nl.NewRtAttr(attrType, nl.ZeroTerminated(value))
+}
+
+// nftables中的整数均为网络字节序
+func nftUint32Attr(attrType int, value uint32) *nl.RtAttr {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, value)
+	return nl.NewRtAttr(attrType, data)
+}
+
+func nftNestedAttr(attrType int, children ...*nl.RtAttr) *nl.RtAttr {
+	attr := nl.NewRtAttr(attrType|unix.NLA_F_NESTED, nil)
+	for _, child := range children {
+		attr.AddChild(child)
+	}
+	return attr
+}
+
+func nftDataAttr(attrType int, value []byte) *nl.RtAttr {
+	return nftNestedAttr(attrType, nl.NewRtAttr(nftaDataValue, value))
+}
+
+func nftTableAttrs(table string) []*nl.RtAttr {
+	return []*nl.RtAttr{nftStringAttr(nftaTableName, table)}
+}
+
+func nftBaseChainAttrs(table string, chain string, chainType string, hook uint32, priority int32) []*nl.RtAttr {
+	return []*nl.RtAttr{
+		nftStringAttr(nftaChainTable, table),
+		nftStringAttr(nftaChainName, chain),
+		nftNestedAttr(nftaChainHook,
+			nftUint32Attr(nftaHookNum, hook),
+			nftUint32Attr(nftaHookPrio, uint32(priority)),
+		),
+		nftStringAttr(nftaChainType, chainType),
+	}
+}
+
+func nftChainAttrs(table string, chain string) []*nl.RtAttr {
+	return []*nl.RtAttr{
+		nftStringAttr(nftaChainTable, table),
+		nftStringAttr(nftaChainName, chain),
+	}
+}
+
+func nftRuleAttrs(table string, chain string, exprs ...*nl.RtAttr) []*nl.RtAttr {
+	return []*nl.RtAttr{
+		nftStringAttr(nftaRuleTable, table),
+		nftStringAttr(nftaRuleChain, chain),
+		nftNestedAttr(nftaRuleExpressions, exprs...),
+	}
+}
+
+// 只指定table和chain的DELRULE会删除chain中的所有规则
+func nftFlushChainAttrs(table string, chain string) []*nl.RtAttr {
+	return []*nl.RtAttr{
+		nftStringAttr(nftaRuleTable, table),
+		nftStringAttr(nftaRuleChain, chain),
+	}
+}
+
+func nftMapAttrs(table string, name string, id uint32, keyType, keyLen, dataType, dataLen uint32) []*nl.RtAttr {
+	return []*nl.RtAttr{
+		nftStringAttr(nftaSetTable, table),
+		nftStringAttr(nftaSetName, name),
+		nftUint32Attr(nftaSetFlags, nftSetMap),
+		nftUint32Attr(nftaSetKeyType, keyType),
+		nftUint32Attr(nftaSetKeyLen, keyLen),
+		nftUint32Attr(nftaSetDataType, dataType),
+		nftUint32Attr(nftaSetDataLen, dataLen),
+		nftUint32Attr(nftaSetId, id),
+	}
+}
+
+func nftMapElemAttrs(table string, set string, key []byte, data []byte) []*nl.RtAttr {
+	elem := nftNestedAttr(nftaListElem, nftDataAttr(nftaSetElemKey, key))
+	if data != nil {
+		elem.AddChild(nftDataAttr(nftaSetElemData, data))
+	}
+	return []*nl.RtAttr{
+		nftStringAttr(nftaSetElemListTable, table),
+		nftStringAttr(nftaSetElemListSet, set),
+		nftNestedAttr(nftaSetElemListElements, elem),
+	}
+}
+
+// 只指定table和set的DELSETELEM会清空set中的所有元素
+func nftFlushSetAttrs(table string, set string) []*nl.RtAttr {
+	return []*nl.RtAttr{
+		nftStringAttr(nftaSetElemListTable, table),
+		nftStringAttr(nftaSetElemListSet, set),
+	}
+}
+
+// ************************************************************************************************
+// expressions
+// ************************************************************************************************
+
+func nftExpr(name string, data ...*nl.RtAttr) *nl.RtAttr {
+	expr := nftNestedAttr(nftaListElem, nftStringAttr(nftaExprName, name))
+	if len(data) > 0 {
+		expr.AddChild(nftNestedAttr(nftaExprData, data...))
+	}
+	return expr
+}
+
+func nftMetaExpr(key uint32, dreg uint32) *nl.RtAttr {
+	return nftExpr("meta",
+		nftUint32Attr(nftaMetaKey, key),
+		nftUint32Attr(nftaMetaDreg, dreg),
+	)
+}
+
+func nftPayloadExpr(base uint32, offset uint32, length uint32, dreg uint32) *nl.RtAttr {
+	return nftExpr("payload",
+		nftUint32Attr(nftaPayloadDreg, dreg),
+		nftUint32Attr(nftaPayloadBase, base),
+		nftUint32Attr(nftaPayloadOffset, offset),
+		nftUint32Attr(nftaPayloadLen, length),
+	)
+}
+
+func nftCmpExpr(op uint32, sreg uint32, data []byte) *nl.RtAttr {
+	return nftExpr("cmp",
+		nftUint32Attr(nftaCmpSreg, sreg),
+		nftUint32Attr(nftaCmpOp, op),
+		nftDataAttr(nftaCmpData, data),
+	)
+}
+
+func nftBitwiseExpr(sreg uint32, dreg uint32, mask []byte, xor []byte) *nl.RtAttr {
+	return nftExpr("bitwise",
+		nftUint32Attr(nftaBitwiseSreg, sreg),
+		nftUint32Attr(nftaBitwiseDreg, dreg),
+		nftUint32Attr(nftaBitwiseLen, uint32(len(mask))),
+		nftDataAttr(nftaBitwiseMask, mask),
+		nftDataAttr(nftaBitwiseXor, xor),
+	)
+}
+
+func nftLookupExpr(set string, sreg uint32, dreg uint32) *nl.RtAttr {
+	return nftExpr("lookup",
+		nftStringAttr(nftaLookupSet, set),
+		nftUint32Attr(nftaLookupSreg, sreg),
+		nftUint32Attr(nftaLookupDreg, dreg),
+	)
+}
+
+func nftDNATExpr(addrReg uint32, protoReg uint32) *nl.RtAttr {
+	return nftExpr("nat",
+		nftUint32Attr(nftaNatType, nftNatDNAT),
+		nftUint32Attr(nftaNatFamily, unix.AF_INET),
+		nftUint32Attr(nftaNatRegAddrMin, addrReg),
+		nftUint32Attr(nftaNatRegProtoMin, protoReg),
+	)
+}
+
+func nftMasqExpr() *nl.RtAttr {
+	return nftExpr("masq")
+}
+
+func nftIfName(name string) []byte {
+	data := make([]byte, ifNameSize)
+	copy(data, name)
+	return data
+}
+
+func nftPort(port string) ([]byte, error) {
+	value, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, uint16(value))
+	return data, nil
+}
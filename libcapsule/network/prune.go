@@ -0,0 +1,161 @@
+package network
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"net"
+)
+
+/*
+被回收的资源，用于展示给用户
+*/
+type PruneReport struct {
+	Endpoints    []string
+	Links        []string
+	PortMappings []string
+	IPs          []string
+}
+
+func (report *PruneReport) merge(other *PruneReport) {
+	report.Endpoints = append(report.Endpoints, other.Endpoints...)
+	report.Links = append(report.Links, other.Links...)
+	report.PortMappings = append(report.PortMappings, other.PortMappings...)
+	report.IPs = append(report.IPs, other.IPs...)
+}
+
+/*
+回收孤儿网络资源(宿主机重启、capsule在Connect中途崩溃等情况下遗留的)
+listLiveEndpoints返回所有存在的容器(无论是否在运行)的endpoint，不在其中的资源均会被回收:
+1. 持久化的endpoint记录
+2. 端口映射规则
+3. 宿主机上的veth和ifb
+4. IPAM中已分配的IP(网关IP除外)
+listLiveEndpoints在网络锁内调用，此时不会有容器正在Connect
+*/
+func Prune(listLiveEndpoints func() ([]*Endpoint, error)) (*PruneReport, error) {
+	fileLock, err := lockNetwork()
+	if err != nil {
+		return nil, err
+	}
+	defer fileLock.Unlock()
+	liveEndpoints, err := listLiveEndpoints()
+	if err != nil {
+		return nil, err
+	}
+	report := &PruneReport{}
+	live := make(map[string]bool)
+	for _, endpoint := range liveEndpoints {
+		live[endpoint.Name] = true
+	}
+	networks, err := ListAllNetwork()
+	if err != nil {
+		return nil, err
+	}
+	for _, network := range networks {
+		endpoints, err := loadEndpoints(network.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, endpoint := range endpoints {
+			if live[endpoint.Name] {
+				continue
+			}
+			logrus.Infof("pruning orphan endpoint %s of container %s", endpoint.Name, endpoint.ContainerId)
+			// 端口映射、IP在下面统一回收
+			if err := deleteBandwidth(endpoint); err != nil {
+				logrus.Warnf("delete bandwidth of %s failed, cause: %s", endpoint.Name, err.Error())
+			}
+			if err := removeEndpoint(endpoint); err != nil {
+				return nil, err
+			}
+			report.Endpoints = append(report.Endpoints, fmt.Sprintf("%s(%s)", endpoint.Name, endpoint.ContainerId))
+		}
+	}
+	for _, driver := range networkDrivers {
+		driverReport, err := driver.Prune(liveEndpoints)
+		if err != nil {
+			return report, err
+		}
+		report.merge(driverReport)
+	}
+	return report, nil
+}
+
+func (driver *BridgeNetworkDriver) Prune(liveEndpoints []*Endpoint) (*PruneReport, error) {
+	report := &PruneReport{}
+	networks, err := driver.List()
+	if err != nil {
+		return nil, err
+	}
+	var subnets []*net.IPNet
+	bridgeIndexes := make(map[int]bool)
+	for _, network := range networks {
+		subnets = append(subnets, network.Subnet())
+		if link, err := netlink.LinkByName(network.GetBridgeName()); err == nil {
+			bridgeIndexes[link.Attrs().Index] = true
+		}
+	}
+
+	// 1. 端口映射
+	pruned, err := driver.firewall.PrunePortMappings(liveEndpoints, subnets)
+	if err != nil {
+		return nil, err
+	}
+	report.PortMappings = pruned
+
+	// 2. veth和ifb
+	liveLinks := make(map[string]bool)
+	for _, endpoint := range liveEndpoints {
+		liveLinks[endpoint.GetHostVethName()] = true
+		liveLinks[endpoint.GetIfbName()] = true
+	}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	// 只回收由capsule的veth名称推导出的ifb，不能按前缀匹配，宿主机上可能有其他程序创建的ifb-xxx
+	// veth已经随容器net namespace销毁的ifb由上面的endpoint记录回收
+	capsuleIfbs := make(map[string]bool)
+	for _, link := range links {
+		if _, isVeth := link.(*netlink.Veth); isVeth && bridgeIndexes[link.Attrs().MasterIndex] {
+			capsuleIfbs[ifbName(link.Attrs().Name)] = true
+		}
+	}
+	for _, link := range links {
+		name := link.Attrs().Name
+		if liveLinks[name] {
+			continue
+		}
+		_, isVeth := link.(*netlink.Veth)
+		_, isIfb := link.(*netlink.Ifb)
+		if !(isVeth && bridgeIndexes[link.Attrs().MasterIndex]) && !(isIfb && capsuleIfbs[name]) {
+			continue
+		}
+		logrus.Infof("pruning orphan link %s", name)
+		if err := netlink.LinkDel(link); err != nil {
+			return nil, err
+		}
+		report.Links = append(report.Links, name)
+	}
+
+	// 3. IP
+	liveIPs := make(map[string]bool)
+	for _, endpoint := range liveEndpoints {
+		liveIPs[endpoint.IpAddress.String()] = true
+	}
+	for _, network := range networks {
+		liveIPs[network.GatewayIP().String()] = true
+		for _, ip := range driver.allocator.Allocated(network.Subnet()) {
+			if liveIPs[ip.String()] {
+				continue
+			}
+			logrus.Infof("pruning orphan ip %s in %s", ip, network.Name)
+			report.IPs = append(report.IPs, ip.String())
+			if err := driver.allocator.Release(network.Subnet(), ip); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return report, nil
+}
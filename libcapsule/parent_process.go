@@ -15,8 +15,8 @@ type ParentProcess interface {
 	// send a SIGKILL to the process and wait for the exit.
 	terminate() error
 
-	// wait waits on the process returning the process state.
-	wait() error
+	// wait waits on the process returning the process exit status.
+	wait() (*ExitStatus, error)
 
 	// startTime returns the process create time.
 	startTime() (uint64, error)
@@ -6,9 +6,11 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/songxinjianqwe/capsule/libcapsule/configs"
 	"github.com/songxinjianqwe/capsule/libcapsule/util"
+	"github.com/songxinjianqwe/capsule/libcapsule/util/console"
 	"github.com/songxinjianqwe/capsule/libcapsule/util/exception"
 	"github.com/songxinjianqwe/capsule/libcapsule/util/proc"
 	"golang.org/x/sys/unix"
+	"io"
 	"os"
 	"os/exec"
 	"strings"
@@ -27,6 +29,14 @@ type ParentAbstractProcess struct {
 	namespacePathMap map[configs.NamespaceType]string
 	// 模板方法模式
 	startHook ParentProcessStartHook
+	// 终端模式下，容器进程通过consoleSocket将pty master发送过来
+	// childConsoleSocket是传给容器进程的另一端，启动后parent需要关闭自己持有的这一份
+	consoleSocket      *os.File
+	childConsoleSocket *os.File
+	console            *console.Console
+	// 后台运行时，容器进程一端的stdio和relay一端的stdio，启动后parent需要关闭
+	childStdio []*os.File
+	relayFiles []*os.File
 }
 
 func (p *ParentAbstractProcess) pid() int {
@@ -38,20 +48,45 @@ func (p *ParentAbstractProcess) terminate() error {
 		return nil
 	}
 	err := p.processCmd.Process.Kill()
-	if err := p.wait(); err == nil {
+	if _, err := p.wait(); err == nil {
 		return err
 	}
 	return err
 }
 
-func (p *ParentAbstractProcess) wait() error {
+/*
+进程以非0的退出码退出不是错误，由调用方根据退出状态决定如何处理
+*/
+func (p *ParentAbstractProcess) wait() (*ExitStatus, error) {
+	// 前台运行时，等待期间代理终端的输入输出
+	if p.console != nil {
+		if err := p.console.Proxy(); err != nil {
+			return nil, err
+		}
+		defer p.console.Close()
+	}
+	if p.process.SigProxy {
+		stopProxy := proxySignals(p)
+		defer stopProxy()
+	}
 	logrus.Infof("starting to wait init process exit")
-	err := p.processCmd.Wait()
-	if err != nil {
-		return err
+	if p.process.Init {
+		// 容器init进程是shim的子进程，只能由shim来wait
+		status, err := shimWait(p.container.containerRoot)
+		if err != nil {
+			return nil, err
+		}
+		logrus.Infof("wait init process exit complete, %s", status)
+		return status, nil
 	}
-	logrus.Infof("wait init process exit complete")
-	return nil
+	if err := p.processCmd.Wait(); err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			return nil, err
+		}
+	}
+	status := newExitStatus(unix.WaitStatus(p.processCmd.ProcessState.Sys().(syscall.WaitStatus)), 0, false)
+	logrus.Infof("wait exec process exit complete, %s", status)
+	return status, nil
 }
 
 func (p *ParentAbstractProcess) startTime() (uint64, error) {
@@ -67,6 +102,10 @@ func (p *ParentAbstractProcess) signal(sig os.Signal) error {
 	if !ok {
 		return exception.NewGenericError(fmt.Errorf("os: unsupported signal type:%v", sig), exception.SignalError)
 	}
+	// 由shim发送，shim可以据此记录容器停止的原因
+	if p.process.Init && shimRunning(p.container.containerRoot) {
+		return shimKill(p.container.containerRoot, s)
+	}
 	return unix.Kill(p.pid(), s)
 }
 
@@ -79,10 +118,25 @@ func (p *ParentAbstractProcess) detach() bool {
 */
 func (p *ParentAbstractProcess) start() error {
 	logrus.Infof("ParentAbstractProcess starting...")
-	if err := p.processCmd.Start(); err != nil {
-		return exception.NewGenericErrorWithContext(err, exception.CmdStartError, "starting init/exec process command")
+	if p.process.Init {
+		// init进程由shim启动
+		if err := p.container.startShim(p); err != nil {
+			return exception.NewGenericErrorWithContext(err, exception.ShimError, "starting shim")
+		}
+		logrus.Infof("INIT PROCESS STARTED BY SHIM")
+	} else {
+		if err := p.processCmd.Start(); err != nil {
+			return exception.NewGenericErrorWithContext(err, exception.CmdStartError, "starting exec process command")
+		}
+		logrus.Infof("EXEC PROCESS STARTED, PID: %d", p.processCmd.Process.Pid)
+	}
+	// 子进程已经持有了这些fd，parent关闭自己的这一份，否则子进程退出时另一端读不到EOF
+	for _, file := range p.processCmd.ExtraFiles {
+		file.Close()
+	}
+	for _, file := range append(p.childStdio, p.relayFiles...) {
+		file.Close()
 	}
-	logrus.Infof("INIT/EXEC PROCESS STARTED, PID: %d", p.pid())
 	if err := p.sendNamespaces(); err != nil {
 		return exception.NewGenericErrorWithContext(err, exception.PipeError, "sending namespacePathMap to init/exec process")
 	}
@@ -140,7 +194,33 @@ func (p *ParentAbstractProcess) sendNamespaces() error {
 	return nil
 }
 
-func (p *ParentAbstractProcess) sendConfigAndClosePipe() error {
+/*
+接收容器进程创建的pty master，需要在容器进程读到config之后调用
+*/
+func (p *ParentAbstractProcess) receiveConsole() error {
+	if p.consoleSocket == nil {
+		return nil
+	}
+	defer p.consoleSocket.Close()
+	master, err := console.RecvFd(p.consoleSocket)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("received pty master: %s", master.Name())
+	if p.process.ConsoleSocket != "" {
+		// 转交给console socket另一端的进程后，parent不再持有pty master
+		defer master.Close()
+		logrus.Infof("sending pty master to console socket: %s", p.process.ConsoleSocket)
+		return console.SendFdToSocket(p.process.ConsoleSocket, master)
+	}
+	p.console = console.NewConsole(master)
+	return nil
+}
+
+/*
+发送config后关闭写的一端，容器进程读到EOF即config结束，但仍然可以通过它向parent回复
+*/
+func (p *ParentAbstractProcess) sendConfig() error {
 	initConfig := &InitExecConfig{
 		ContainerConfig: p.container.config,
 		ProcessConfig:   *p.process,
@@ -155,9 +235,35 @@ func (p *ParentAbstractProcess) sendConfigAndClosePipe() error {
 	if err != nil {
 		return err
 	}
-	// parent 写完就关
-	if err := p.parentConfigPipe.Close(); err != nil {
-		logrus.Errorf("closing parent pipe failed: %s", err.Error())
+	return unix.Shutdown(int(p.parentConfigPipe.Fd()), unix.SHUT_WR)
+}
+
+/*
+等待容器init进程初始化完毕，初始化失败时返回容器init进程回复的错误
+*/
+func (p *ParentAbstractProcess) waitInitReady() error {
+	defer p.parentConfigPipe.Close()
+	if _, err := readSync(p.parentConfigPipe); err != nil {
+		if err == io.EOF {
+			return fmt.Errorf("init process exited without reporting ready")
+		}
+		return err
 	}
 	return nil
 }
+
+/*
+等待exec进程执行命令，执行命令时config pipe随之关闭，读到EOF即成功，失败时返回exec进程回复的错误
+*/
+func (p *ParentAbstractProcess) waitExecStarted() error {
+	defer p.parentConfigPipe.Close()
+	t, err := readSync(p.parentConfigPipe)
+	switch {
+	case err == io.EOF:
+		return nil
+	case err != nil:
+		return err
+	default:
+		return fmt.Errorf("unexpected sync message %q from exec process", t)
+	}
+}
@@ -18,16 +18,26 @@ func execStartHook(p *ParentAbstractProcess) error {
 	}
 
 	// exec process会在启动后阻塞，直至收到config
-	if err := p.sendConfigAndClosePipe(); err != nil {
-		return exception.NewGenericErrorWithContext(err, exception.PipeError, "sending config to init process")
+	if err := p.sendConfig(); err != nil {
+		return exception.NewGenericErrorWithContext(err, exception.PipeError, "sending config to exec process")
+	}
+	// pty master在执行命令之前已经发送到了console socket中，等exec进程执行命令后再接收
+	if err := p.waitExecStarted(); err != nil {
+		return exception.NewGenericErrorWithContext(err, exception.PipeError, "waiting exec process start")
+	}
+
+	if err := p.receiveConsole(); err != nil {
+		return exception.NewGenericErrorWithContext(err, exception.ConsoleError, "receiving pty master")
 	}
 
 	// 如果是detach，则直接结束。
 	if !p.detach() {
 		logrus.Infof("wait child process exit...")
-		if err := p.wait(); err != nil {
+		status, err := p.wait()
+		if err != nil {
 			return exception.NewGenericErrorWithContext(err, exception.CmdWaitError, "waiting child process exit")
 		}
+		p.process.ExitStatus = status
 		logrus.Infof("child process exited")
 	}
 	return nil
@@ -1,12 +1,10 @@
 package libcapsule
 
 import (
-	"fmt"
 	"github.com/sirupsen/logrus"
 	"github.com/songxinjianqwe/capsule/libcapsule/network"
 	"github.com/songxinjianqwe/capsule/libcapsule/util"
 	"github.com/songxinjianqwe/capsule/libcapsule/util/exception"
-	"syscall"
 )
 
 /*
@@ -30,19 +28,20 @@ func initStartHook(p *ParentAbstractProcess) error {
 	}
 
 	// init process会在启动后阻塞，直至收到config
-	if err := p.sendConfigAndClosePipe(); err != nil {
+	if err := p.sendConfig(); err != nil {
 		return exception.NewGenericErrorWithContext(err, exception.PipeError, "sending config to init process")
 	}
 
 	// 等待init process到达在初始化之后，执行命令之前的状态
-	// 使用SIGUSR1信号
-	logrus.Info("start waiting init process ready(SIGUSR1) or fail(SIGCHLD) signal...")
-	sig := util.WaitSignal(syscall.SIGUSR1, syscall.SIGCHLD)
-	if sig == syscall.SIGUSR1 {
-		logrus.Info("received SIGUSR1 signal")
-	} else if sig == syscall.SIGCHLD {
-		logrus.Errorf("received SIGCHLD signal")
-		return fmt.Errorf("init process init failed")
+	// 容器init进程不再是parent的子进程，所以通过config pipe而不是信号来同步
+	logrus.Info("start waiting init process ready...")
+	if err := p.waitInitReady(); err != nil {
+		return exception.NewGenericErrorWithContext(err, exception.PipeError, "waiting init process ready")
+	}
+	logrus.Info("init process is ready")
+	// 容器进程在回复ready之前就已经发送了pty master
+	if err := p.receiveConsole(); err != nil {
+		return exception.NewGenericErrorWithContext(err, exception.ConsoleError, "receiving pty master")
 	}
 	return nil
 }
@@ -57,7 +56,7 @@ func createNetworkInterfaces(p *ParentAbstractProcess) error {
 	var bridge *network.Network
 	bridge, err := network.LoadNetwork("bridge", network.DefaultBridgeName)
 	if err != nil {
-		bridge, err = network.CreateNetwork("bridge", network.DefaultSubnet, network.DefaultBridgeName)
+		bridge, err = network.CreateNetwork("bridge", network.DefaultBridgeName, &network.CreateOptions{Subnet: network.DefaultSubnet})
 		if err != nil {
 			return err
 		}
@@ -67,10 +66,18 @@ func createNetworkInterfaces(p *ParentAbstractProcess) error {
 	// 创建端点
 	endpointConfig := p.container.config.Endpoint
 	logrus.Infof("creating endpoint: %#v", endpointConfig)
-	endpoint, err := network.Connect(endpointConfig.ID, endpointConfig.NetworkName, endpointConfig.PortMappings, p.pid())
+	endpoint, err := network.Connect(endpointConfig.ID, endpointConfig.NetworkName, endpointConfig.PortMappings, endpointConfig.Bandwidth, p.pid())
 	if err != nil {
 		return err
 	}
+	endpoint.ContainerId = p.container.id
+	endpoint.Hostname = p.container.config.Hostname
+	endpoint.Links = endpointConfig.Links
+	endpoint.DNS = endpointConfig.DNS
 	p.container.endpoint = endpoint
+	// 供网络的DNS server解析容器名
+	if err := network.RegisterEndpoint(endpoint); err != nil {
+		return err
+	}
 	return nil
 }
@@ -1,11 +1,12 @@
 package libcapsule
 
 import (
+	"context"
 	"errors"
 	"github.com/sirupsen/logrus"
 	"github.com/songxinjianqwe/capsule/libcapsule/util/proc"
 	"os"
-	"time"
+	"syscall"
 )
 
 func NewParentNoChildProcess(initProcessPid int, initProcessStartTime uint64, c *LinuxContainer) ParentProcess {
@@ -47,23 +48,12 @@ func (p *ParentNoChildProcess) terminate() error {
 	return errors.New("should not be called")
 }
 
-func (p *ParentNoChildProcess) wait() error {
-	// https://stackoverflow.com/questions/1157700/how-to-wait-for-exit-of-non-children-processes
+func (p *ParentNoChildProcess) wait() (*ExitStatus, error) {
 	// 无法使用wait之类的系统调用来等待一个无关进程的结束
-	// 可以轮询 /prod/${pid}/stat
-	// 如果该文件不存在，则说明进程已停止
-	for {
-		<-time.After(time.Millisecond * 100)
-		stat, err := proc.GetProcessStat(p.pid())
-		// 如果出现err，或者进程已经成为僵尸进程，则退出循环
-		if os.IsNotExist(err) {
-			logrus.Infof("%d process exited(/proc/%d/stat not exists)", p.pid(), p.pid())
-			return nil
-		}
-		if err != nil || stat.Status == proc.Zombie {
-			return err
-		}
+	if err := proc.WaitExit(context.Background(), p.pid()); err != nil {
+		return nil, err
 	}
+	return p.container.loadExitStatus()
 }
 
 func (p *ParentNoChildProcess) startTime() (uint64, error) {
@@ -71,6 +61,11 @@ func (p *ParentNoChildProcess) startTime() (uint64, error) {
 }
 
 func (p *ParentNoChildProcess) signal(sig os.Signal) error {
+	// 由shim发送，shim回收容器init进程之前pid不会被复用
+	if s, ok := sig.(syscall.Signal); ok && shimRunning(p.container.containerRoot) {
+		logrus.Infof("send %s to %d via shim", sig, p.pid())
+		return shimKill(p.container.containerRoot, s)
+	}
 	process, err := os.FindProcess(p.pid())
 	if err != nil {
 		return err
@@ -1,5 +1,7 @@
 package libcapsule
 
+import "github.com/songxinjianqwe/capsule/libcapsule/configs"
+
 type Process struct {
 	// The command to be run followed by any arguments.
 	Args []string
@@ -10,12 +12,45 @@ type Process struct {
 	// Cwd will change the processes current working directory inside the container's rootfs.
 	Cwd string
 
+	// User specifies the user to run the process as, user[:group], names are resolved against the container's /etc/passwd and /etc/group
+	User string
+
+	// AdditionalGroups specifies the supplementary groups of the process, names or gids
+	AdditionalGroups []string
+
+	// Umask specifies the umask of the process, nil means inheriting it
+	Umask *uint32
+
+	// Capabilities specifies the capability sets of the process, nil means keeping all capabilities
+	Capabilities *configs.Capabilities
+
+	// NoNewPrivileges sets no_new_privs of the process, execve will not grant privileges any more(setuid, file capabilities)
+	NoNewPrivileges bool
+
+	// OomScoreAdj specifies the oom_score_adj of the process, nil means inheriting it
+	OomScoreAdj *int
+
+	// Rlimits specifies the resource limits of the process
+	Rlimits []configs.Rlimit
+
 	// Init specifies whether the config is the first config in the container.
 	Init bool
 
 	// Detach specifies the container is running frontend or backend
 	Detach bool
 
+	// Terminal specifies whether a pty is allocated for the process
+	Terminal bool
+
+	// ConsoleSocket is the path of a unix socket, the pty master will be sent to it via SCM_RIGHTS
+	ConsoleSocket string
+
+	// SigProxy specifies whether signals received by capsule are forwarded to the process while waiting it in foreground
+	SigProxy bool
+
 	// if init = true, ID is container id, or ID is exec id.
 	ID string
+
+	// ExitStatus is filled after a foreground process exited
+	ExitStatus *ExitStatus `json:"-"`
 }
@@ -0,0 +1,440 @@
+package libcapsule
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/songxinjianqwe/capsule/libcapsule/cgroups"
+	"github.com/songxinjianqwe/capsule/libcapsule/constant"
+	"github.com/songxinjianqwe/capsule/libcapsule/util/filelock"
+	"github.com/songxinjianqwe/capsule/libcapsule/util/proc"
+	"github.com/songxinjianqwe/capsule/libcapsule/util/stdio"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+const shimArg = "shim"
+
+/*
+传给shim进程的fd，依次在stdin、stdout、stderr之后:
+1. 控制socket的listener
+2. 容器进程的stdin、stdout、stderr
+3. 如果后台运行，则是relay一端的stdin、stdout、stderr和attach socket的listener
+4. 容器进程的ExtraFiles，即config pipe和console socket
+*/
+const (
+	shimListenerFd = constant.DefaultStdFdCount + iota
+	shimContainerStdinFd
+	shimContainerStdoutFd
+	shimContainerStderrFd
+	shimRelayStdinFd
+	shimRelayStdoutFd
+	shimRelayStderrFd
+	shimRelayListenerFd
+)
+
+/*
+shim启动容器进程(capsule init)所需的信息，通过环境变量传给shim
+*/
+type ShimConfig struct {
+	Args []string `json:"args"`
+	Env  []string `json:"env"`
+	Dir  string   `json:"dir"`
+	// 是否有relay的fd
+	Relay bool `json:"relay"`
+	// 容器进程的ExtraFiles的数量
+	ExtraFileCount int `json:"extra_file_count"`
+}
+
+func (config *ShimConfig) fdCount() int {
+	if config.Relay {
+		return shimRelayListenerFd - constant.DefaultStdFdCount + 1 + config.ExtraFileCount
+	}
+	return shimContainerStderrFd - constant.DefaultStdFdCount + 1 + config.ExtraFileCount
+}
+
+/*
+每个容器一个shim进程，在create时启动，由它来启动容器进程(capsule init)
+nsexec以CLONE_PARENT clone出容器init进程，所以容器init进程也是shim的子进程，shim负责:
+1. 作为subreaper回收容器init进程，记录退出码
+2. 后台运行时，持有容器的stdio，并通过relay提供attach
+3. 提供控制socket，支持wait、kill、resize
+与DNS server一样，shim需要在parent退出后继续存活，所以先同步执行 capsule shim --daemon，由它再启动真正的shim
+*/
+func (c *LinuxContainer) startShim(p *ParentAbstractProcess) error {
+	cmd := p.processCmd
+	socketPath := filepath.Join(c.containerRoot, constant.ContainerShimSocketFilename)
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// 在这里就开始监听，parent返回后即可连接
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
+	if err != nil {
+		return err
+	}
+	listener.SetUnlinkOnClose(false)
+	defer listener.Close()
+	listenerFile, err := listener.File()
+	if err != nil {
+		return err
+	}
+	defer listenerFile.Close()
+
+	shimFiles := []*os.File{listenerFile}
+	for _, std := range []interface{}{cmd.Stdin, cmd.Stdout, cmd.Stderr} {
+		file, ok := std.(*os.File)
+		if !ok {
+			return fmt.Errorf("stdio of container process must be a file, got %T", std)
+		}
+		shimFiles = append(shimFiles, file)
+	}
+	shimFiles = append(shimFiles, p.relayFiles...)
+	shimFiles = append(shimFiles, cmd.ExtraFiles...)
+	config := &ShimConfig{
+		Args:           cmd.Args,
+		Env:            cmd.Env,
+		Dir:            cmd.Dir,
+		Relay:          len(p.relayFiles) > 0,
+		ExtraFileCount: len(cmd.ExtraFiles),
+	}
+	bytes, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("starting shim of container %s, config: %#v", c.id, config)
+	shimCmd := exec.Command(constant.ContainerInitCmd, "--root", c.runtimeRoot, shimArg, "--daemon", c.id)
+	shimCmd.ExtraFiles = shimFiles
+	shimCmd.Env = append(os.Environ(), fmt.Sprintf("%s=%s", constant.EnvShimConfig, string(bytes)))
+	if output, err := shimCmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("start shim failed, cause: %s, output: %s", err.Error(), string(output))
+	}
+	return nil
+}
+
+/*
+由 capsule shim --daemon 调用，在新的session中启动shim，fd原样传下去
+*/
+func StartShimDaemon(runtimeRoot string, id string) error {
+	config, err := loadShimConfig()
+	if err != nil {
+		return err
+	}
+	containerRoot := filepath.Join(runtimeRoot, constant.ContainerDir, id)
+	logFile, err := os.OpenFile(filepath.Join(containerRoot, constant.ContainerShimLogFilename), os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+	cmd := exec.Command(constant.ContainerInitCmd, "--root", runtimeRoot, shimArg, id)
+	for i := 0; i < config.fdCount(); i++ {
+		fd := constant.DefaultStdFdCount + i
+		cmd.ExtraFiles = append(cmd.ExtraFiles, os.NewFile(uintptr(fd), fmt.Sprintf("shim-%d", fd)))
+	}
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
+
+func loadShimConfig() (*ShimConfig, error) {
+	config := &ShimConfig{}
+	if err := json.Unmarshal([]byte(os.Getenv(constant.EnvShimConfig)), config); err != nil {
+		return nil, fmt.Errorf("invalid shim config, cause: %s", err.Error())
+	}
+	return config, nil
+}
+
+type shim struct {
+	id            string
+	containerRoot string
+	mutex         sync.Mutex
+	initPid       int
+	// 通过kill发给容器init进程的最后一个信号，用来判断容器停止的原因
+	killSignal unix.Signal
+	// 容器init进程退出后关闭
+	exited     chan struct{}
+	exitStatus *ExitStatus
+	// 正在处理的请求，shim退出之前要等它们都回复完
+	handlers sync.WaitGroup
+}
+
+/*
+阻塞运行，由 capsule shim $containerId 调用，容器init进程退出且stdio转发完毕后返回
+*/
+func ServeShim(runtimeRoot string, id string) error {
+	config, err := loadShimConfig()
+	if err != nil {
+		return err
+	}
+	if err := unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0); err != nil {
+		return err
+	}
+	s := &shim{
+		id:            id,
+		containerRoot: filepath.Join(runtimeRoot, constant.ContainerDir, id),
+		exited:        make(chan struct{}),
+	}
+	listener, err := net.FileListener(os.NewFile(shimListenerFd, "shim-listener"))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(filepath.Join(s.containerRoot, constant.ContainerShimSocketFilename))
+	defer listener.Close()
+	go s.accept(listener)
+
+	relayDone := make(chan error, 1)
+	if config.Relay {
+		logFile, err := os.OpenFile(filepath.Join(s.containerRoot, constant.ContainerInitLogFilename), os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		defer logFile.Close()
+		relayListener, err := net.FileListener(os.NewFile(shimRelayListenerFd, "relay-listener"))
+		if err != nil {
+			return err
+		}
+		defer os.Remove(filepath.Join(s.containerRoot, constant.ContainerAttachSocketFilename))
+		relay := stdio.NewRelay(relayListener, logFile, os.NewFile(shimRelayStdinFd, "relay-stdin"))
+		go func() {
+			relayDone <- relay.Serve(os.NewFile(shimRelayStdoutFd, "relay-stdout"), os.NewFile(shimRelayStderrFd, "relay-stderr"))
+		}()
+	} else {
+		relayDone <- nil
+	}
+
+	// 启动容器进程
+	cmd := exec.Command(config.Args[0], config.Args[1:]...)
+	cmd.Env = config.Env
+	cmd.Dir = config.Dir
+	cmd.Stdin = os.NewFile(shimContainerStdinFd, "container-stdin")
+	cmd.Stdout = os.NewFile(shimContainerStdoutFd, "container-stdout")
+	cmd.Stderr = os.NewFile(shimContainerStderrFd, "container-stderr")
+	extraFileStart := shimContainerStderrFd + 1
+	if config.Relay {
+		extraFileStart = shimRelayListenerFd + 1
+	}
+	for i := 0; i < config.ExtraFileCount; i++ {
+		cmd.ExtraFiles = append(cmd.ExtraFiles, os.NewFile(uintptr(extraFileStart+i), fmt.Sprintf("container-extra-%d", i)))
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// 只有容器进程持有这些fd，parent才能在容器进程退出时读到EOF
+	for _, file := range append([]*os.File{cmd.Stdin.(*os.File), cmd.Stdout.(*os.File), cmd.Stderr.(*os.File)}, cmd.ExtraFiles...) {
+		file.Close()
+	}
+	logrus.Infof("container process started, pid: %d", cmd.Process.Pid)
+	if err := s.reap(cmd.Process.Pid); err != nil {
+		return err
+	}
+	err = <-relayDone
+	listener.Close()
+	s.handlers.Wait()
+	return err
+}
+
+/*
+回收所有子进程，直至容器init进程退出
+capsule init(nsexec)在clone出容器init进程后就会退出，它退出时容器init进程一定已经是shim的子进程了
+*/
+func (s *shim) reap(bootstrapPid int) error {
+	exited := make(map[int]unix.WaitStatus)
+	for {
+		var waitStatus unix.WaitStatus
+		pid, err := unix.Wait4(-1, &waitStatus, 0, nil)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if pid == bootstrapPid {
+			logrus.Infof("bootstrap process %d exited, status: %d", pid, waitStatus.ExitStatus())
+			initPid, err := s.findInitPid(exited)
+			if err != nil {
+				return err
+			}
+			s.mutex.Lock()
+			s.initPid = initPid
+			s.mutex.Unlock()
+			logrus.Infof("container init process pid: %d", initPid)
+			if status, ok := exited[initPid]; ok {
+				return s.recordExit(status)
+			}
+			continue
+		}
+		if s.initPid == 0 {
+			exited[pid] = waitStatus
+			continue
+		}
+		if pid == s.initPid {
+			return s.recordExit(waitStatus)
+		}
+		// subreaper会收养容器中的孤儿进程
+		logrus.Infof("reaped orphan process %d", pid)
+	}
+}
+
+/*
+容器init进程是shim除了capsule init之外唯一的子进程，有可能已经被回收了
+*/
+func (s *shim) findInitPid(exited map[int]unix.WaitStatus) (int, error) {
+	for pid := range exited {
+		return pid, nil
+	}
+	dirs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return 0, err
+	}
+	for _, dir := range dirs {
+		pid, err := strconv.Atoi(dir.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := proc.GetProcessStat(pid)
+		if err != nil {
+			continue
+		}
+		if stat.PPid == os.Getpid() {
+			return pid, nil
+		}
+	}
+	return 0, fmt.Errorf("container init process not found, bootstrap process may have failed")
+}
+
+func (s *shim) recordExit(waitStatus unix.WaitStatus) error {
+	s.mutex.Lock()
+	killSignal := s.killSignal
+	s.mutex.Unlock()
+	statePath := filepath.Join(s.containerRoot, constant.StateFilename)
+	// 容器有可能已经被删除了，此时只能把退出状态返回给wait的调用方，不能再创建容器目录
+	if _, err := os.Stat(s.containerRoot); err != nil {
+		logrus.Warnf("container root is not accessible, cause: %s", err.Error())
+		s.setExitStatus(newExitStatus(waitStatus, killSignal, false))
+		return nil
+	}
+	fileLock, err := filelock.LockExisting(statePath)
+	if err != nil {
+		logrus.Warnf("lock state failed, cause: %s", err.Error())
+		s.setExitStatus(newExitStatus(waitStatus, killSignal, false))
+		return nil
+	}
+	defer fileLock.Unlock()
+	state, err := loadStateStorage(statePath)
+	if err != nil {
+		logrus.Warnf("load state failed, cause: %s", err.Error())
+		s.setExitStatus(newExitStatus(waitStatus, killSignal, false))
+		return nil
+	}
+	oomKillCount, err := cgroups.NewCroupManager(s.id, state.CgroupPaths).OOMKillCount()
+	if err != nil {
+		logrus.Warnf("read oom kill count failed, cause: %s", err.Error())
+	}
+	status := newExitStatus(waitStatus, killSignal, oomKillCount > 0)
+	state.ExitStatus = status
+	// 写完state之后才唤醒wait的调用方，destroy在wait返回之后才会删除容器目录
+	defer s.setExitStatus(status)
+	bytes, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := filelock.WriteFileAtomic(statePath, bytes, 0644); err != nil {
+		logrus.Warnf("save exit status failed, cause: %s", err.Error())
+	}
+	return nil
+}
+
+func (s *shim) setExitStatus(status *ExitStatus) {
+	logrus.Infof("container init process exited, %s", status)
+	s.mutex.Lock()
+	s.exitStatus = status
+	s.mutex.Unlock()
+	close(s.exited)
+}
+
+func (s *shim) accept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		s.handlers.Add(1)
+		go func() {
+			defer s.handlers.Done()
+			s.handle(conn)
+		}()
+	}
+}
+
+func (s *shim) handle(conn net.Conn) {
+	defer conn.Close()
+	request := &shimRequest{}
+	if err := json.NewDecoder(conn).Decode(request); err != nil {
+		logrus.Warnf("decode shim request failed, cause: %s", err.Error())
+		return
+	}
+	logrus.Infof("received shim request: %#v", request)
+	response := &shimResponse{}
+	if err := s.execute(request, response); err != nil {
+		response.Error = err.Error()
+	}
+	if err := json.NewEncoder(conn).Encode(response); err != nil {
+		logrus.Warnf("encode shim response failed, cause: %s", err.Error())
+	}
+}
+
+func (s *shim) execute(request *shimRequest, response *shimResponse) error {
+	switch request.Action {
+	case shimActionWait:
+		<-s.exited
+		response.ExitStatus = s.exitStatus
+		return nil
+	case shimActionKill:
+		pid, err := s.runningInitPid()
+		if err != nil {
+			return err
+		}
+		if request.Signal != 0 {
+			s.mutex.Lock()
+			s.killSignal = unix.Signal(request.Signal)
+			s.mutex.Unlock()
+		}
+		return unix.Kill(pid, unix.Signal(request.Signal))
+	case shimActionResize:
+		pid, err := s.runningInitPid()
+		if err != nil {
+			return err
+		}
+		// 容器init进程的stdin即pty的slave，对slave设置窗口大小与对master设置效果相同
+		slave, err := os.OpenFile(fmt.Sprintf("/proc/%d/fd/0", pid), os.O_RDWR, 0)
+		if err != nil {
+			return err
+		}
+		defer slave.Close()
+		return unix.IoctlSetWinsize(int(slave.Fd()), unix.TIOCSWINSZ, &unix.Winsize{Row: request.Height, Col: request.Width})
+	default:
+		return fmt.Errorf("unknown shim action %q", request.Action)
+	}
+}
+
+func (s *shim) runningInitPid() (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.initPid == 0 {
+		return 0, fmt.Errorf("container init process not started")
+	}
+	if s.exitStatus != nil {
+		return 0, fmt.Errorf("container init process already exited")
+	}
+	return s.initPid, nil
+}
@@ -0,0 +1,84 @@
+package libcapsule
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/songxinjianqwe/capsule/libcapsule/constant"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+const (
+	shimActionWait   = "wait"
+	shimActionKill   = "kill"
+	shimActionResize = "resize"
+)
+
+/*
+shim控制socket的请求和响应，每个连接一个请求
+*/
+type shimRequest struct {
+	Action string `json:"action"`
+	Signal int    `json:"signal,omitempty"`
+	Width  uint16 `json:"width,omitempty"`
+	Height uint16 `json:"height,omitempty"`
+}
+
+type shimResponse struct {
+	Error      string      `json:"error,omitempty"`
+	ExitStatus *ExitStatus `json:"exit_status,omitempty"`
+}
+
+func shimSocketPath(containerRoot string) string {
+	return filepath.Join(containerRoot, constant.ContainerShimSocketFilename)
+}
+
+/*
+shim在容器init进程退出后就不再运行了
+*/
+func shimRunning(containerRoot string) bool {
+	_, err := os.Stat(shimSocketPath(containerRoot))
+	return err == nil
+}
+
+func callShim(containerRoot string, request *shimRequest) (*shimResponse, error) {
+	conn, err := net.Dial("unix", shimSocketPath(containerRoot))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := json.NewEncoder(conn).Encode(request); err != nil {
+		return nil, err
+	}
+	response := &shimResponse{}
+	if err := json.NewDecoder(conn).Decode(response); err != nil {
+		return nil, err
+	}
+	if response.Error != "" {
+		return nil, errors.New(response.Error)
+	}
+	return response, nil
+}
+
+/*
+阻塞直至容器init进程退出，返回其退出状态
+*/
+func shimWait(containerRoot string) (*ExitStatus, error) {
+	response, err := callShim(containerRoot, &shimRequest{Action: shimActionWait})
+	if err != nil {
+		return nil, err
+	}
+	return response.ExitStatus, nil
+}
+
+func shimKill(containerRoot string, sig syscall.Signal) error {
+	_, err := callShim(containerRoot, &shimRequest{Action: shimActionKill, Signal: int(sig)})
+	return err
+}
+
+func shimResize(containerRoot string, width uint16, height uint16) error {
+	_, err := callShim(containerRoot, &shimRequest{Action: shimActionResize, Width: width, Height: height})
+	return err
+}
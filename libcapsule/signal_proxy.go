@@ -0,0 +1,42 @@
+package libcapsule
+
+import (
+	"github.com/sirupsen/logrus"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+/*
+前台运行时，将capsule进程收到的信号(比如ctrl-c的SIGINT、systemd发来的SIGTERM)转发给容器进程
+返回的函数用于停止转发
+*/
+func proxySignals(parent ParentProcess) func() {
+	signals := make(chan os.Signal, 128)
+	// 不指定信号即接收所有可以捕获的信号
+	signal.Notify(signals)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case sig := <-signals:
+				switch sig {
+				// SIGCHLD是capsule自己的子进程，SIGURG是go runtime用来抢占goroutine的
+				// SIGWINCH由console处理，SIGPIPE是capsule自己的管道
+				case syscall.SIGCHLD, syscall.SIGURG, syscall.SIGWINCH, syscall.SIGPIPE:
+					continue
+				}
+				logrus.Infof("forwarding %s to container process %d", sig, parent.pid())
+				if err := parent.signal(sig); err != nil {
+					logrus.Warnf("forward %s failed, cause: %s", sig, err.Error())
+				}
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
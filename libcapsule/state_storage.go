@@ -1,8 +1,10 @@
 package libcapsule
 
 import (
+	"encoding/json"
 	"github.com/songxinjianqwe/capsule/libcapsule/configs"
 	"github.com/songxinjianqwe/capsule/libcapsule/network"
+	"os"
 	"time"
 )
 
@@ -33,4 +35,20 @@ type StateStorage struct {
 
 	// Endpoint is container veth
 	Endpoint *network.Endpoint `json:"endpoint"`
+
+	// ExitStatus is how the init process ended, recorded by the shim after the init process exited.
+	ExitStatus *ExitStatus `json:"exit_status,omitempty"`
+}
+
+func loadStateStorage(stateFilePath string) (*StateStorage, error) {
+	f, err := os.Open(stateFilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var state *StateStorage
+	if err := json.NewDecoder(f).Decode(&state); err != nil {
+		return nil, err
+	}
+	return state, nil
 }
@@ -57,10 +57,17 @@ func destroy(c *LinuxContainer) (err error) {
 			logrus.Warnf("destroy endpoint failed, cause: %s", err.Error())
 		}
 	}
+	// shim可能还在写退出状态，等它写完再删除容器目录，否则shim会重新创建出容器目录
+	if shimRunning(c.containerRoot) {
+		logrus.Infof("waiting for shim to record exit status...")
+		if _, err := shimWait(c.containerRoot); err != nil {
+			logrus.Warnf("wait shim failed, cause: %s", err.Error())
+		}
+	}
 	logrus.Infof("removing container root files...")
 	removeErr := os.RemoveAll(c.containerRoot)
 	if removeErr != nil {
-		logrus.Warnf("remove container root runtime files failed, cause: %s", err.Error())
+		logrus.Warnf("remove container root runtime files failed, cause: %s", removeErr.Error())
 		err = removeErr
 	}
 	c.parentProcess = nil
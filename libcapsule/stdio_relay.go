@@ -0,0 +1,61 @@
+package libcapsule
+
+import (
+	"fmt"
+	"github.com/songxinjianqwe/capsule/libcapsule/constant"
+	"github.com/songxinjianqwe/capsule/libcapsule/util/stdio"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+/*
+后台运行的容器，stdio连接到shim中的relay，而不是直接写日志文件，这样之后可以通过capsule attach连接上来
+返回容器进程一端的stdio和relay一端的stdio+attach socket的listener，都需要在shim启动后关闭
+*/
+func (c *LinuxContainer) newStdioRelay(cmd *exec.Cmd) ([]*os.File, []*os.File, error) {
+	stdinReader, stdinWriter, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	stdoutReader, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	stderrReader, stderrWriter, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	socketPath := filepath.Join(c.containerRoot, constant.ContainerAttachSocketFilename)
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	// 在这里就开始监听，parent返回后即可attach
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
+	if err != nil {
+		return nil, nil, err
+	}
+	listener.SetUnlinkOnClose(false)
+	defer listener.Close()
+	listenerFile, err := listener.File()
+	if err != nil {
+		return nil, nil, err
+	}
+	cmd.Stdin = stdinReader
+	cmd.Stdout = stdoutWriter
+	cmd.Stderr = stderrWriter
+	return []*os.File{stdinReader, stdoutWriter, stderrWriter}, []*os.File{stdinWriter, stdoutReader, stderrReader, listenerFile}, nil
+}
+
+/*
+连接到后台运行的容器的stdio，detach或容器的输出结束时返回
+*/
+func (c *LinuxContainer) Attach(stdin io.Reader, detachKeys []byte) error {
+	socketPath := filepath.Join(c.containerRoot, constant.ContainerAttachSocketFilename)
+	if _, err := os.Stat(socketPath); err != nil {
+		return fmt.Errorf("container %s has no stdio relay, only containers run with --detach can be attached", c.id)
+	}
+	return stdio.Attach(socketPath, stdin, detachKeys)
+}
@@ -0,0 +1,62 @@
+package libcapsule
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/songxinjianqwe/capsule/libcapsule/util/exception"
+	"io"
+)
+
+type syncType string
+
+/*
+容器进程读完config之后，通过config pipe(socketpair)回复给parent的消息，每条消息是一个JSON对象
+init进程: 初始化完毕时回复ready，失败时回复error
+exec进程: 失败时回复error，成功时不回复，执行命令时config pipe随之关闭，parent读到EOF
+*/
+const (
+	syncReady syncType = "ready"
+	syncError syncType = "error"
+)
+
+type syncMessage struct {
+	Type  syncType                `json:"type"`
+	Error *exception.GenericError `json:"error,omitempty"`
+}
+
+func writeSync(pipe io.Writer, t syncType) error {
+	return json.NewEncoder(pipe).Encode(&syncMessage{Type: t})
+}
+
+/*
+把容器进程中的错误原样交给parent，错误码和上下文都会保留
+*/
+func writeSyncError(pipe io.Writer, err error) error {
+	genericError, ok := exception.NewGenericError(err, exception.InitializerRunError).(*exception.GenericError)
+	if !ok {
+		genericError = &exception.GenericError{ErrorCode: exception.InitializerRunError, Message: err.Error()}
+	}
+	return json.NewEncoder(pipe).Encode(&syncMessage{Type: syncError, Error: genericError})
+}
+
+/*
+读取一条消息，容器进程回复的是error时返回其中的错误
+容器进程没有回复就退出了(或者exec进程已经执行了命令)时返回io.EOF
+*/
+func readSync(pipe io.Reader) (syncType, error) {
+	message := &syncMessage{}
+	if err := json.NewDecoder(pipe).Decode(message); err != nil {
+		return "", err
+	}
+	switch message.Type {
+	case syncReady:
+		return message.Type, nil
+	case syncError:
+		if message.Error == nil {
+			return "", fmt.Errorf("container process reported an error without detail")
+		}
+		return message.Type, message.Error
+	default:
+		return "", fmt.Errorf("unexpected sync message %q from container process", message.Type)
+	}
+}
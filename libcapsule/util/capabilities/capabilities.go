@@ -0,0 +1,322 @@
+package capabilities
+
+import (
+	"fmt"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/sirupsen/logrus"
+	"github.com/songxinjianqwe/capsule/libcapsule/configs"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// capget/capset的版本3，支持64个capability
+const linuxCapabilityVersion3 = 0x20080522
+
+/*
+capability的名字与编号，见linux/capability.h
+*/
+var capabilityList = []string{
+	"CAP_CHOWN",
+	"CAP_DAC_OVERRIDE",
+	"CAP_DAC_READ_SEARCH",
+	"CAP_FOWNER",
+	"CAP_FSETID",
+	"CAP_KILL",
+	"CAP_SETGID",
+	"CAP_SETUID",
+	"CAP_SETPCAP",
+	"CAP_LINUX_IMMUTABLE",
+	"CAP_NET_BIND_SERVICE",
+	"CAP_NET_BROADCAST",
+	"CAP_NET_ADMIN",
+	"CAP_NET_RAW",
+	"CAP_IPC_LOCK",
+	"CAP_IPC_OWNER",
+	"CAP_SYS_MODULE",
+	"CAP_SYS_RAWIO",
+	"CAP_SYS_CHROOT",
+	"CAP_SYS_PTRACE",
+	"CAP_SYS_PACCT",
+	"CAP_SYS_ADMIN",
+	"CAP_SYS_BOOT",
+	"CAP_SYS_NICE",
+	"CAP_SYS_RESOURCE",
+	"CAP_SYS_TIME",
+	"CAP_SYS_TTY_CONFIG",
+	"CAP_MKNOD",
+	"CAP_LEASE",
+	"CAP_AUDIT_WRITE",
+	"CAP_AUDIT_CONTROL",
+	"CAP_SETFCAP",
+	"CAP_MAC_OVERRIDE",
+	"CAP_MAC_ADMIN",
+	"CAP_SYSLOG",
+	"CAP_WAKE_ALARM",
+	"CAP_BLOCK_SUSPEND",
+	"CAP_AUDIT_READ",
+	"CAP_PERFMON",
+	"CAP_BPF",
+	"CAP_CHECKPOINT_RESTORE",
+}
+
+/*
+容器进程默认拥有的capability，与docker一致
+默认不设置inheritable，否则以非root用户执行带有file capability的程序时会得到这些capability
+*/
+var DefaultCapabilities = []string{
+	"CAP_CHOWN",
+	"CAP_DAC_OVERRIDE",
+	"CAP_FSETID",
+	"CAP_FOWNER",
+	"CAP_MKNOD",
+	"CAP_NET_RAW",
+	"CAP_SETGID",
+	"CAP_SETUID",
+	"CAP_SETFCAP",
+	"CAP_SETPCAP",
+	"CAP_NET_BIND_SERVICE",
+	"CAP_SYS_CHROOT",
+	"CAP_KILL",
+	"CAP_AUDIT_WRITE",
+}
+
+/*
+spec中默认的capability
+*/
+func DefaultSpecCapabilities() *specs.LinuxCapabilities {
+	return &specs.LinuxCapabilities{
+		Bounding:  append([]string(nil), DefaultCapabilities...),
+		Effective: append([]string(nil), DefaultCapabilities...),
+		Permitted: append([]string(nil), DefaultCapabilities...),
+	}
+}
+
+/*
+CAP_CHOWN、chown、CHOWN都转为CAP_CHOWN
+*/
+func Normalize(name string) string {
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "CAP_") {
+		name = "CAP_" + name
+	}
+	return name
+}
+
+func capabilityValue(name string) (int, error) {
+	name = Normalize(name)
+	for value, capability := range capabilityList {
+		if capability == name {
+			return value, nil
+		}
+	}
+	return -1, fmt.Errorf("unknown capability %q", name)
+}
+
+/*
+--cap-add/--cap-drop，ALL表示所有capability
+先drop再add，bounding、effective、permitted都会调整，inheritable和ambient只会drop
+caps为nil表示容器进程拥有所有capability(inheritable为空)
+*/
+func Adjust(caps *specs.LinuxCapabilities, add []string, drop []string) (*specs.LinuxCapabilities, error) {
+	if len(add) == 0 && len(drop) == 0 {
+		return caps, nil
+	}
+	for _, name := range append(append([]string(nil), add...), drop...) {
+		if strings.ToUpper(name) == "ALL" {
+			continue
+		}
+		if _, err := capabilityValue(name); err != nil {
+			return nil, err
+		}
+	}
+	if caps == nil {
+		caps = &specs.LinuxCapabilities{
+			Bounding:  capabilityList,
+			Effective: capabilityList,
+			Permitted: capabilityList,
+		}
+	}
+	return &specs.LinuxCapabilities{
+		Bounding:    adjustSet(caps.Bounding, add, drop),
+		Effective:   adjustSet(caps.Effective, add, drop),
+		Permitted:   adjustSet(caps.Permitted, add, drop),
+		Inheritable: adjustSet(caps.Inheritable, nil, drop),
+		Ambient:     adjustSet(caps.Ambient, nil, drop),
+	}, nil
+}
+
+func adjustSet(set []string, add []string, drop []string) []string {
+	result := make([]string, 0, len(set))
+	dropped := make(map[string]bool)
+	for _, name := range drop {
+		dropped[Normalize(name)] = true
+	}
+	if !dropped["CAP_ALL"] {
+		for _, name := range set {
+			if !dropped[Normalize(name)] {
+				result = append(result, Normalize(name))
+			}
+		}
+	}
+	for _, name := range add {
+		if Normalize(name) == "CAP_ALL" {
+			return append([]string(nil), capabilityList...)
+		}
+		if !contains(result, Normalize(name)) {
+			result = append(result, Normalize(name))
+		}
+	}
+	return result
+}
+
+func contains(set []string, name string) bool {
+	for _, s := range set {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+解析后的各个capability集合
+capability是线程级别的，调用方需要保证设置capability和执行命令在同一个线程中(runtime.LockOSThread)
+*/
+type Caps struct {
+	bounding    []int
+	effective   []int
+	inheritable []int
+	permitted   []int
+	ambient     []int
+}
+
+func New(config *configs.Capabilities) (*Caps, error) {
+	lastCap, err := lastCapability()
+	if err != nil {
+		return nil, err
+	}
+	caps := &Caps{}
+	for _, set := range []struct {
+		names []string
+		dest  *[]int
+	}{
+		{config.Bounding, &caps.bounding},
+		{config.Effective, &caps.effective},
+		{config.Inheritable, &caps.inheritable},
+		{config.Permitted, &caps.permitted},
+		{config.Ambient, &caps.ambient},
+	} {
+		for _, name := range set.names {
+			value, err := capabilityValue(name)
+			if err != nil {
+				return nil, err
+			}
+			// 内核不支持的capability直接忽略
+			if value > lastCap {
+				logrus.Warnf("capability %s is not supported by the kernel, ignored", name)
+				continue
+			}
+			// 当前进程的bounding set中没有的capability无论如何也拿不到，capset会失败，同样忽略
+			if inBounding, _, errno := unix.Syscall(unix.SYS_PRCTL, unix.PR_CAPBSET_READ, uintptr(value), 0); errno == 0 && inBounding == 0 {
+				logrus.Warnf("capability %s is not in the bounding set of capsule, ignored", name)
+				continue
+			}
+			*set.dest = append(*set.dest, value)
+		}
+	}
+	return caps, nil
+}
+
+/*
+从bounding set中去掉不需要的capability，需要CAP_SETPCAP，所以要在切换用户之前调用
+*/
+func (c *Caps) ApplyBoundingSet() error {
+	lastCap, err := lastCapability()
+	if err != nil {
+		return err
+	}
+	for value := 0; value <= lastCap; value++ {
+		if containsValue(c.bounding, value) {
+			continue
+		}
+		if err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(value), 0, 0, 0); err != nil {
+			// 已经不在bounding set中的capability会返回EINVAL
+			if err == unix.EINVAL {
+				continue
+			}
+			return fmt.Errorf("dropping bounding capability %s: %s", capabilityName(value), err.Error())
+		}
+	}
+	return nil
+}
+
+/*
+设置effective、permitted、inheritable，然后设置ambient
+ambient中的capability必须同时在permitted和inheritable中
+*/
+func (c *Caps) ApplyCaps() error {
+	header := struct {
+		version uint32
+		pid     int32
+	}{version: linuxCapabilityVersion3}
+	var data [2]struct {
+		effective   uint32
+		permitted   uint32
+		inheritable uint32
+	}
+	for _, value := range c.effective {
+		data[value/32].effective |= 1 << uint(value%32)
+	}
+	for _, value := range c.permitted {
+		data[value/32].permitted |= 1 << uint(value%32)
+	}
+	for _, value := range c.inheritable {
+		data[value/32].inheritable |= 1 << uint(value%32)
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("capset: %s", errno.Error())
+	}
+	if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0); err != nil {
+		// 4.3之前的内核不支持ambient
+		if err == unix.EINVAL && len(c.ambient) == 0 {
+			return nil
+		}
+		return fmt.Errorf("clearing ambient capabilities: %s", err.Error())
+	}
+	for _, value := range c.ambient {
+		if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_RAISE, uintptr(value), 0, 0); err != nil {
+			return fmt.Errorf("raising ambient capability %s: %s", capabilityList[value], err.Error())
+		}
+	}
+	return nil
+}
+
+func capabilityName(value int) string {
+	if value < len(capabilityList) {
+		return capabilityList[value]
+	}
+	return strconv.Itoa(value)
+}
+
+func containsValue(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+内核支持的最大的capability编号，有可能比capsule认识的还要新
+*/
+func lastCapability() (int, error) {
+	bytes, err := ioutil.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(bytes)))
+}
@@ -0,0 +1,102 @@
+package console
+
+import (
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// 容器进程退出后，最多等待这么久把pty中剩余的输出转发完
+const outputDrainTimeout = time.Second
+
+/*
+宿主机一侧的终端，持有容器中pty的master
+*/
+type Console struct {
+	master *os.File
+	// 宿主机终端原来的属性，Close时恢复
+	hostTermios *unix.Termios
+	winch       chan os.Signal
+	outputDone  chan struct{}
+}
+
+func NewConsole(master *os.File) *Console {
+	return &Console{
+		master: master,
+		winch:  make(chan os.Signal, 1),
+	}
+}
+
+/*
+如果stdin是终端，则将其设置为raw模式，由容器中的pty负责回显、行编辑、信号等
+然后开始在宿主机的stdin/stdout与master之间转发数据，并将宿主机终端的窗口大小同步给pty
+*/
+func (console *Console) Proxy() error {
+	stdinFd := int(os.Stdin.Fd())
+	if termios, err := unix.IoctlGetTermios(stdinFd, unix.TCGETS); err == nil {
+		raw := *termios
+		MakeRaw(&raw)
+		if err := unix.IoctlSetTermios(stdinFd, unix.TCSETS, &raw); err != nil {
+			return err
+		}
+		console.hostTermios = termios
+		console.resize()
+		signal.Notify(console.winch, unix.SIGWINCH)
+		go func() {
+			for range console.winch {
+				console.resize()
+			}
+		}()
+	}
+	console.outputDone = make(chan struct{})
+	go io.Copy(console.master, os.Stdin)
+	go func() {
+		// 容器中所有持有slave的进程退出后，读master会返回EIO
+		io.Copy(os.Stdout, console.master)
+		close(console.outputDone)
+	}()
+	return nil
+}
+
+func (console *Console) Close() error {
+	if console.outputDone != nil {
+		select {
+		case <-console.outputDone:
+		case <-time.After(outputDrainTimeout):
+		}
+	}
+	signal.Stop(console.winch)
+	close(console.winch)
+	if console.hostTermios != nil {
+		if err := unix.IoctlSetTermios(int(os.Stdin.Fd()), unix.TCSETS, console.hostTermios); err != nil {
+			logrus.Warnf("restore terminal failed, cause: %s", err.Error())
+		}
+	}
+	return console.master.Close()
+}
+
+func (console *Console) resize() {
+	winsize, err := unix.IoctlGetWinsize(int(os.Stdin.Fd()), unix.TIOCGWINSZ)
+	if err != nil {
+		return
+	}
+	if err := unix.IoctlSetWinsize(int(console.master.Fd()), unix.TIOCSWINSZ, winsize); err != nil {
+		logrus.Warnf("resize pty failed, cause: %s", err.Error())
+	}
+}
+
+/*
+同cfmakeraw(3)
+*/
+func MakeRaw(termios *unix.Termios) {
+	termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	termios.Oflag &^= unix.OPOST
+	termios.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	termios.Cflag &^= unix.CSIZE | unix.PARENB
+	termios.Cflag |= unix.CS8
+	termios.Cc[unix.VMIN] = 1
+	termios.Cc[unix.VTIME] = 0
+}
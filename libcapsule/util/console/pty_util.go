@@ -0,0 +1,109 @@
+package console
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"net"
+	"os"
+	"syscall"
+)
+
+/*
+在当前的mount namespace中打开/dev/ptmx，创建一对pty
+返回master和slave的路径，比如/dev/pts/0
+*/
+func OpenPty() (*os.File, string, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	// unlockpt
+	if err := unix.IoctlSetPointerInt(int(master.Fd()), unix.TIOCSPTLCK, 0); err != nil {
+		master.Close()
+		return nil, "", err
+	}
+	// ptsname
+	ptyNumber, err := unix.IoctlGetInt(int(master.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		return nil, "", err
+	}
+	return master, fmt.Sprintf("/dev/pts/%d", ptyNumber), nil
+}
+
+/*
+将slave作为当前进程的控制终端，并替换stdin、stdout、stderr
+只有session leader才能拥有控制终端，所以先setsid
+*/
+func SetupSlave(slavePath string) error {
+	if _, err := unix.Setsid(); err != nil {
+		return err
+	}
+	slave, err := os.OpenFile(slavePath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer slave.Close()
+	for fd := 0; fd < 3; fd++ {
+		if err := syscall.Dup2(int(slave.Fd()), fd); err != nil {
+			return err
+		}
+	}
+	return unix.IoctlSetInt(0, unix.TIOCSCTTY, 0)
+}
+
+/*
+通过unix socket(SCM_RIGHTS)将fd发送给另一个进程，文件名作为消息内容一起发送
+*/
+func SendFd(socket *os.File, file *os.File) error {
+	rights := unix.UnixRights(int(file.Fd()))
+	return unix.Sendmsg(int(socket.Fd()), []byte(file.Name()), rights, nil, 0)
+}
+
+/*
+连接到path上监听的unix socket，将fd发送过去，即OCI的--console-socket协议
+*/
+func SendFdToSocket(path string, file *os.File) error {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return fmt.Errorf("%s is not a unix socket", path)
+	}
+	socket, err := unixConn.File()
+	if err != nil {
+		return err
+	}
+	defer socket.Close()
+	return SendFd(socket, file)
+}
+
+func RecvFd(socket *os.File) (*os.File, error) {
+	name := make([]byte, 4096)
+	oob := make([]byte, unix.CmsgSpace(4))
+	n, oobn, _, _, err := unix.Recvmsg(int(socket.Fd()), name, oob, 0)
+	if err != nil {
+		return nil, err
+	}
+	if oobn == 0 {
+		return nil, fmt.Errorf("no fd received from %s", socket.Name())
+	}
+	messages, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) != 1 {
+		return nil, fmt.Errorf("expect 1 socket control message, got %d", len(messages))
+	}
+	fds, err := unix.ParseUnixRights(&messages[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(fds) != 1 {
+		return nil, fmt.Errorf("expect 1 fd, got %d", len(fds))
+	}
+	return os.NewFile(uintptr(fds[0]), string(name[:n])), nil
+}
@@ -33,6 +33,15 @@ const (
 	CgroupsError
 	CmdStartError
 	CmdWaitError
+	ConsoleError
+	StdioRelayError
+	ShimError
+	UserError
+	CapabilitiesError
+	SeccompError
+	NoNewPrivilegesError
+	OomScoreAdjError
+	RlimitError
 	// network
 	NetworkError
 	BridgeNetworkCreateError
@@ -41,18 +50,22 @@ const (
 	NetworkLinkDeleteError
 	InterfaceIPAndRouteSetError
 	InterfaceSetUpError
-	IPTablesSetError
-	IPTablesDeleteError
+	FirewallSetError
+	FirewallDeleteError
 	IPAMLoadError
 	IPAMDumpError
 	IPRunOutError
 	IPReleaseError
+	IPAllocateError
 	VethPairCreateError
 	VethInitError
 	VethMoveToNetNsError
 	PortMappingsConfigError
 	RouteAddError
 	EnterNetNsError
+	BandwidthSetError
+	NetworkPruneError
+	NetworkPruneSkippedError
 	// image
 	ImageServiceError
 	ImageIdExistsError
@@ -127,6 +140,24 @@ func (c ErrorCode) String() string {
 		return "start cmd error"
 	case CmdWaitError:
 		return "wait cmd error"
+	case ConsoleError:
+		return "console error"
+	case StdioRelayError:
+		return "stdio relay error"
+	case ShimError:
+		return "shim error"
+	case UserError:
+		return "user error"
+	case CapabilitiesError:
+		return "capabilities error"
+	case SeccompError:
+		return "seccomp error"
+	case NoNewPrivilegesError:
+		return "no new privileges error"
+	case OomScoreAdjError:
+		return "oom score adj error"
+	case RlimitError:
+		return "rlimit error"
 	// network
 	case NetworkError:
 		return "network error"
@@ -136,10 +167,10 @@ func (c ErrorCode) String() string {
 		return "set interface ip and route error"
 	case InterfaceSetUpError:
 		return "set interface up error"
-	case IPTablesSetError:
-		return "set iptables rule error"
-	case IPTablesDeleteError:
-		return "delete iptables rule error"
+	case FirewallSetError:
+		return "set firewall rule error"
+	case FirewallDeleteError:
+		return "delete firewall rule error"
 	case BridgeNetworkLoadError:
 		return "load bridge network error"
 	case NetworkLinkNotFoundError:
@@ -154,6 +185,8 @@ func (c ErrorCode) String() string {
 		return "ip run out error"
 	case IPReleaseError:
 		return "ip release error"
+	case IPAllocateError:
+		return "ip allocate error"
 	case VethPairCreateError:
 		return "create veth pair error"
 	case VethInitError:
@@ -166,6 +199,12 @@ func (c ErrorCode) String() string {
 		return "route add error"
 	case EnterNetNsError:
 		return "enter network namespace error"
+	case BandwidthSetError:
+		return "set bandwidth limit error"
+	case NetworkPruneError:
+		return "prune network error"
+	case NetworkPruneSkippedError:
+		return "prune network skipped"
 	// image
 	case ImageServiceError:
 		return "image service error"
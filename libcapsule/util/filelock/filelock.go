@@ -0,0 +1,97 @@
+package filelock
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+/*
+每次capsule命令都是一个独立的进程，进程内的sync.Mutex无法保护subnet.json、repositories.json这类共享文件
+这里使用flock做跨进程的互斥，flock锁在进程退出(包括崩溃)时会被内核自动释放
+注意锁加在单独的xxx.lock文件上，而不是数据文件本身，因为数据文件会被rename替换掉，锁在旧inode上就失效了
+*/
+type FileLock struct {
+	file *os.File
+}
+
+/*
+对path加排他锁，阻塞直到获得锁
+*/
+func Lock(path string) (*FileLock, error) {
+	return lock(path, os.O_RDWR|os.O_CREATE, syscall.LOCK_EX)
+}
+
+/*
+对path加共享锁，可以与其他共享锁共存，与排他锁互斥
+*/
+func RLock(path string) (*FileLock, error) {
+	return lock(path, os.O_RDWR|os.O_CREATE, syscall.LOCK_SH)
+}
+
+/*
+与Lock相同，但不会创建锁文件，锁文件不存在时返回os.IsNotExist的错误
+用于path所在的目录可能已经被其他进程删除的场景，比如容器已经被destroy
+*/
+func LockExisting(path string) (*FileLock, error) {
+	return lock(path, os.O_RDWR, syscall.LOCK_EX)
+}
+
+/*
+锁文件所在的目录由调用方创建，这里不会创建目录
+*/
+func lock(path string, flag int, how int) (*FileLock, error) {
+	file, err := os.OpenFile(path+".lock", flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		err = syscall.Flock(int(file.Fd()), how)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &FileLock{file: file}, nil
+}
+
+func (lock *FileLock) Unlock() error {
+	defer lock.file.Close()
+	return syscall.Flock(int(lock.file.Fd()), syscall.LOCK_UN)
+}
+
+/*
+先写到同目录下的临时文件并fsync，再rename覆盖目标文件
+rename是原子的，读者要么看到旧文件，要么看到完整的新文件，不会读到写了一半的内容
+*/
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+	defer os.Remove(tmpPath)
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpPath, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
@@ -57,6 +57,9 @@ type ProcessStat struct {
 	// ProcessStatus is the state of the process.
 	Status ProcessStatus
 
+	// PPid is the PID of the parent of this process.
+	PPid int
+
 	// StartTime is the number of clock ticks after system boot (since
 	// Linux 2.6).
 	StartTime uint64
@@ -98,6 +101,7 @@ func parseStat(data string) (stat ProcessStat, err error) {
 	var state int
 	fmt.Sscanf(parts[3-3], "%c", &state)
 	stat.Status = ProcessStatus(state)
+	fmt.Sscanf(parts[4-3], "%d", &stat.PPid)
 	fmt.Sscanf(parts[22-3], "%d", &stat.StartTime)
 	return stat, nil
 }
@@ -0,0 +1,71 @@
+package proc
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"os"
+	"time"
+)
+
+// pidfd_open需要5.3以上的内核，vendor的unix包中还没有这个常量
+const sysPidfdOpen = 434
+
+const waitPollInterval = 100 * time.Millisecond
+
+/*
+等待任意一个进程(不一定是当前进程的子进程)退出，进程成为僵尸进程即视为已退出
+优先使用pidfd_open，进程退出时pidfd变为可读；内核不支持时退化为轮询/proc/${pid}/stat
+*/
+func WaitExit(ctx context.Context, pid int) error {
+	pidfd, _, errno := unix.Syscall(sysPidfdOpen, uintptr(pid), 0, 0)
+	switch errno {
+	case 0:
+		defer unix.Close(int(pidfd))
+		return waitPidfd(ctx, int(pidfd))
+	case unix.ESRCH:
+		return nil
+	default:
+		logrus.Infof("pidfd_open not available(%s), polling /proc/%d/stat", errno.Error(), pid)
+		return pollProcessStat(ctx, pid)
+	}
+}
+
+func waitPidfd(ctx context.Context, pidfd int) error {
+	fds := []unix.PollFd{{Fd: int32(pidfd), Events: unix.POLLIN}}
+	for {
+		// 每次只poll一小段时间，以便响应ctx的取消
+		n, err := unix.Poll(fds, int(waitPollInterval/time.Millisecond))
+		if err != nil && err != unix.EINTR {
+			return err
+		}
+		if n > 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+	}
+}
+
+func pollProcessStat(ctx context.Context, pid int) error {
+	// https://stackoverflow.com/questions/1157700/how-to-wait-for-exit-of-non-children-processes
+	// 如果/proc/${pid}/stat不存在，或者进程已经成为僵尸进程，则说明进程已停止
+	for {
+		stat, err := GetProcessStat(pid)
+		if os.IsNotExist(err) {
+			logrus.Infof("%d process exited(/proc/%d/stat not exists)", pid, pid)
+			return nil
+		}
+		if err != nil || stat.Status == Zombie {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(waitPollInterval):
+		}
+	}
+}
@@ -40,3 +40,22 @@ func PivotRoot(rootfs string) error {
 	// 删除临时目录
 	return os.Remove(pivotDir)
 }
+
+/*
+pivot root无法用于initramfs(rootfs不能被卸载)，此时将rootfs移动到/上再chroot
+与pivot root不同，老的root仍然在mount namespace中，只是被rootfs覆盖住了
+*/
+func MsMoveRoot(rootfs string) error {
+	logrus.Infof("moving rootfs to / and chroot...")
+	if err := syscall.Chdir(rootfs); err != nil {
+		return err
+	}
+	if err := syscall.Mount(rootfs, "/", "", syscall.MS_MOVE, ""); err != nil {
+		logrus.Errorf("move mount failed, cause: %s", err.Error())
+		return err
+	}
+	if err := syscall.Chroot("."); err != nil {
+		return err
+	}
+	return syscall.Chdir("/")
+}
@@ -1,6 +1,7 @@
 package rootfs
 
 import (
+	"bufio"
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"github.com/songxinjianqwe/capsule/libcapsule/configs"
@@ -13,7 +14,11 @@ import (
 
 func PrepareRoot(config *configs.ContainerConfig) error {
 	logrus.WithField("init", true).Info("preparing root...")
+	// 默认为rslave，宿主机上的挂载会传播到容器中，容器中的挂载不会传播到宿主机
 	flag := unix.MS_SLAVE | unix.MS_REC
+	if config.RootPropagation != 0 {
+		flag = config.RootPropagation
+	}
 	logrus.WithField("init", true).Info("mounting / in \"\" fs...")
 	// 这行必须要有，否则在某些情况下宿主机会出现 open /dev/null: no such file or directory
 	if err := unix.Mount("", "/", "", uintptr(flag), ""); err != nil {
@@ -26,53 +31,158 @@ func PrepareRoot(config *configs.ContainerConfig) error {
 
 	// 可以让当前root的老root和新root不在同一个文件系统
 	// bind mount是把相同的内容换了一个挂载点的挂载方法
+	if err := rootfsParentMountPrivate(config.Rootfs); err != nil {
+		return err
+	}
 	return unix.Mount(config.Rootfs, config.Rootfs, "bind", unix.MS_BIND|unix.MS_REC, "")
 }
 
+/*
+pivot root要求rootfs的父挂载点不能是shared，rootfs propagation为shared时需要将其改为private
+*/
+func rootfsParentMountPrivate(rootfs string) error {
+	mountPoint, optional, err := parentMount(rootfs)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(optional, "shared:") {
+		return nil
+	}
+	logrus.WithField("init", true).Infof("making parent mount %s of rootfs private", mountPoint)
+	return unix.Mount("", mountPoint, "", unix.MS_PRIVATE, "")
+}
+
+/*
+从/proc/self/mountinfo中找到包含path的挂载点，以及它的optional fields(shared:N master:N)
+*/
+func parentMount(path string) (string, string, error) {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+	var mountPoint, optional string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		fields := strings.Split(scanner.Text(), " ")
+		if len(fields) < 7 {
+			continue
+		}
+		point := fields[4]
+		if point != "/" && path != point && !strings.HasPrefix(path, point+"/") {
+			continue
+		}
+		// 同一个挂载点被挂载多次时，后面的在上面
+		if len(point) >= len(mountPoint) {
+			mountPoint = point
+			optional = strings.Join(fields[6:], " ")
+			if i := strings.Index(optional, " - "); i >= 0 {
+				optional = optional[:i]
+			} else if optional == "-" || strings.HasPrefix(optional, "- ") {
+				optional = ""
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", err
+	}
+	return mountPoint, optional, nil
+}
+
 /*
 挂载
+挂载点在rootfs中解析，不会被镜像中的软链接引到rootfs之外
 */
 func MountToRootfs(m *configs.Mount, rootfs string) error {
 	logrus.WithField("init", true).Infof("mounting %#v to rootfs...", m)
-	var (
-		dest = m.Destination
-	)
-	if !strings.HasPrefix(dest, rootfs) {
-		dest = filepath.Join(rootfs, dest)
+	dest := m.Destination
+	if strings.HasPrefix(dest, rootfs) {
+		dest = strings.TrimPrefix(dest, rootfs)
+	}
+	if err := createMountTarget(m, rootfs, dest); err != nil {
+		return err
+	}
+	target, err := OpenInRoot(rootfs, dest)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+	if err := mount(m, target); err != nil {
+		return err
 	}
+	return setPropagation(m, rootfs, dest)
+}
 
-	_, err := os.Stat(dest)
+/*
+挂载点不存在时创建，bind一个文件时挂载点也需要是文件，其他情况都是目录
+*/
+func createMountTarget(m *configs.Mount, rootfs string, dest string) error {
+	unsafeDest, err := SecureJoin(rootfs, dest)
 	if err != nil {
-		// 不存在，则创建
-		if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	if _, err := os.Lstat(unsafeDest); err == nil {
+		return nil
+	}
+	isDir := true
+	if m.Flags&unix.MS_BIND == unix.MS_BIND {
+		fi, err := os.Stat(m.Source)
+		if err != nil {
 			return err
 		}
+		isDir = fi.IsDir()
+	}
+	if isDir {
+		return os.MkdirAll(unsafeDest, 0755)
+	}
+	if err := os.MkdirAll(filepath.Dir(unsafeDest), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(unsafeDest, os.O_CREATE|os.O_EXCL|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0644)
+	if err != nil {
+		return err
 	}
-	return mount(m, rootfs)
+	return file.Close()
 }
 
 /*
-真正执行挂载
+真正执行挂载，挂载到target对应的/proc/self/fd/$fd上，与路径无关
 */
-func mount(m *configs.Mount, rootfs string) error {
-	var (
-		flags = m.Flags
-		dest  = m.Destination
-	)
+func mount(m *configs.Mount, target *os.File) error {
+	flags := m.Flags
 	if util.CleanPath(m.Destination) == "/dev" {
 		flags &= ^unix.MS_RDONLY
 	}
-	if !strings.HasPrefix(dest, rootfs) {
-		dest = filepath.Join(rootfs, dest)
-	}
 	// mount -t device src dest
-	if err := unix.Mount(m.Source, dest, m.Device, uintptr(flags), m.Data); err != nil {
+	if err := unix.Mount(m.Source, fmt.Sprintf("/proc/self/fd/%d", target.Fd()), m.Device, uintptr(flags), m.Data); err != nil {
 		logrus.WithField("init", true).Errorf("mount failed, cause: %s", err.Error())
 		return err
 	}
 	return nil
 }
 
+/*
+传播类型只能在挂载之后单独设置
+挂载之前打开的fd指向的是被覆盖的目录，需要重新打开才能拿到新的挂载点
+*/
+func setPropagation(m *configs.Mount, rootfs string, dest string) error {
+	if len(m.PropagationFlags) == 0 {
+		return nil
+	}
+	target, err := OpenInRoot(rootfs, dest)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+	for _, pflag := range m.PropagationFlags {
+		if err := unix.Mount("", fmt.Sprintf("/proc/self/fd/%d", target.Fd()), "", uintptr(pflag), ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 /*
 将该mount置为read only
 */
@@ -95,11 +205,104 @@ func SetRootfsReadonly() error {
 	return unix.Mount("/", "/", "bind", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY|unix.MS_REC, "")
 }
 
+/*
+默认屏蔽的路径，容器中读取这些文件会泄露宿主机的信息
+*/
+var DefaultMaskedPaths = []string{
+	"/proc/acpi",
+	"/proc/asound",
+	"/proc/kcore",
+	"/proc/keys",
+	"/proc/latency_stats",
+	"/proc/timer_list",
+	"/proc/timer_stats",
+	"/proc/sched_debug",
+	"/proc/scsi",
+	"/sys/firmware",
+}
+
+/*
+默认只读的路径，容器中写这些文件会修改宿主机的内核参数
+*/
+var DefaultReadonlyPaths = []string{
+	"/proc/bus",
+	"/proc/fs",
+	"/proc/irq",
+	"/proc/sys",
+	"/proc/sysrq-trigger",
+}
+
+/*
+屏蔽容器中的路径，需要在pivot root之后调用
+文件用/dev/null覆盖，目录用只读的空tmpfs覆盖，路径不存在时忽略
+*/
+func MaskPath(path string) error {
+	logrus.WithField("init", true).Infof("masking %s", path)
+	if err := unix.Mount("/dev/null", path, "", unix.MS_BIND, ""); err != nil {
+		switch err {
+		case unix.ENOENT:
+			return nil
+		case unix.ENOTDIR:
+			return unix.Mount("tmpfs", path, "tmpfs", unix.MS_RDONLY, "")
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+将容器中的路径重新挂载为只读，需要在pivot root之后调用，路径不存在时忽略
+先bind自己得到一个单独的挂载点，再remount为只读
+*/
+func ReadonlyPath(path string) error {
+	logrus.WithField("init", true).Infof("remounting %s as readonly", path)
+	if err := unix.Mount(path, path, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		if err == unix.ENOENT {
+			return nil
+		}
+		return err
+	}
+	return unix.Mount(path, path, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY|unix.MS_REC, "")
+}
+
+/*
+devpts以newinstance挂载时，容器中的pty只能通过/dev/pts/ptmx分配
+所以将/dev/ptmx替换为指向pts/ptmx的软链接，没有挂载devpts时不做处理
+*/
+func SetupPtmx(rootfs string) error {
+	if _, err := os.Stat(filepath.Join(rootfs, "/dev/pts/ptmx")); err != nil {
+		return nil
+	}
+	ptmx := filepath.Join(rootfs, "/dev/ptmx")
+	if err := os.Remove(ptmx); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	logrus.WithField("init", true).Infof("linking %s to pts/ptmx", ptmx)
+	return os.Symlink("pts/ptmx", ptmx)
+}
+
+/*
+容器自己挂载了/dev时才需要创建设备和软链接，bind宿主机的/dev时不能修改它
+*/
+func NeedsSetupDev(config *configs.ContainerConfig) bool {
+	for _, m := range config.Mounts {
+		if m.Flags&unix.MS_BIND == unix.MS_BIND && util.CleanPath(m.Destination) == "/dev" {
+			return false
+		}
+	}
+	return true
+}
+
 /*
 创建设备文件,mknod
+没有权限mknod时(比如在user namespace中)，改为bind宿主机上的设备
 */
 func CreateDeviceNode(rootfs string, node *configs.Device) error {
-	dest := filepath.Join(rootfs, node.Path)
+	dest, err := SecureJoin(rootfs, node.Path)
+	if err != nil {
+		return err
+	}
 	logrus.WithField("init", true).Infof("creating device %#v ...", node)
 	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
 		return err
@@ -108,8 +311,50 @@ func CreateDeviceNode(rootfs string, node *configs.Device) error {
 		if os.IsExist(err) {
 			return nil
 		}
+		if os.IsPermission(err) {
+			return bindMountDeviceNode(dest, node)
+		}
+		return err
+	}
+	return nil
+}
+
+func bindMountDeviceNode(dest string, node *configs.Device) error {
+	logrus.WithField("init", true).Infof("mknod %s not permitted, bind mounting it from host", node.Path)
+	file, err := os.OpenFile(dest, os.O_CREATE|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0000)
+	if err != nil {
 		return err
 	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return unix.Mount(node.Path, dest, "bind", unix.MS_BIND, "")
+}
+
+/*
+/dev下的标准软链接，/dev/fd是bash进程替换所需要的
+*/
+func SetupDevSymlinks(rootfs string) error {
+	links := [][2]string{
+		{"/proc/self/fd", "/dev/fd"},
+		{"/proc/self/fd/0", "/dev/stdin"},
+		{"/proc/self/fd/1", "/dev/stdout"},
+		{"/proc/self/fd/2", "/dev/stderr"},
+	}
+	// 内核开启了/proc/kcore时才创建/dev/core
+	if _, err := os.Stat("/proc/kcore"); err == nil {
+		links = append(links, [2]string{"/proc/kcore", "/dev/core"})
+	}
+	for _, link := range links {
+		dest, err := SecureJoin(rootfs, link[1])
+		if err != nil {
+			return err
+		}
+		logrus.WithField("init", true).Infof("linking %s to %s", dest, link[0])
+		if err := os.Symlink(link[0], dest); err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -131,5 +376,9 @@ func mknodDevice(dest string, node *configs.Device) error {
 	if err := unix.Mknod(dest, uint32(fileMode), node.Mkdev()); err != nil {
 		return err
 	}
-	return unix.Chown(dest, int(node.Uid), int(node.Gid))
+	if err := unix.Chown(dest, int(node.Uid), int(node.Gid)); err != nil {
+		return err
+	}
+	// mknod时会受到umask的影响，需要重新设置权限
+	return os.Chmod(dest, node.FileMode)
 }
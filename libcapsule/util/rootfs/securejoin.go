@@ -0,0 +1,127 @@
+package rootfs
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// 解析软链接的最大次数，超过时认为出现了循环
+const maxSymlinkLimit = 255
+
+// openat2的resolve flag，见linux/openat2.h
+const (
+	sysOpenat2     = 437
+	resolveNoMagic = 0x02
+	resolveInRoot  = 0x10
+	openHowSize    = 24
+)
+
+/*
+将unsafePath拼接到root下，路径中的软链接都在root中解析
+绝对路径的软链接以root为根，..最多回到root，所以结果一定在root之内
+与filepath.Join不同，镜像中的/etc -> /host/etc不会指向宿主机的/host/etc
+*/
+func SecureJoin(root, unsafePath string) (string, error) {
+	root = filepath.Clean(root)
+	var resolved string
+	remaining := filepath.Clean("/" + unsafePath)
+	linksWalked := 0
+	for remaining != "" {
+		// 每次取出第一个路径分量
+		var component string
+		remaining = strings.TrimPrefix(remaining, "/")
+		if i := strings.IndexByte(remaining, '/'); i >= 0 {
+			component, remaining = remaining[:i], remaining[i:]
+		} else {
+			component, remaining = remaining, ""
+		}
+		if component == "" || component == "." {
+			continue
+		}
+		if component == ".." {
+			resolved = filepath.Dir("/" + resolved)
+			continue
+		}
+		next := filepath.Join("/", resolved, component)
+		fi, err := os.Lstat(filepath.Join(root, next))
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		// 不存在的部分之后会被创建，与普通目录一样处理
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		linksWalked++
+		if linksWalked > maxSymlinkLimit {
+			return "", &os.PathError{Op: "SecureJoin", Path: filepath.Join(root, unsafePath), Err: syscall.ELOOP}
+		}
+		dest, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		// 绝对路径从root重新开始解析，相对路径相对于软链接所在的目录
+		if filepath.IsAbs(dest) {
+			resolved = ""
+		}
+		remaining = dest + "/" + remaining
+	}
+	return filepath.Join(root, resolved), nil
+}
+
+/*
+struct open_how
+*/
+type openHow struct {
+	flags   uint64
+	mode    uint64
+	resolve uint64
+}
+
+/*
+以O_PATH打开root中的path，内核支持openat2时使用RESOLVE_IN_ROOT，由内核保证解析的结果不会逃出root
+否则先SecureJoin再以O_NOFOLLOW打开，返回的fd可以通过/proc/self/fd/$fd作为挂载点
+*/
+func OpenInRoot(root, path string) (*os.File, error) {
+	rootFile, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer rootFile.Close()
+	how := openHow{
+		flags:   unix.O_PATH | unix.O_CLOEXEC,
+		resolve: resolveInRoot | resolveNoMagic,
+	}
+	pathPtr, err := unix.BytePtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	fd, _, errno := unix.Syscall6(sysOpenat2, rootFile.Fd(), uintptr(unsafe.Pointer(pathPtr)), uintptr(unsafe.Pointer(&how)), openHowSize, 0, 0)
+	switch errno {
+	case 0:
+		return os.NewFile(fd, filepath.Join(root, path)), nil
+	case unix.ENOSYS, unix.EPERM:
+		// 5.6之前的内核没有openat2，被seccomp禁用时返回EPERM
+	default:
+		return nil, &os.PathError{Op: "openat2", Path: filepath.Join(root, path), Err: errno}
+	}
+	unsafePath, err := SecureJoin(root, path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(unsafePath, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	// SecureJoin之后路径被替换为软链接时，O_NOFOLLOW打开的是软链接本身，不能作为挂载点
+	if fi, err := file.Stat(); err != nil || fi.Mode()&os.ModeSymlink != 0 {
+		file.Close()
+		return nil, fmt.Errorf("mount target %s was replaced with a symlink", unsafePath)
+	}
+	return file, nil
+}
@@ -0,0 +1,105 @@
+package rootfs
+
+import (
+	"github.com/songxinjianqwe/capsule/libcapsule/configs"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newRootfs(t *testing.T) string {
+	root, err := ioutil.TempDir("", "capsule-rootfs")
+	assert.Nil(t, err)
+	assert.Nil(t, os.MkdirAll(filepath.Join(root, "usr/lib"), 0755))
+	return root
+}
+
+func TestSecureJoin(t *testing.T) {
+	root := newRootfs(t)
+	defer os.RemoveAll(root)
+	// 指向宿主机的绝对路径
+	assert.Nil(t, os.Symlink("/host/etc", filepath.Join(root, "etc")))
+	// 用..逃出rootfs
+	assert.Nil(t, os.Symlink("../../../../../../../tmp", filepath.Join(root, "escape")))
+	assert.Nil(t, os.Symlink("lib", filepath.Join(root, "usr/lib64")))
+	assert.Nil(t, os.Symlink("/usr/lib64", filepath.Join(root, "lib64")))
+
+	for _, c := range []struct {
+		unsafePath string
+		expected   string
+	}{
+		{"/usr/lib", "/usr/lib"},
+		{"/etc/hosts", "/host/etc/hosts"},
+		{"/escape/passwd", "/tmp/passwd"},
+		{"/../../../etc", "/host/etc"},
+		{"/usr/lib64/libc.so", "/usr/lib/libc.so"},
+		{"/lib64/../lib64", "/usr/lib"},
+		{"/not/exists/../../../..", "/"},
+	} {
+		path, err := SecureJoin(root, c.unsafePath)
+		assert.Nil(t, err)
+		assert.Equal(t, filepath.Join(root, c.expected), path, c.unsafePath)
+	}
+}
+
+func TestSecureJoinLoop(t *testing.T) {
+	root := newRootfs(t)
+	defer os.RemoveAll(root)
+	assert.Nil(t, os.Symlink("/b", filepath.Join(root, "a")))
+	assert.Nil(t, os.Symlink("/a", filepath.Join(root, "b")))
+	_, err := SecureJoin(root, "/a/c")
+	assert.NotNil(t, err)
+}
+
+func TestOpenInRoot(t *testing.T) {
+	root := newRootfs(t)
+	defer os.RemoveAll(root)
+	host, err := ioutil.TempDir("", "capsule-host")
+	assert.Nil(t, err)
+	defer os.RemoveAll(host)
+	assert.Nil(t, os.Symlink(host, filepath.Join(root, "etc")))
+	assert.Nil(t, os.MkdirAll(filepath.Join(root, host), 0755))
+
+	file, err := OpenInRoot(root, "/etc")
+	assert.Nil(t, err)
+	defer file.Close()
+	// 打开的是rootfs中的目录而不是宿主机的目录
+	var expected, actual unix.Stat_t
+	assert.Nil(t, unix.Stat(filepath.Join(root, host), &expected))
+	assert.Nil(t, unix.Fstat(int(file.Fd()), &actual))
+	assert.Equal(t, expected.Ino, actual.Ino)
+}
+
+func TestCreateMountTarget(t *testing.T) {
+	root := newRootfs(t)
+	defer os.RemoveAll(root)
+	host, err := ioutil.TempDir("", "capsule-host")
+	assert.Nil(t, err)
+	defer os.RemoveAll(host)
+	source := filepath.Join(host, "hosts")
+	assert.Nil(t, ioutil.WriteFile(source, []byte("127.0.0.1 localhost"), 0644))
+	assert.Nil(t, os.Symlink(host, filepath.Join(root, "etc")))
+
+	// bind一个文件，挂载点是rootfs中的文件，不会创建在宿主机上
+	assert.Nil(t, createMountTarget(&configs.Mount{Source: source, Destination: "/etc/hosts", Flags: unix.MS_BIND}, root, "/etc/hosts"))
+	fi, err := os.Lstat(filepath.Join(root, host, "hosts"))
+	assert.Nil(t, err)
+	assert.True(t, fi.Mode().IsRegular())
+	content, err := ioutil.ReadFile(source)
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1 localhost", string(content))
+
+	// bind一个目录或者其他类型的挂载，挂载点是目录
+	assert.Nil(t, createMountTarget(&configs.Mount{Source: host, Destination: "/etc/data", Flags: unix.MS_BIND}, root, "/etc/data"))
+	assert.Nil(t, createMountTarget(&configs.Mount{Source: "tmpfs", Destination: "/etc/tmp", Device: "tmpfs"}, root, "/etc/tmp"))
+	for _, dir := range []string{"data", "tmp"} {
+		fi, err := os.Lstat(filepath.Join(root, host, dir))
+		assert.Nil(t, err)
+		assert.True(t, fi.IsDir())
+		_, err = os.Lstat(filepath.Join(host, dir))
+		assert.True(t, os.IsNotExist(err))
+	}
+}
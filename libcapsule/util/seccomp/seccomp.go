@@ -0,0 +1,307 @@
+package seccomp
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/songxinjianqwe/capsule/libcapsule/configs"
+	"golang.org/x/sys/unix"
+	"unsafe"
+)
+
+// seccomp的返回值，见linux/seccomp.h
+const (
+	retKillProcess = 0x80000000
+	retKillThread  = 0x00000000
+	retTrap        = 0x00030000
+	retErrno       = 0x00050000
+	retTrace       = 0x7ff00000
+	retLog         = 0x7ffc0000
+	retAllow       = 0x7fff0000
+)
+
+// struct seccomp_data中各字段的偏移
+const (
+	offsetNr   = 0
+	offsetArch = 4
+	offsetArgs = 16
+)
+
+const (
+	// seccomp(2)的operation和flag
+	setModeFilter   = 1
+	filterFlagTsync = 1
+	// x32的系统调用号带有这个标记位，与x86_64共用AUDIT_ARCH
+	x32SyscallBit = 0x40000000
+	// 一个BPF程序最多4096条指令
+	maxInstructions = 4096
+)
+
+/*
+将seccomp配置编译为BPF程序，并为当前线程及其他线程加载
+调用之后的所有系统调用都受到限制，包括之后的execve
+*/
+func InitSeccomp(config *configs.Seccomp) error {
+	if config == nil {
+		return nil
+	}
+	filter, err := Compile(config)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("loading seccomp filter, %d instructions", len(filter))
+	prog := unix.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_SECCOMP, setModeFilter, filterFlagTsync, uintptr(unsafe.Pointer(&prog))); errno != 0 {
+		return fmt.Errorf("loading seccomp filter: %s", errno.Error())
+	}
+	return nil
+}
+
+/*
+BPF程序的结构:
+1. 检查架构，只支持当前架构，其他架构(包括x32)的系统调用直接杀掉进程，否则可以绕过过滤
+2. 没有参数条件的规则，每条规则是 JEQ nr + RET action
+3. 有参数条件的规则，每条规则是一个块，依次检查系统调用号和每个参数，任何一项不满足就跳到块的末尾
+4. 都没有匹配上，返回defaultAction
+*/
+func Compile(config *configs.Seccomp) ([]unix.SockFilter, error) {
+	if nativeArchName == "" {
+		return nil, fmt.Errorf("seccomp is not supported on this architecture")
+	}
+	for _, arch := range config.Architectures {
+		if arch != nativeArchName {
+			logrus.Infof("seccomp only filters native architecture %s, syscalls of %s will be killed", nativeArchName, arch)
+		}
+	}
+	defaultAction, err := action(config.DefaultAction, config.DefaultErrnoRet)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := []unix.SockFilter{
+		loadAbs(offsetArch),
+		jump(unix.BPF_JEQ, nativeArch, 1, 0),
+		ret(retKillProcess),
+		loadAbs(offsetNr),
+	}
+	if nativeArchName == "SCMP_ARCH_X86_64" {
+		filter = append(filter,
+			jump(unix.BPF_JGE, x32SyscallBit, 0, 1),
+			ret(retKillProcess),
+		)
+	}
+
+	var argRules []unix.SockFilter
+	for _, syscall := range config.Syscalls {
+		syscallAction, err := action(syscall.Action, syscall.ErrnoRet)
+		if err != nil {
+			return nil, err
+		}
+		// 与默认行为一样的规则不需要生成指令
+		if syscallAction == defaultAction {
+			continue
+		}
+		for _, name := range syscall.Names {
+			nr, ok := syscallTable[name]
+			if !ok {
+				// 配置通常会包含其他架构的系统调用，直接忽略
+				logrus.Infof("syscall %s is not found on %s, ignored", name, nativeArchName)
+				continue
+			}
+			if len(syscall.Args) == 0 {
+				filter = append(filter,
+					jump(unix.BPF_JEQ, uint32(nr), 0, 1),
+					ret(syscallAction),
+				)
+				continue
+			}
+			block, err := compileArgRule(uint32(nr), syscall.Args, syscallAction)
+			if err != nil {
+				return nil, fmt.Errorf("compiling rule of syscall %s: %s", name, err.Error())
+			}
+			argRules = append(argRules, block...)
+		}
+	}
+	filter = append(filter, argRules...)
+	filter = append(filter, ret(defaultAction))
+	if len(filter) > maxInstructions {
+		return nil, fmt.Errorf("seccomp filter is too large: %d instructions", len(filter))
+	}
+	return filter, nil
+}
+
+/*
+跳转目标，BPF只能向后跳转，偏移量在整个块生成之后再计算
+*/
+type target int
+
+const (
+	// 下一条指令
+	targetNext target = iota
+	// 当前参数条件满足，跳到下一个参数条件
+	targetPass
+	// 参数条件不满足，跳到块的末尾
+	targetFail
+)
+
+type instruction struct {
+	filter unix.SockFilter
+	jt, jf target
+	// 所属参数条件的结束位置，即targetPass的位置
+	passIndex int
+}
+
+func compileArgRule(nr uint32, args []*configs.SeccompArg, syscallAction uint32) ([]unix.SockFilter, error) {
+	block := []instruction{
+		{filter: loadAbs(offsetNr)},
+		{filter: jump(unix.BPF_JEQ, nr, 0, 0), jt: targetNext, jf: targetFail},
+	}
+	for _, arg := range args {
+		if arg.Index > 5 {
+			return nil, fmt.Errorf("invalid argument index %d", arg.Index)
+		}
+		condition, err := compileArg(arg)
+		if err != nil {
+			return nil, err
+		}
+		passIndex := len(block) + len(condition)
+		for i := range condition {
+			condition[i].passIndex = passIndex
+		}
+		block = append(block, condition...)
+	}
+	block = append(block, instruction{filter: ret(syscallAction)})
+	end := len(block)
+	if end > 255 {
+		return nil, fmt.Errorf("too many argument conditions")
+	}
+	filter := make([]unix.SockFilter, 0, len(block))
+	for i, insn := range block {
+		if insn.filter.Code&0x07 == unix.BPF_JMP {
+			insn.filter.Jt = offset(insn.jt, i, insn.passIndex, end)
+			insn.filter.Jf = offset(insn.jf, i, insn.passIndex, end)
+		}
+		filter = append(filter, insn.filter)
+	}
+	return filter, nil
+}
+
+func offset(t target, index int, passIndex int, end int) uint8 {
+	switch t {
+	case targetPass:
+		return uint8(passIndex - index - 1)
+	case targetFail:
+		return uint8(end - index - 1)
+	default:
+		return 0
+	}
+}
+
+/*
+参数是64位的，BPF每次只能比较32位，先比较高32位再比较低32位
+*/
+func compileArg(arg *configs.SeccompArg) ([]instruction, error) {
+	low := uint32(offsetArgs + 8*arg.Index)
+	high := low + 4
+	valueHigh, valueLow := uint32(arg.Value>>32), uint32(arg.Value)
+	switch arg.Op {
+	case "SCMP_CMP_EQ":
+		return compare(high, low, unix.BPF_JEQ, unix.BPF_JEQ, valueHigh, valueLow, targetPass, targetFail), nil
+	case "SCMP_CMP_NE":
+		return compare(high, low, unix.BPF_JEQ, unix.BPF_JEQ, valueHigh, valueLow, targetFail, targetPass), nil
+	case "SCMP_CMP_GT":
+		return compareOrdered(high, low, unix.BPF_JGT, valueHigh, valueLow, targetPass, targetFail), nil
+	case "SCMP_CMP_GE":
+		return compareOrdered(high, low, unix.BPF_JGE, valueHigh, valueLow, targetPass, targetFail), nil
+	case "SCMP_CMP_LT":
+		// a < b 即 !(a >= b)
+		return compareOrdered(high, low, unix.BPF_JGE, valueHigh, valueLow, targetFail, targetPass), nil
+	case "SCMP_CMP_LE":
+		return compareOrdered(high, low, unix.BPF_JGT, valueHigh, valueLow, targetFail, targetPass), nil
+	case "SCMP_CMP_MASKED_EQ":
+		// Value是掩码，ValueTwo是掩码之后的值
+		maskHigh, maskLow := valueHigh, valueLow
+		expectedHigh, expectedLow := uint32(arg.ValueTwo>>32), uint32(arg.ValueTwo)
+		return []instruction{
+			{filter: loadAbs(high)},
+			{filter: and(maskHigh)},
+			{filter: jump(unix.BPF_JEQ, expectedHigh, 0, 0), jt: targetNext, jf: targetFail},
+			{filter: loadAbs(low)},
+			{filter: and(maskLow)},
+			{filter: jump(unix.BPF_JEQ, expectedLow, 0, 0), jt: targetPass, jf: targetFail},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown operator %q", arg.Op)
+	}
+}
+
+/*
+高32位相等时比较低32位，否则直接不相等
+*/
+func compare(high, low uint32, opHigh, opLow uint16, valueHigh, valueLow uint32, equal, notEqual target) []instruction {
+	return []instruction{
+		{filter: loadAbs(high)},
+		{filter: jump(opHigh, valueHigh, 0, 0), jt: targetNext, jf: notEqual},
+		{filter: loadAbs(low)},
+		{filter: jump(opLow, valueLow, 0, 0), jt: equal, jf: notEqual},
+	}
+}
+
+/*
+高32位大于时直接满足，相等时再比较低32位，否则不满足
+*/
+func compareOrdered(high, low uint32, op uint16, valueHigh, valueLow uint32, matched, unmatched target) []instruction {
+	return []instruction{
+		{filter: loadAbs(high)},
+		{filter: jump(unix.BPF_JGT, valueHigh, 0, 0), jt: matched, jf: targetNext},
+		{filter: jump(unix.BPF_JEQ, valueHigh, 0, 0), jt: targetNext, jf: unmatched},
+		{filter: loadAbs(low)},
+		{filter: jump(op, valueLow, 0, 0), jt: matched, jf: unmatched},
+	}
+}
+
+/*
+OCI的action转为seccomp的返回值
+*/
+func action(name string, errnoRet *uint) (uint32, error) {
+	errno := uint32(unix.EPERM)
+	if errnoRet != nil {
+		errno = uint32(*errnoRet)
+	}
+	switch name {
+	case "SCMP_ACT_KILL", "SCMP_ACT_KILL_THREAD":
+		return retKillThread, nil
+	case "SCMP_ACT_KILL_PROCESS":
+		return retKillProcess, nil
+	case "SCMP_ACT_TRAP":
+		return retTrap, nil
+	case "SCMP_ACT_ERRNO":
+		return retErrno | (errno & 0xffff), nil
+	case "SCMP_ACT_TRACE":
+		return retTrace | (errno & 0xffff), nil
+	case "SCMP_ACT_LOG":
+		return retLog, nil
+	case "SCMP_ACT_ALLOW":
+		return retAllow, nil
+	default:
+		return 0, fmt.Errorf("unknown seccomp action %q", name)
+	}
+}
+
+func loadAbs(offset uint32) unix.SockFilter {
+	return unix.SockFilter{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: offset}
+}
+
+func jump(op uint16, k uint32, jt, jf uint8) unix.SockFilter {
+	return unix.SockFilter{Code: unix.BPF_JMP | op | unix.BPF_K, Jt: jt, Jf: jf, K: k}
+}
+
+func and(k uint32) unix.SockFilter {
+	return unix.SockFilter{Code: unix.BPF_ALU | unix.BPF_AND | unix.BPF_K, K: k}
+}
+
+func ret(k uint32) unix.SockFilter {
+	return unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: k}
+}
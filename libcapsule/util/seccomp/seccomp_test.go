@@ -0,0 +1,287 @@
+//go:build amd64 || arm64
+// +build amd64 arm64
+
+package seccomp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/songxinjianqwe/capsule/libcapsule/configs"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+	"testing"
+)
+
+/*
+struct seccomp_data，按小端序编码
+*/
+type seccompData struct {
+	nr   int
+	arch uint32
+	args [6]uint64
+}
+
+func (data *seccompData) bytes() []byte {
+	buf := make([]byte, offsetArgs+8*len(data.args))
+	binary.LittleEndian.PutUint32(buf[offsetNr:], uint32(data.nr))
+	binary.LittleEndian.PutUint32(buf[offsetArch:], data.arch)
+	for i, arg := range data.args {
+		binary.LittleEndian.PutUint64(buf[offsetArgs+8*i:], arg)
+	}
+	return buf
+}
+
+/*
+只支持Compile会生成的指令的BPF解释器，返回RET的值
+*/
+func run(filter []unix.SockFilter, data *seccompData) (uint32, error) {
+	input := data.bytes()
+	var acc uint32
+	for pc := 0; pc < len(filter); pc++ {
+		insn := filter[pc]
+		switch insn.Code {
+		case unix.BPF_LD | unix.BPF_W | unix.BPF_ABS:
+			if int(insn.K)+4 > len(input) {
+				return 0, fmt.Errorf("load out of range at %d", pc)
+			}
+			acc = binary.LittleEndian.Uint32(input[insn.K:])
+		case unix.BPF_ALU | unix.BPF_AND | unix.BPF_K:
+			acc &= insn.K
+		case unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, unix.BPF_JMP | unix.BPF_JGT | unix.BPF_K, unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K:
+			var matched bool
+			switch insn.Code &^ (unix.BPF_JMP | unix.BPF_K) {
+			case unix.BPF_JEQ:
+				matched = acc == insn.K
+			case unix.BPF_JGT:
+				matched = acc > insn.K
+			case unix.BPF_JGE:
+				matched = acc >= insn.K
+			}
+			if matched {
+				pc += int(insn.Jt)
+			} else {
+				pc += int(insn.Jf)
+			}
+		case unix.BPF_RET | unix.BPF_K:
+			return insn.K, nil
+		default:
+			return 0, fmt.Errorf("unknown instruction %#x at %d", insn.Code, pc)
+		}
+	}
+	return 0, fmt.Errorf("filter does not return")
+}
+
+func mustRun(t *testing.T, filter []unix.SockFilter, nr int, args ...uint64) uint32 {
+	data := &seccompData{nr: nr, arch: nativeArch}
+	copy(data.args[:], args)
+	result, err := run(filter, data)
+	assert.Nil(t, err)
+	return result
+}
+
+func TestCompileArch(t *testing.T) {
+	filter, err := Compile(&configs.Seccomp{DefaultAction: "SCMP_ACT_ALLOW"})
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(retAllow), mustRun(t, filter, syscallTable["getpid"]))
+
+	// 其他架构的系统调用直接杀掉进程
+	result, err := run(filter, &seccompData{nr: syscallTable["getpid"], arch: 0x40000003})
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(retKillProcess), result)
+
+	if nativeArchName == "SCMP_ARCH_X86_64" {
+		assert.Equal(t, uint32(retKillProcess), mustRun(t, filter, x32SyscallBit|syscallTable["getpid"]))
+	}
+}
+
+func TestCompileActions(t *testing.T) {
+	eacces := uint(unix.EACCES)
+	for _, c := range []struct {
+		action   string
+		errnoRet *uint
+		expected uint32
+	}{
+		{"SCMP_ACT_KILL", nil, retKillThread},
+		{"SCMP_ACT_KILL_THREAD", nil, retKillThread},
+		{"SCMP_ACT_KILL_PROCESS", nil, retKillProcess},
+		{"SCMP_ACT_TRAP", nil, retTrap},
+		{"SCMP_ACT_ERRNO", nil, retErrno | uint32(unix.EPERM)},
+		{"SCMP_ACT_ERRNO", &eacces, retErrno | uint32(unix.EACCES)},
+		{"SCMP_ACT_TRACE", nil, retTrace | uint32(unix.EPERM)},
+		{"SCMP_ACT_TRACE", &eacces, retTrace | uint32(unix.EACCES)},
+		{"SCMP_ACT_LOG", nil, retLog},
+		{"SCMP_ACT_ALLOW", nil, retAllow},
+	} {
+		// 规则的action与默认action相同时不会生成指令，所以默认action换成另一个
+		defaultAction := "SCMP_ACT_ALLOW"
+		if c.action == defaultAction {
+			defaultAction = "SCMP_ACT_ERRNO"
+		}
+		filter, err := Compile(&configs.Seccomp{
+			DefaultAction: defaultAction,
+			Syscalls: []*configs.Syscall{
+				{Names: []string{"getpid"}, Action: c.action, ErrnoRet: c.errnoRet},
+			},
+		})
+		assert.Nil(t, err, c.action)
+		assert.Equal(t, c.expected, mustRun(t, filter, syscallTable["getpid"]), c.action)
+		defaultResult, _ := action(defaultAction, nil)
+		assert.Equal(t, defaultResult, mustRun(t, filter, syscallTable["getppid"]), c.action)
+	}
+
+	// 默认action的errno
+	filter, err := Compile(&configs.Seccomp{DefaultAction: "SCMP_ACT_ERRNO", DefaultErrnoRet: &eacces})
+	assert.Nil(t, err)
+	assert.Equal(t, retErrno|uint32(unix.EACCES), mustRun(t, filter, syscallTable["getpid"]))
+
+	_, err = Compile(&configs.Seccomp{DefaultAction: "SCMP_ACT_UNKNOWN"})
+	assert.NotNil(t, err)
+	_, err = Compile(&configs.Seccomp{
+		DefaultAction: "SCMP_ACT_ALLOW",
+		Syscalls:      []*configs.Syscall{{Names: []string{"getpid"}, Action: "SCMP_ACT_UNKNOWN"}},
+	})
+	assert.NotNil(t, err)
+}
+
+func TestCompileOperators(t *testing.T) {
+	const high = uint64(1) << 32
+	for _, c := range []struct {
+		op       string
+		value    uint64
+		valueTwo uint64
+		arg      uint64
+		matched  bool
+	}{
+		{"SCMP_CMP_EQ", 5, 0, 5, true},
+		{"SCMP_CMP_EQ", 5, 0, 6, false},
+		// 低32位相同，高32位不同
+		{"SCMP_CMP_EQ", 5, 0, high | 5, false},
+		{"SCMP_CMP_EQ", high | 5, 0, high | 5, true},
+		{"SCMP_CMP_NE", 5, 0, 5, false},
+		{"SCMP_CMP_NE", 5, 0, 6, true},
+		{"SCMP_CMP_NE", 5, 0, high | 5, true},
+		{"SCMP_CMP_GT", 5, 0, 6, true},
+		{"SCMP_CMP_GT", 5, 0, 5, false},
+		{"SCMP_CMP_GT", 5, 0, 4, false},
+		// 高32位更大，低32位更小
+		{"SCMP_CMP_GT", 5, 0, high | 1, true},
+		{"SCMP_CMP_GT", high | 1, 0, 0xffffffff, false},
+		{"SCMP_CMP_GE", 5, 0, 6, true},
+		{"SCMP_CMP_GE", 5, 0, 5, true},
+		{"SCMP_CMP_GE", 5, 0, 4, false},
+		{"SCMP_CMP_GE", high, 0, 0xffffffff, false},
+		{"SCMP_CMP_GE", high, 0, high, true},
+		{"SCMP_CMP_LT", 5, 0, 4, true},
+		{"SCMP_CMP_LT", 5, 0, 5, false},
+		{"SCMP_CMP_LT", 5, 0, 6, false},
+		{"SCMP_CMP_LT", high, 0, 0xffffffff, true},
+		{"SCMP_CMP_LT", 5, 0, high | 1, false},
+		{"SCMP_CMP_LE", 5, 0, 4, true},
+		{"SCMP_CMP_LE", 5, 0, 5, true},
+		{"SCMP_CMP_LE", 5, 0, 6, false},
+		{"SCMP_CMP_LE", high | 5, 0, high | 5, true},
+		{"SCMP_CMP_LE", high | 5, 0, 2*high | 1, false},
+		{"SCMP_CMP_MASKED_EQ", 0xff, 0x12, 0x1012, true},
+		{"SCMP_CMP_MASKED_EQ", 0xff, 0x12, 0x1013, false},
+		{"SCMP_CMP_MASKED_EQ", high | 0xff, high | 0x12, high | 0x1012, true},
+		{"SCMP_CMP_MASKED_EQ", high | 0xff, high | 0x12, 0x1012, false},
+		{"SCMP_CMP_MASKED_EQ", cloneNamespaceFlags, 0, unix.CLONE_NEWNS, false},
+		{"SCMP_CMP_MASKED_EQ", cloneNamespaceFlags, 0, unix.CLONE_VM | unix.CLONE_FS, true},
+	} {
+		name := fmt.Sprintf("%s(%#x, %#x) with %#x", c.op, c.value, c.valueTwo, c.arg)
+		// 每个参数位置都测一遍，确保偏移正确
+		for index := uint(0); index < 6; index++ {
+			filter, err := Compile(&configs.Seccomp{
+				DefaultAction: "SCMP_ACT_ALLOW",
+				Syscalls: []*configs.Syscall{
+					{
+						Names:  []string{"read"},
+						Action: "SCMP_ACT_ERRNO",
+						Args:   []*configs.SeccompArg{{Index: index, Value: c.value, ValueTwo: c.valueTwo, Op: c.op}},
+					},
+				},
+			})
+			assert.Nil(t, err, name)
+			args := make([]uint64, 6)
+			// 其他参数位置填上不会匹配的值
+			for i := range args {
+				args[i] = 0xdeadbeefdeadbeef
+			}
+			args[index] = c.arg
+			expected := uint32(retAllow)
+			if c.matched {
+				expected = retErrno | uint32(unix.EPERM)
+			}
+			assert.Equal(t, expected, mustRun(t, filter, syscallTable["read"], args...), "%s at index %d", name, index)
+			// 系统调用号不同时不受参数条件影响
+			assert.Equal(t, uint32(retAllow), mustRun(t, filter, syscallTable["write"], args...), name)
+		}
+	}
+}
+
+func TestCompileMultipleArgs(t *testing.T) {
+	filter, err := Compile(&configs.Seccomp{
+		DefaultAction: "SCMP_ACT_ALLOW",
+		Syscalls: []*configs.Syscall{
+			// 同一条规则的参数条件都满足才匹配
+			{
+				Names:  []string{"read"},
+				Action: "SCMP_ACT_ERRNO",
+				Args: []*configs.SeccompArg{
+					{Index: 0, Value: 1, Op: "SCMP_CMP_EQ"},
+					{Index: 2, Value: 100, Op: "SCMP_CMP_GT"},
+				},
+			},
+			// 同一个系统调用的多条规则依次匹配
+			{
+				Names:  []string{"read"},
+				Action: "SCMP_ACT_TRAP",
+				Args:   []*configs.SeccompArg{{Index: 0, Value: 2, Op: "SCMP_CMP_EQ"}},
+			},
+		},
+	})
+	assert.Nil(t, err)
+	read := syscallTable["read"]
+	assert.Equal(t, retErrno|uint32(unix.EPERM), mustRun(t, filter, read, 1, 0, 101))
+	assert.Equal(t, uint32(retAllow), mustRun(t, filter, read, 1, 0, 100))
+	assert.Equal(t, uint32(retAllow), mustRun(t, filter, read, 3, 0, 101))
+	assert.Equal(t, uint32(retTrap), mustRun(t, filter, read, 2, 0, 0))
+}
+
+func TestCompileInvalid(t *testing.T) {
+	// 当前架构上不存在的系统调用被忽略
+	filter, err := Compile(&configs.Seccomp{
+		DefaultAction: "SCMP_ACT_ALLOW",
+		Syscalls:      []*configs.Syscall{{Names: []string{"not_a_syscall"}, Action: "SCMP_ACT_ERRNO"}},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(retAllow), mustRun(t, filter, syscallTable["getpid"]))
+
+	for _, arg := range []*configs.SeccompArg{
+		{Index: 6, Value: 1, Op: "SCMP_CMP_EQ"},
+		{Index: 0, Value: 1, Op: "SCMP_CMP_UNKNOWN"},
+	} {
+		_, err := Compile(&configs.Seccomp{
+			DefaultAction: "SCMP_ACT_ALLOW",
+			Syscalls:      []*configs.Syscall{{Names: []string{"read"}, Action: "SCMP_ACT_ERRNO", Args: []*configs.SeccompArg{arg}}},
+		})
+		assert.NotNil(t, err)
+	}
+}
+
+func TestDefaultProfile(t *testing.T) {
+	filter, err := Compile(DefaultProfile())
+	assert.Nil(t, err)
+	eperm := retErrno | uint32(unix.EPERM)
+	assert.Equal(t, uint32(retAllow), mustRun(t, filter, syscallTable["getpid"]))
+	assert.Equal(t, eperm, mustRun(t, filter, syscallTable["mount"]))
+	assert.Equal(t, eperm, mustRun(t, filter, syscallTable["unshare"]))
+	// clone不能创建新的namespace
+	assert.Equal(t, uint32(retAllow), mustRun(t, filter, syscallTable["clone"], unix.CLONE_VM|unix.CLONE_THREAD))
+	assert.Equal(t, eperm, mustRun(t, filter, syscallTable["clone"], unix.CLONE_NEWUSER))
+	assert.Equal(t, retErrno|uint32(unix.ENOSYS), mustRun(t, filter, syscallTable["clone3"]))
+	// personality只允许部分persona
+	assert.Equal(t, uint32(retAllow), mustRun(t, filter, syscallTable["personality"], 0x8))
+	assert.Equal(t, uint32(retAllow), mustRun(t, filter, syscallTable["personality"], 0xffffffff))
+	assert.Equal(t, eperm, mustRun(t, filter, syscallTable["personality"], 0x0040000))
+}
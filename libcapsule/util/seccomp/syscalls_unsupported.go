@@ -0,0 +1,11 @@
+//go:build !amd64 && !arm64
+// +build !amd64,!arm64
+
+package seccomp
+
+// 其他架构暂时没有系统调用表，配置了seccomp时会报错
+const nativeArch = 0
+
+const nativeArchName = ""
+
+var syscallTable = map[string]int{}
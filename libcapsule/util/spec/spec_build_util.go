@@ -2,6 +2,8 @@ package spec
 
 import (
 	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/songxinjianqwe/capsule/libcapsule/util/capabilities"
+	"github.com/songxinjianqwe/capsule/libcapsule/util/rootfs"
 )
 
 // Example returns an example spec file, with many options set so a user can
@@ -23,7 +25,8 @@ func Example() *specs.Spec {
 				"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
 				"TERM=xterm",
 			},
-			Cwd: "/",
+			Cwd:          "/",
+			Capabilities: capabilities.DefaultSpecCapabilities(),
 		},
 		Hostname: "capsule",
 		Mounts: []specs.Mount{
@@ -65,6 +68,8 @@ func Example() *specs.Spec {
 			},
 		},
 		Linux: &specs.Linux{
+			MaskedPaths:   rootfs.DefaultMaskedPaths,
+			ReadonlyPaths: rootfs.DefaultReadonlyPaths,
 			Resources: &specs.LinuxResources{
 				Devices: []specs.LinuxDeviceCgroup{
 					{
@@ -12,7 +12,7 @@ import (
 /*
 将specs.Spec转为libcapsule.ContainerConfig
 */
-func CreateContainerConfig(bundle string, spec *specs.Spec, network string, portMappings []string) (*configs.ContainerConfig, error) {
+func CreateContainerConfig(bundle string, spec *specs.Spec, endpointConfig configs.EndpointConfig) (*configs.ContainerConfig, error) {
 	logrus.Infof("converting specs.Spec to libcapsule.ContainerConfig...")
 	if bundle == "" {
 		cwd, err := os.Getwd()
@@ -70,10 +70,21 @@ func CreateContainerConfig(bundle string, spec *specs.Spec, network string, port
 		}
 		logrus.Infof("convert namespaces complete, config.Namespaces: %#v", config.Namespaces)
 		config.Sysctl = spec.Linux.Sysctl
+		if config.RootPropagation, err = parseRootfsPropagation(spec.Linux.RootfsPropagation); err != nil {
+			return nil, err
+		}
+		config.MaskPaths = spec.Linux.MaskedPaths
+		config.ReadonlyPaths = spec.Linux.ReadonlyPaths
+		config.Seccomp = createSeccomp(spec.Linux.Seccomp)
+	}
+
+	// 没有mount namespace时，挂载、屏蔽路径以及切换rootfs都会作用于宿主机
+	if !config.Namespaces.Contains(configs.NEWNS) {
+		return nil, fmt.Errorf("a mount namespace is required to set up the container rootfs, add linux.namespaces[].type=mount to the spec")
 	}
 
 	// 转换网络
-	if err := createNetworkConfig(config, network, portMappings); err != nil {
+	if err := createNetworkConfig(config, endpointConfig); err != nil {
 		return nil, err
 	}
 	config.Version = specs.Version
@@ -95,7 +95,18 @@ func createDevices(spec *specs.Spec, config *configs.ContainerConfig) error {
 				Uid:      uid,
 				Gid:      gid,
 			}
-			config.Devices = append(config.Devices, device)
+			// 与默认设备路径相同时，以spec中的为准
+			replaced := false
+			for i, d := range config.Devices {
+				if d.Path == device.Path {
+					config.Devices[i] = device
+					replaced = true
+					break
+				}
+			}
+			if !replaced {
+				config.Devices = append(config.Devices, device)
+			}
 		}
 	}
 	return nil
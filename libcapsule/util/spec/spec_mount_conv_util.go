@@ -1,6 +1,7 @@
 package spec
 
 import (
+	"fmt"
 	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/sirupsen/logrus"
 	"github.com/songxinjianqwe/capsule/libcapsule/configs"
@@ -48,9 +49,23 @@ var flags = map[string]struct {
 	"sync":          {false, unix.MS_SYNCHRONOUS},
 }
 
+/*
+挂载的传播类型，不能与其他flag一起使用，需要在挂载之后单独设置
+*/
+var propagationFlags = map[string]int{
+	"private":     unix.MS_PRIVATE,
+	"shared":      unix.MS_SHARED,
+	"slave":       unix.MS_SLAVE,
+	"unbindable":  unix.MS_UNBINDABLE,
+	"rprivate":    unix.MS_PRIVATE | unix.MS_REC,
+	"rshared":     unix.MS_SHARED | unix.MS_REC,
+	"rslave":      unix.MS_SLAVE | unix.MS_REC,
+	"runbindable": unix.MS_UNBINDABLE | unix.MS_REC,
+}
+
 func createMount(cwd string, specMount specs.Mount) *configs.Mount {
 	logrus.Infof("converting specs.mount to configs.Mount...")
-	flags, data := parseMountOptions(specMount.Options)
+	flags, pgflags, data := parseMountOptions(specMount.Options)
 	source := specMount.Source
 	device := specMount.Type
 	if flags&unix.MS_BIND != 0 {
@@ -63,19 +78,22 @@ func createMount(cwd string, specMount specs.Mount) *configs.Mount {
 	}
 	return &configs.Mount{
 		// device是type，比如proc、tmpfs
-		Device:      device,
-		Source:      source,
-		Destination: specMount.Destination,
-		Data:        data,
-		Flags:       flags,
+		Device:           device,
+		Source:           source,
+		Destination:      specMount.Destination,
+		Data:             data,
+		Flags:            flags,
+		PropagationFlags: pgflags,
 	}
 }
 
-// parseMountOptions parses the string and returns the flags and any mount data that it contains.
-func parseMountOptions(options []string) (int, string) {
+// parseMountOptions parses the string and returns the flags, propagation
+// flags and any mount data that it contains.
+func parseMountOptions(options []string) (int, []int, string) {
 	var (
-		flag int
-		data []string
+		flag   int
+		pgflag []int
+		data   []string
 	)
 	for _, o := range options {
 		if f, exists := flags[o]; exists && f.flag != 0 {
@@ -84,9 +102,24 @@ func parseMountOptions(options []string) (int, string) {
 			} else {
 				flag |= f.flag
 			}
+		} else if f, exists := propagationFlags[o]; exists && f != 0 {
+			pgflag = append(pgflag, f)
 		} else {
 			data = append(data, o)
 		}
 	}
-	return flag, strings.Join(data, ",")
+	return flag, pgflag, strings.Join(data, ",")
+}
+
+/*
+spec.Linux.RootfsPropagation，没有设置时为0
+*/
+func parseRootfsPropagation(propagation string) (int, error) {
+	if propagation == "" {
+		return 0, nil
+	}
+	if flag, exists := propagationFlags[propagation]; exists {
+		return flag, nil
+	}
+	return 0, fmt.Errorf("rootfs propagation %s is not supported", propagation)
 }
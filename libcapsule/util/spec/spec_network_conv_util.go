@@ -6,19 +6,16 @@ import (
 	"github.com/songxinjianqwe/capsule/libcapsule/network"
 )
 
-func createNetworkConfig(config *configs.ContainerConfig, networkName string, portMappings []string) error {
+func createNetworkConfig(config *configs.ContainerConfig, endpointConfig configs.EndpointConfig) error {
 	// veth端点
 	id, err := uuid.NewV4()
 	if err != nil {
 		return err
 	}
-	if networkName == "" {
-		networkName = network.DefaultBridgeName
-	}
-	config.Endpoint = configs.EndpointConfig{
-		ID:           id.String(),
-		NetworkName:  networkName,
-		PortMappings: portMappings,
+	endpointConfig.ID = id.String()
+	if endpointConfig.NetworkName == "" {
+		endpointConfig.NetworkName = network.DefaultBridgeName
 	}
+	config.Endpoint = endpointConfig
 	return nil
 }
@@ -0,0 +1,69 @@
+package spec
+
+import (
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/songxinjianqwe/capsule/libcapsule/configs"
+)
+
+/*
+spec.Linux.Seccomp，没有设置时为nil，即不做限制
+vendor中的specs.LinuxSeccomp没有errnoRet，转换后的ErrnoRet均为nil，由调用方补充
+*/
+func createSeccomp(seccomp *specs.LinuxSeccomp) *configs.Seccomp {
+	if seccomp == nil {
+		return nil
+	}
+	config := &configs.Seccomp{
+		DefaultAction: string(seccomp.DefaultAction),
+	}
+	for _, arch := range seccomp.Architectures {
+		config.Architectures = append(config.Architectures, string(arch))
+	}
+	for _, syscall := range seccomp.Syscalls {
+		rule := &configs.Syscall{
+			Names:  syscall.Names,
+			Action: string(syscall.Action),
+		}
+		for _, arg := range syscall.Args {
+			rule.Args = append(rule.Args, &configs.SeccompArg{
+				Index:    arg.Index,
+				Value:    arg.Value,
+				ValueTwo: arg.ValueTwo,
+				Op:       string(arg.Op),
+			})
+		}
+		config.Syscalls = append(config.Syscalls, rule)
+	}
+	return config
+}
+
+/*
+与createSeccomp相反，用于把configs.Seccomp放入spec中
+*/
+func SeccompToSpec(config *configs.Seccomp) *specs.LinuxSeccomp {
+	if config == nil {
+		return nil
+	}
+	seccomp := &specs.LinuxSeccomp{
+		DefaultAction: specs.LinuxSeccompAction(config.DefaultAction),
+	}
+	for _, arch := range config.Architectures {
+		seccomp.Architectures = append(seccomp.Architectures, specs.Arch(arch))
+	}
+	for _, rule := range config.Syscalls {
+		syscall := specs.LinuxSyscall{
+			Names:  rule.Names,
+			Action: specs.LinuxSeccompAction(rule.Action),
+		}
+		for _, arg := range rule.Args {
+			syscall.Args = append(syscall.Args, specs.LinuxSeccompArg{
+				Index:    arg.Index,
+				Value:    arg.Value,
+				ValueTwo: arg.ValueTwo,
+				Op:       specs.LinuxSeccompOperator(arg.Op),
+			})
+		}
+		seccomp.Syscalls = append(seccomp.Syscalls, syscall)
+	}
+	return seccomp
+}
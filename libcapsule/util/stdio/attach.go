@@ -0,0 +1,162 @@
+package stdio
+
+import (
+	"errors"
+	"fmt"
+	"github.com/songxinjianqwe/capsule/libcapsule/util/console"
+	"golang.org/x/sys/unix"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+const DefaultDetachKeys = "ctrl-p,ctrl-q"
+
+var ErrDetached = errors.New("detached from container")
+
+/*
+解析detach的按键序列，格式与docker一致，比如ctrl-p,ctrl-q
+每一项可以是单个字符，或ctrl-加上一个字母及@[\]^_中的一个
+*/
+func ParseDetachKeys(keys string) ([]byte, error) {
+	var sequence []byte
+	for _, key := range strings.Split(keys, ",") {
+		key = strings.TrimSpace(key)
+		switch {
+		case len(key) == 1:
+			sequence = append(sequence, key[0])
+		case strings.HasPrefix(key, "ctrl-") && len(key) == len("ctrl-")+1:
+			c := key[len(key)-1]
+			switch {
+			case c >= 'a' && c <= 'z':
+				sequence = append(sequence, c-'a'+1)
+			case c == '@':
+				sequence = append(sequence, 0)
+			case c >= '[' && c <= '_':
+				sequence = append(sequence, c-'['+27)
+			default:
+				return nil, fmt.Errorf("invalid detach key %q", key)
+			}
+		default:
+			return nil, fmt.Errorf("invalid detach key %q", key)
+		}
+	}
+	return sequence, nil
+}
+
+/*
+检测输入中的detach按键序列，匹配到时返回ErrDetached
+只匹配了一部分的按键先暂存，后续不匹配时再原样输出
+*/
+type detachKeysReader struct {
+	reader   io.Reader
+	keys     []byte
+	matched  int
+	pending  []byte
+	detached bool
+}
+
+func (r *detachKeysReader) Read(p []byte) (int, error) {
+	if len(r.pending) > 0 {
+		n := copy(p, r.pending)
+		r.pending = r.pending[n:]
+		return n, nil
+	}
+	if r.detached {
+		return 0, ErrDetached
+	}
+	buf := make([]byte, len(p))
+	n, err := r.reader.Read(buf)
+	var out []byte
+	for _, b := range buf[:n] {
+		if b == r.keys[r.matched] {
+			r.matched++
+			if r.matched == len(r.keys) {
+				// 按键序列之前的输入仍然要发送出去
+				r.detached = true
+				err = nil
+				break
+			}
+			continue
+		}
+		out = append(out, r.keys[:r.matched]...)
+		r.matched = 0
+		if b == r.keys[0] {
+			r.matched = 1
+			continue
+		}
+		out = append(out, b)
+	}
+	// 输入结束时，暂存的部分按键也要发送出去
+	if err == io.EOF && !r.detached && r.matched > 0 {
+		out = append(out, r.keys[:r.matched]...)
+		r.matched = 0
+	}
+	copied := copy(p, out)
+	r.pending = out[copied:]
+	if len(r.pending) > 0 && err == io.EOF {
+		// 先把暂存的内容读完，下次Read时reader会再次返回EOF
+		err = nil
+	}
+	if copied == 0 && r.detached {
+		return 0, ErrDetached
+	}
+	return copied, err
+}
+
+/*
+连接到容器的stdio relay，将relay发来的stdout、stderr写到当前进程的stdout、stderr
+stdin为nil时只读取输出
+返回nil表示容器的输出已经结束，返回ErrDetached表示用户按下了detach按键
+*/
+func Attach(socketPath string, stdin io.Reader, detachKeys []byte) error {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	done := make(chan error, 2)
+	if stdin != nil {
+		// 与console一样将终端设置为raw模式，否则ctrl-p、ctrl-q等按键会被终端的行编辑、流控处理掉，detach按键无法逐个读到
+		if file, ok := stdin.(*os.File); ok {
+			if termios, err := unix.IoctlGetTermios(int(file.Fd()), unix.TCGETS); err == nil {
+				raw := *termios
+				console.MakeRaw(&raw)
+				// relay转发的是没有pty的容器的输出，换行只有\n，保留输出处理才能换行到行首
+				raw.Oflag |= termios.Oflag & unix.OPOST
+				if err := unix.IoctlSetTermios(int(file.Fd()), unix.TCSETS, &raw); err != nil {
+					return err
+				}
+				defer unix.IoctlSetTermios(int(file.Fd()), unix.TCSETS, termios)
+			}
+		}
+		go func() {
+			_, err := io.Copy(conn, &detachKeysReader{reader: stdin, keys: detachKeys})
+			if err == ErrDetached {
+				done <- err
+				return
+			}
+			// stdin结束后，继续读取容器的输出
+			conn.(*net.UnixConn).CloseWrite()
+		}()
+	}
+	go func() {
+		for {
+			stream, data, err := decodeFrame(conn)
+			if err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				done <- err
+				return
+			}
+			if stream == StreamStderr {
+				os.Stderr.Write(data)
+			} else {
+				os.Stdout.Write(data)
+			}
+		}
+	}()
+	return <-done
+}
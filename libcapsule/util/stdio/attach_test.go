@@ -0,0 +1,132 @@
+package stdio
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+)
+
+func TestParseDetachKeys(t *testing.T) {
+	for _, c := range []struct {
+		keys     string
+		expected []byte
+	}{
+		{"ctrl-p,ctrl-q", []byte{0x10, 0x11}},
+		{"ctrl-a", []byte{0x01}},
+		{"ctrl-z", []byte{0x1a}},
+		{"ctrl-@", []byte{0x00}},
+		{"ctrl-[,ctrl-\\,ctrl-],ctrl-^,ctrl-_", []byte{0x1b, 0x1c, 0x1d, 0x1e, 0x1f}},
+		{"a,b", []byte{'a', 'b'}},
+		{" ctrl-p , q ", []byte{0x10, 'q'}},
+	} {
+		sequence, err := ParseDetachKeys(c.keys)
+		assert.Nil(t, err, c.keys)
+		assert.Equal(t, c.expected, sequence, c.keys)
+	}
+	for _, keys := range []string{"", "ab", "ctrl-", "ctrl-1", "ctrl-A", "ctrl-pq", "shift-a", "ctrl-p,,ctrl-q"} {
+		_, err := ParseDetachKeys(keys)
+		assert.NotNil(t, err, keys)
+	}
+}
+
+/*
+每次Read返回chunks中的一段
+*/
+type chunkReader struct {
+	chunks [][]byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.chunks[0])
+	r.chunks[0] = r.chunks[0][n:]
+	if len(r.chunks[0]) == 0 {
+		r.chunks = r.chunks[1:]
+	}
+	return n, nil
+}
+
+/*
+以bufferSize大小的buffer读完reader，返回读到的内容和最后的错误
+*/
+func readDetachKeys(chunks []string, bufferSize int) (string, error) {
+	reader := &chunkReader{}
+	for _, chunk := range chunks {
+		reader.chunks = append(reader.chunks, []byte(chunk))
+	}
+	r := &detachKeysReader{reader: reader, keys: []byte{0x10, 0x11}}
+	var out bytes.Buffer
+	buf := make([]byte, bufferSize)
+	for {
+		n, err := r.Read(buf)
+		out.Write(buf[:n])
+		if err != nil {
+			return out.String(), err
+		}
+	}
+}
+
+func TestDetachKeysReader(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		chunks   []string
+		output   string
+		detached bool
+	}{
+		{"no detach keys", []string{"hello", " world"}, "hello world", false},
+		{"detach keys only", []string{"\x10\x11"}, "", true},
+		{"detach in the middle of a buffer", []string{"ab\x10\x11cd"}, "ab", true},
+		{"detach keys across reads", []string{"ab\x10", "\x11cd"}, "ab", true},
+		{"partial match followed by other input", []string{"a\x10b"}, "a\x10b", false},
+		{"partial match across reads followed by other input", []string{"a\x10", "b"}, "a\x10b", false},
+		{"repeated first key", []string{"\x10\x10\x11"}, "\x10", true},
+		{"second key only", []string{"\x11\x10"}, "\x11\x10", false},
+		{"partial match at the end of input", []string{"ab\x10"}, "ab\x10", false},
+	} {
+		for _, bufferSize := range []int{1, 2, 64} {
+			output, err := readDetachKeys(c.chunks, bufferSize)
+			assert.Equal(t, c.output, output, "%s with buffer size %d", c.name, bufferSize)
+			if c.detached {
+				assert.Equal(t, ErrDetached, err, "%s with buffer size %d", c.name, bufferSize)
+			} else {
+				assert.Equal(t, io.EOF, err, "%s with buffer size %d", c.name, bufferSize)
+			}
+		}
+	}
+}
+
+func TestFrame(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(encodeFrame(StreamStdout, []byte("hello")))
+	buf.Write(encodeFrame(StreamStderr, []byte("error\n")))
+	buf.Write(encodeFrame(StreamStdout, nil))
+
+	stream, data, err := decodeFrame(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, StreamStdout, stream)
+	assert.Equal(t, "hello", string(data))
+
+	stream, data, err = decodeFrame(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, StreamStderr, stream)
+	assert.Equal(t, "error\n", string(data))
+
+	stream, data, err = decodeFrame(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, StreamStdout, stream)
+	assert.Empty(t, data)
+
+	// 连接关闭
+	_, _, err = decodeFrame(&buf)
+	assert.Equal(t, io.EOF, err)
+
+	// 帧不完整
+	frame := encodeFrame(StreamStdout, []byte("hello"))
+	_, _, err = decodeFrame(bytes.NewReader(frame[:3]))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	_, _, err = decodeFrame(bytes.NewReader(frame[:len(frame)-1]))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
@@ -0,0 +1,174 @@
+package stdio
+
+import (
+	"encoding/binary"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"os"
+	"sync"
+)
+
+const (
+	StreamStdout byte = 1
+	StreamStderr byte = 2
+
+	// 帧头: 1字节的stream + 4字节的长度
+	frameHeaderSize = 5
+	readBufferSize  = 32 * 1024
+	// attach的客户端消费太慢时，积压超过这么多帧就断开它，避免拖慢容器进程的输出
+	clientQueueSize = 256
+)
+
+/*
+后台运行的容器的stdio中转:
+1. 容器进程的stdout、stderr写入日志文件，同时广播给所有attach上来的客户端
+2. 任意一个客户端的输入都写入容器进程的stdin
+relay -> client的数据按帧发送，以区分stdout和stderr；client -> relay的数据不分帧，直接作为stdin
+*/
+type Relay struct {
+	listener net.Listener
+	logFile  *os.File
+	stdin    *os.File
+	mutex    sync.Mutex
+	clients  map[*relayClient]bool
+}
+
+type relayClient struct {
+	conn   net.Conn
+	frames chan []byte
+}
+
+func NewRelay(listener net.Listener, logFile *os.File, stdin *os.File) *Relay {
+	return &Relay{
+		listener: listener,
+		logFile:  logFile,
+		stdin:    stdin,
+		clients:  make(map[*relayClient]bool),
+	}
+}
+
+/*
+阻塞运行，直至容器进程的stdout和stderr都被关闭(即容器中所有持有它们的进程都已退出)
+*/
+func (relay *Relay) Serve(stdout *os.File, stderr *os.File) error {
+	go relay.accept()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go relay.forward(StreamStdout, stdout, &wg)
+	go relay.forward(StreamStderr, stderr, &wg)
+	wg.Wait()
+	logrus.Infof("container stdout and stderr closed, stopping relay")
+	relay.listener.Close()
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+	for client := range relay.clients {
+		relay.removeClient(client)
+	}
+	return nil
+}
+
+func (relay *Relay) accept() {
+	for {
+		conn, err := relay.listener.Accept()
+		if err != nil {
+			return
+		}
+		client := &relayClient{
+			conn:   conn,
+			frames: make(chan []byte, clientQueueSize),
+		}
+		relay.mutex.Lock()
+		relay.clients[client] = true
+		logrus.Infof("client attached, total: %d", len(relay.clients))
+		relay.mutex.Unlock()
+		go relay.writeFrames(client)
+		go relay.readStdin(client)
+	}
+}
+
+func (relay *Relay) forward(stream byte, source *os.File, wg *sync.WaitGroup) {
+	defer wg.Done()
+	buf := make([]byte, readBufferSize)
+	for {
+		n, err := source.Read(buf)
+		if n > 0 {
+			if _, err := relay.logFile.Write(buf[:n]); err != nil {
+				logrus.Warnf("write container log failed, cause: %s", err.Error())
+			}
+			relay.broadcast(encodeFrame(stream, buf[:n]))
+		}
+		if err != nil {
+			if err != io.EOF {
+				logrus.Warnf("read container stream %d failed, cause: %s", stream, err.Error())
+			}
+			return
+		}
+	}
+}
+
+func (relay *Relay) broadcast(frame []byte) {
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+	for client := range relay.clients {
+		select {
+		case client.frames <- frame:
+		default:
+			logrus.Warnf("client %s is too slow, detaching it", client.conn.RemoteAddr())
+			relay.removeClient(client)
+		}
+	}
+}
+
+// 调用方需要持有mutex
+func (relay *Relay) removeClient(client *relayClient) {
+	if !relay.clients[client] {
+		return
+	}
+	delete(relay.clients, client)
+	// writeFrames发送完积压的帧后会关闭连接
+	close(client.frames)
+}
+
+func (relay *Relay) readStdin(client *relayClient) {
+	// 客户端detach或关闭了自己的stdin，容器的stdin保持打开，其他客户端还可以继续输入
+	if _, err := io.Copy(relay.stdin, client.conn); err != nil {
+		logrus.Infof("stop copying stdin from client, cause: %s", err.Error())
+	}
+}
+
+func (relay *Relay) writeFrames(client *relayClient) {
+	defer client.conn.Close()
+	for frame := range client.frames {
+		if _, err := client.conn.Write(frame); err != nil {
+			// 客户端已经断开(比如detach)
+			relay.mutex.Lock()
+			relay.removeClient(client)
+			relay.mutex.Unlock()
+			return
+		}
+	}
+}
+
+func encodeFrame(stream byte, data []byte) []byte {
+	frame := make([]byte, frameHeaderSize+len(data))
+	frame[0] = stream
+	binary.BigEndian.PutUint32(frame[1:frameHeaderSize], uint32(len(data)))
+	copy(frame[frameHeaderSize:], data)
+	return frame
+}
+
+/*
+读取一帧，连接关闭时返回io.EOF
+*/
+func decodeFrame(reader io.Reader) (byte, []byte, error) {
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(header[1:]))
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return 0, nil, err
+	}
+	return header[0], data, nil
+}
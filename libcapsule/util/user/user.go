@@ -0,0 +1,206 @@
+package user
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// 容器rootfs中的用户和用户组文件
+	PasswdPath = "/etc/passwd"
+	GroupPath  = "/etc/group"
+)
+
+/*
+/etc/passwd中的一行
+name:password:uid:gid:gecos:home:shell
+*/
+type User struct {
+	Name string
+	Uid  int
+	Gid  int
+	Home string
+}
+
+/*
+/etc/group中的一行
+name:password:gid:member1,member2
+*/
+type Group struct {
+	Name    string
+	Gid     int
+	Members []string
+}
+
+/*
+解析后，容器进程最终使用的用户
+*/
+type ExecUser struct {
+	Uid   int
+	Gid   int
+	Sgids []int
+	Home  string
+}
+
+/*
+解析user[:group]，user和group既可以是名字也可以是数字
+用户在/etc/group中所属的组和additionalGroups都会作为附加组
+passwd和group文件不存在时，只能使用数字
+*/
+func GetExecUser(userSpec string, additionalGroups []string, passwdPath, groupPath string) (*ExecUser, error) {
+	users, err := parsePasswdFile(passwdPath)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := parseGroupFile(groupPath)
+	if err != nil {
+		return nil, err
+	}
+	execUser := &ExecUser{Home: "/"}
+	userName, groupName := userSpec, ""
+	if i := strings.Index(userSpec, ":"); i >= 0 {
+		userName, groupName = userSpec[:i], userSpec[i+1:]
+	}
+
+	// 用户
+	var matched *User
+	if userName != "" {
+		uid, numericErr := strconv.Atoi(userName)
+		for i := range users {
+			if users[i].Name == userName || (numericErr == nil && users[i].Uid == uid) {
+				matched = &users[i]
+				break
+			}
+		}
+		switch {
+		case matched != nil:
+			execUser.Uid, execUser.Gid, execUser.Home = matched.Uid, matched.Gid, matched.Home
+		case numericErr == nil && uid >= 0:
+			execUser.Uid = uid
+		default:
+			return nil, fmt.Errorf("unable to find user %s: no matching entries in passwd file", userName)
+		}
+	}
+
+	// 主组
+	if groupName != "" {
+		if execUser.Gid, err = lookupGroup(groupName, groups); err != nil {
+			return nil, err
+		}
+	}
+
+	// 附加组
+	if matched != nil {
+		for _, group := range groups {
+			for _, member := range group.Members {
+				if member == matched.Name {
+					execUser.Sgids = append(execUser.Sgids, group.Gid)
+					break
+				}
+			}
+		}
+	}
+	for _, additionalGroup := range additionalGroups {
+		gid, err := lookupGroup(additionalGroup, groups)
+		if err != nil {
+			return nil, err
+		}
+		execUser.Sgids = append(execUser.Sgids, gid)
+	}
+	return execUser, nil
+}
+
+func lookupGroup(groupName string, groups []Group) (int, error) {
+	gid, numericErr := strconv.Atoi(groupName)
+	for _, group := range groups {
+		if group.Name == groupName || (numericErr == nil && group.Gid == gid) {
+			return group.Gid, nil
+		}
+	}
+	if numericErr == nil && gid >= 0 {
+		return gid, nil
+	}
+	return 0, fmt.Errorf("unable to find group %s: no matching entries in group file", groupName)
+}
+
+/*
+格式不对的行直接跳过，与glibc一致，不影响其他用户的解析
+*/
+func parsePasswdFile(path string) ([]User, error) {
+	lines, err := readEntries(path)
+	if err != nil {
+		return nil, err
+	}
+	var users []User
+	for _, fields := range lines {
+		if len(fields) < 7 {
+			logrus.Warnf("skip invalid passwd entry: %s", strings.Join(fields, ":"))
+			continue
+		}
+		uid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			logrus.Warnf("skip passwd entry %s with invalid uid: %s", fields[0], err.Error())
+			continue
+		}
+		gid, err := strconv.Atoi(fields[3])
+		if err != nil {
+			logrus.Warnf("skip passwd entry %s with invalid gid: %s", fields[0], err.Error())
+			continue
+		}
+		users = append(users, User{Name: fields[0], Uid: uid, Gid: gid, Home: fields[5]})
+	}
+	return users, nil
+}
+
+func parseGroupFile(path string) ([]Group, error) {
+	lines, err := readEntries(path)
+	if err != nil {
+		return nil, err
+	}
+	var groups []Group
+	for _, fields := range lines {
+		if len(fields) < 4 {
+			logrus.Warnf("skip invalid group entry: %s", strings.Join(fields, ":"))
+			continue
+		}
+		gid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			logrus.Warnf("skip group entry %s with invalid gid: %s", fields[0], err.Error())
+			continue
+		}
+		group := Group{Name: fields[0], Gid: gid}
+		if fields[3] != "" {
+			group.Members = strings.Split(fields[3], ",")
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+/*
+按行读取，每行按冒号分隔，忽略空行和注释，文件不存在时返回空
+*/
+func readEntries(path string) ([][]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	var entries [][]string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, strings.Split(line, ":"))
+	}
+	return entries, scanner.Err()
+}
@@ -0,0 +1,112 @@
+package user
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testPasswd = `# comment
+root:x:0:0:root:/root:/bin/sh
+
+daemon:x:1:1:daemon:/usr/sbin:/usr/sbin/nologin
+alice:x:1000:1000:Alice:/home/alice:/bin/sh
+broken:x:1001
+baduid:x:abc:1000::/home/baduid:/bin/sh
+badgid:x:1002:abc::/home/badgid:/bin/sh
+bob:x:1003:1003:Bob:/home/bob:/bin/sh
+`
+
+const testGroup = `root:x:0:
+daemon:x:1:
+alice:x:1000:
+broken:x
+badgid:x:abc:alice
+wheel:x:10:alice,bob
+docker:x:999:alice
+bob:x:1003:
+`
+
+func newUserFiles(t *testing.T) (string, string, func()) {
+	dir, err := ioutil.TempDir("", "capsule-user")
+	assert.Nil(t, err)
+	passwdPath := filepath.Join(dir, "passwd")
+	groupPath := filepath.Join(dir, "group")
+	assert.Nil(t, ioutil.WriteFile(passwdPath, []byte(testPasswd), 0644))
+	assert.Nil(t, ioutil.WriteFile(groupPath, []byte(testGroup), 0644))
+	return passwdPath, groupPath, func() { os.RemoveAll(dir) }
+}
+
+func TestGetExecUser(t *testing.T) {
+	passwdPath, groupPath, cleanup := newUserFiles(t)
+	defer cleanup()
+	for _, c := range []struct {
+		userSpec         string
+		additionalGroups []string
+		expected         ExecUser
+	}{
+		// 没有指定用户时为root
+		{"", nil, ExecUser{Uid: 0, Gid: 0, Home: "/"}},
+		{"root", nil, ExecUser{Uid: 0, Gid: 0, Home: "/root"}},
+		{"alice", nil, ExecUser{Uid: 1000, Gid: 1000, Sgids: []int{10, 999}, Home: "/home/alice"}},
+		{"1000", nil, ExecUser{Uid: 1000, Gid: 1000, Sgids: []int{10, 999}, Home: "/home/alice"}},
+		// 格式不对的行被跳过，不影响后面的用户
+		{"bob", nil, ExecUser{Uid: 1003, Gid: 1003, Sgids: []int{10}, Home: "/home/bob"}},
+		// 不在passwd中的数字uid
+		{"2000", nil, ExecUser{Uid: 2000, Gid: 0, Home: "/"}},
+		// 指定主组
+		{"alice:wheel", nil, ExecUser{Uid: 1000, Gid: 10, Sgids: []int{10, 999}, Home: "/home/alice"}},
+		{"alice:10", nil, ExecUser{Uid: 1000, Gid: 10, Sgids: []int{10, 999}, Home: "/home/alice"}},
+		{"2000:3000", nil, ExecUser{Uid: 2000, Gid: 3000, Home: "/"}},
+		{"daemon:", nil, ExecUser{Uid: 1, Gid: 1, Home: "/usr/sbin"}},
+		// 附加组
+		{"daemon", []string{"docker", "3000"}, ExecUser{Uid: 1, Gid: 1, Sgids: []int{999, 3000}, Home: "/usr/sbin"}},
+	} {
+		execUser, err := GetExecUser(c.userSpec, c.additionalGroups, passwdPath, groupPath)
+		assert.Nil(t, err, c.userSpec)
+		if err == nil {
+			assert.Equal(t, c.expected, *execUser, c.userSpec)
+		}
+	}
+}
+
+func TestGetExecUserNotFound(t *testing.T) {
+	passwdPath, groupPath, cleanup := newUserFiles(t)
+	defer cleanup()
+	for _, c := range []struct {
+		userSpec         string
+		additionalGroups []string
+	}{
+		{"nobody", nil},
+		// 格式不对的行被跳过，其中的用户和组都找不到
+		{"broken", nil},
+		{"baduid", nil},
+		{"alice:badgid", nil},
+		{"alice:nogroup", nil},
+		{"alice", []string{"nogroup"}},
+		{"-1", nil},
+	} {
+		_, err := GetExecUser(c.userSpec, c.additionalGroups, passwdPath, groupPath)
+		assert.NotNil(t, err, c.userSpec)
+	}
+}
+
+func TestGetExecUserWithoutFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capsule-user")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	passwdPath := filepath.Join(dir, "passwd")
+	groupPath := filepath.Join(dir, "group")
+
+	// passwd和group文件不存在时只能使用数字
+	execUser, err := GetExecUser("1000:1000", []string{"10"}, passwdPath, groupPath)
+	assert.Nil(t, err)
+	assert.Equal(t, ExecUser{Uid: 1000, Gid: 1000, Sgids: []int{10}, Home: "/"}, *execUser)
+
+	_, err = GetExecUser("alice", nil, passwdPath, groupPath)
+	assert.NotNil(t, err)
+	_, err = GetExecUser("1000:wheel", nil, passwdPath, groupPath)
+	assert.NotNil(t, err)
+}
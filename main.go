@@ -5,6 +5,7 @@ import (
 	"github.com/sirupsen/logrus"
 	capsuleCli "github.com/songxinjianqwe/capsule/cli/command"
 	"github.com/songxinjianqwe/capsule/libcapsule/constant"
+	"github.com/songxinjianqwe/capsule/libcapsule/network"
 	"github.com/urfave/cli"
 	"os"
 )
@@ -32,6 +33,11 @@ func main() {
 			Value: constant.DefaultRuntimeRoot,
 			Usage: "root directory for storage of container state (this should be located in tmpfs)",
 		},
+		cli.StringFlag{
+			Name:  "firewall",
+			Value: network.FirewallAuto,
+			Usage: "firewall backend for port mappings and masquerade: auto, iptables or nftables",
+		},
 	}
 	app.Commands = []cli.Command{
 		capsuleCli.CreateCommand,
@@ -48,6 +54,9 @@ func main() {
 		capsuleCli.LogCommand,
 		capsuleCli.NetworkCommand,
 		capsuleCli.ImagesCommand,
+		capsuleCli.AttachCommand,
+		capsuleCli.WaitCommand,
+		capsuleCli.ShimCommand,
 	}
 	// 日志是放在文件中的，而fmt.Printf是给用户看的
 	// 暂时将日志输出到stdout中
@@ -65,11 +74,12 @@ func main() {
 		logrus.SetLevel(logrus.InfoLevel)
 		//设置输出文件名和行号
 		logrus.SetReportCaller(true)
-		return nil
+		return network.SetFirewallBackend(ctx.GlobalString("firewall"))
 	}
 	err := app.Run(os.Args)
 	if err != nil {
 		logrus.Error(err)
 		fmt.Println(err)
+		os.Exit(1)
 	}
 }